@@ -0,0 +1,120 @@
+package fsdb
+
+import (
+	"context"
+	"fmt"
+)
+
+type aggregationOp int
+
+const (
+	aggregateCount aggregationOp = iota
+	aggregateSum
+	aggregateAvg
+)
+
+// Aggregation is a value computed over the results of a query, stored under
+// Alias in the AggregationResult.
+type Aggregation struct {
+	Alias string
+	Field string
+
+	op aggregationOp
+}
+
+// Count returns an Aggregation that counts the matching documents.
+func Count(alias string) Aggregation {
+	return Aggregation{Alias: alias, op: aggregateCount}
+}
+
+// Sum returns an Aggregation that adds up the numeric values of field.
+func Sum(alias string, field string) Aggregation {
+	return Aggregation{Alias: alias, Field: field, op: aggregateSum}
+}
+
+// Avg returns an Aggregation that averages the numeric values of field.
+func Avg(alias string, field string) Aggregation {
+	return Aggregation{Alias: alias, Field: field, op: aggregateAvg}
+}
+
+// AggregationResult maps each Aggregation's alias to its value. A count is
+// an int64. A sum is an int64 if every value summed was an integer and the
+// sum did not overflow, and a float64 otherwise. An average is a float64, or
+// nil if there were no numeric values.
+type AggregationResult map[string]interface{}
+
+// Int returns the value of an aggregation as an int64, truncating a float64.
+func (r AggregationResult) Int(alias string) int64 {
+	switch v := r[alias].(type) {
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+// Float returns the value of an aggregation as a float64.
+func (r AggregationResult) Float(alias string) float64 {
+	switch v := r[alias].(type) {
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+// Aggregate computes aggregations over the documents matching the query.
+//
+// Example:
+//
+//	result, err := db.Query("orders").
+//		Where("status", "==", "paid").
+//		Aggregate(ctx, fsdb.Count("n"), fsdb.Sum("total", "amount"))
+//	n := result.Int("n")
+func (q *Query) Aggregate(ctx context.Context, aggs ...Aggregation) (AggregationResult, error) {
+	q.db.recordQuery(&q.spec)
+	if q.tx != nil {
+		return q.tx.Aggregate(&q.spec, aggs)
+	}
+	return q.backend.Aggregate(ctx, &q.spec, aggs)
+}
+
+// Count returns the number of documents matching the query.
+func (q *Query) Count(ctx context.Context) (int64, error) {
+	result, err := q.Aggregate(ctx, Count("count"))
+	if err != nil {
+		return 0, err
+	}
+
+	n, ok := result["count"].(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected count type: %T", result["count"])
+	}
+
+	return n, nil
+}
+
+// Sum returns the sum of the numeric values of field in the documents
+// matching the query. Use Aggregate to get an integer sum exactly.
+func (q *Query) Sum(ctx context.Context, field string) (float64, error) {
+	result, err := q.Aggregate(ctx, Sum("sum", field))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.Float("sum"), nil
+}
+
+// Avg returns the average of the numeric values of field in the documents
+// matching the query, or 0 if there are none. Use Aggregate to tell an
+// average of 0 from no values.
+func (q *Query) Avg(ctx context.Context, field string) (float64, error) {
+	result, err := q.Aggregate(ctx, Avg("avg", field))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.Float("avg"), nil
+}
@@ -0,0 +1,96 @@
+package fsdb
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	orders := map[string]map[string]interface{}{
+		"users/alice/orders/1": {"status": "paid", "amount": 10},
+		"users/alice/orders/2": {"status": "paid", "amount": 2.5},
+		"users/alice/orders/3": {"status": "open", "amount": 7},
+		"users/bob/orders/1":   {"status": "paid", "amount": 20},
+		"users/bob/orders/2":   {"status": "paid", "amount": "n/a"},
+		"users/bob/orders/3":   {"status": "paid"},
+	}
+	for path, order := range orders {
+		err := db.Add(ctx, path, order)
+		if err != nil {
+			t.Fatalf("add %s: %v", path, err)
+		}
+	}
+
+	n, err := db.Query("users/alice/orders").Count(ctx)
+	if err != nil || n != 3 {
+		t.Fatalf("count: got %d, %v", n, err)
+	}
+
+	sum, err := db.Query("users/alice/orders").Where("status", "==", "paid").Sum(ctx, "amount")
+	if err != nil || sum != 12.5 {
+		t.Fatalf("filtered sum: got %v, %v", sum, err)
+	}
+
+	avg, err := db.Query("users/alice/orders").Where("status", "==", "closed").Avg(ctx, "amount")
+	if err != nil || avg != 0 {
+		t.Fatalf("avg of nothing: got %v, %v", avg, err)
+	}
+
+	result, err := db.QueryGroup("orders").Where("status", "==", "paid").Aggregate(ctx,
+		Count("n"), Sum("total", "amount"), Avg("mean", "amount"), Avg("none", "missing"))
+	if err != nil {
+		t.Fatalf("aggregate: %v", err)
+	}
+	if result["n"] != int64(5) || result["total"] != 32.5 || result["mean"] != 32.5/3 || result["none"] != nil {
+		t.Fatalf("aggregate: unexpected %#v", result)
+	}
+
+	result, err = db.QueryGroup("orders").Where("amount", ">", 5).Aggregate(ctx, Sum("total", "amount"), Avg("mean", "amount"))
+	if err != nil {
+		t.Fatalf("aggregate: %v", err)
+	}
+	if result["total"] != int64(37) || result.Int("total") != 37 || result.Float("mean") != 37.0/3 {
+		t.Fatalf("integer sum: unexpected %#v", result)
+	}
+
+	err = db.Add(ctx, "big/1", map[string]interface{}{"v": int64(math.MaxInt64)})
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	err = db.Add(ctx, "big/2", map[string]interface{}{"v": 1})
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	result, err = db.Query("big").Aggregate(ctx, Sum("total", "v"))
+	if err != nil {
+		t.Fatalf("aggregate: %v", err)
+	}
+	if _, ok := result["total"].(float64); !ok {
+		t.Fatalf("overflowing sum: expected float64, got %#v", result["total"])
+	}
+
+	_, err = db.Query("big").Aggregate(ctx, Count("n"), Count("n"))
+	if err == nil {
+		t.Fatalf("duplicate alias: expected error")
+	}
+
+	err = db.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		n, err := tx.Query("users/bob/orders").Count(ctx)
+		if err != nil {
+			return err
+		}
+		return tx.AddOrReplace("counts/bob", map[string]interface{}{"orders": n})
+	})
+	if err != nil {
+		t.Fatalf("transaction: %v", err)
+	}
+	m := map[string]interface{}{}
+	err = db.Get(ctx, "counts/bob", &m)
+	if err != nil || m["orders"] != int64(3) {
+		t.Fatalf("transaction count: got %#v, %v", m, err)
+	}
+}
@@ -0,0 +1,345 @@
+package fsdb
+
+import (
+	"context"
+	"time"
+)
+
+// Backend is the storage layer behind a DBConnection.
+//
+// Paths passed to a Backend are slash separated and relative to the root of
+// the database (e.g. "users/alice" or "users/alice/posts"). Paths returned by
+// a Backend (BackendDocument.Path, BackendCollectionIterator.Next) are full
+// resource names in the form Firestore reports them:
+// "projects/{project}/databases/{database}/documents/{path}".
+//
+// Iterators returned by a Backend must return DBIteratorDone when exhausted,
+// and errors must carry gRPC status codes so ErrorIsNotFound and friends work.
+type Backend interface {
+	// Get reads the document at path, returning a NotFound error if it does not exist.
+	Get(ctx context.Context, path string) (BackendDocument, error)
+
+	// Create writes a new document, returning an AlreadyExists error if it exists.
+	Create(ctx context.Context, path string, dval interface{}) error
+
+	// Set creates or replaces the document at path.
+	Set(ctx context.Context, path string, dval interface{}) error
+
+	// SetMerge creates the document at path or merges dval into it. Only
+	// the dot separated field paths in fields are written; if fields is
+	// empty, every field in dval is, and dval must be a map.
+	SetMerge(ctx context.Context, path string, dval interface{}, fields []string) error
+
+	// Update changes fields of an existing document, returning a NotFound
+	// error if it does not exist. At most one precondition may be given.
+	Update(ctx context.Context, path string, updates []FieldUpdate, preconds ...Precondition) error
+
+	// Delete removes the document at path. Deleting a missing document is
+	// not an error unless a precondition requires it to exist. At most one
+	// precondition may be given.
+	Delete(ctx context.Context, path string, preconds ...Precondition) error
+
+	// Documents runs a query.
+	Documents(ctx context.Context, q *QuerySpec) BackendDocumentIterator
+
+	// Collections lists the subcollections of the document at path.
+	Collections(ctx context.Context, path string) BackendCollectionIterator
+
+	// DocumentRefs lists the paths of the documents in the collection at
+	// path, including missing documents that only have subcollections.
+	DocumentRefs(ctx context.Context, path string) BackendCollectionIterator
+
+	// Aggregate computes aggregations over the documents matching a query.
+	Aggregate(ctx context.Context, q *QuerySpec, aggs []Aggregation) (AggregationResult, error)
+
+	// Explain returns the plan for a query and, if analyze is set, runs it
+	// and returns its execution statistics.
+	Explain(ctx context.Context, q *QuerySpec, analyze bool) (*Explanation, error)
+
+	// RunTransaction runs f in a transaction, retrying on contention.
+	RunTransaction(ctx context.Context, f func(ctx context.Context, tx BackendTransaction) error) error
+
+	// ListenDocument returns an iterator over successive snapshots of a
+	// single document. A snapshot is delivered for a document that does not
+	// exist; its Exists method returns false.
+	ListenDocument(ctx context.Context, path string) BackendDocumentIterator
+
+	// ListenQuery returns an iterator over successive snapshots of a query.
+	ListenQuery(ctx context.Context, q *QuerySpec) BackendQueryIterator
+
+	// BulkWriter returns a writer that applies queued writes independently
+	// and in parallel, throttling and retrying as needed.
+	BulkWriter(ctx context.Context) BackendBulkWriter
+}
+
+// BackendTransaction is the set of operations a Backend supports inside a transaction.
+// As with Firestore, all reads must happen before any writes.
+type BackendTransaction interface {
+	Get(path string) (BackendDocument, error)
+	Documents(q *QuerySpec) BackendDocumentIterator
+	Aggregate(q *QuerySpec, aggs []Aggregation) (AggregationResult, error)
+	Create(path string, dval interface{}) error
+	Set(path string, dval interface{}) error
+	SetMerge(path string, dval interface{}, fields []string) error
+	Update(path string, updates []FieldUpdate) error
+	Delete(path string) error
+}
+
+// BackendBulkWriter queues writes for a Backend to apply in batches. Each
+// document may be written at most once by a given BackendBulkWriter.
+type BackendBulkWriter interface {
+	Create(path string, dval interface{}) (BackendWriteJob, error)
+	Set(path string, dval interface{}) (BackendWriteJob, error)
+	Update(path string, updates []FieldUpdate) (BackendWriteJob, error)
+	Delete(path string) (BackendWriteJob, error)
+
+	// Flush sends every queued write and waits for them to complete.
+	Flush()
+
+	// End flushes the writer and closes it to further writes.
+	End()
+}
+
+// BackendWriteJob is a single write queued on a BackendBulkWriter.
+type BackendWriteJob interface {
+	// Result blocks until the write has been applied, and returns its error.
+	Result() error
+}
+
+// FieldUpdate changes a single field of an existing document. Path is a
+// dot separated field path. Value may be firestore.Delete to remove the
+// field, or firestore.ServerTimestamp to set it to the commit time.
+//
+// FieldUpdates made by Increment, ArrayUnion and ArrayRemove are applied by
+// the server to the field's current value.
+type FieldUpdate struct {
+	Path  string
+	Value interface{}
+
+	transform fieldTransform
+}
+
+type fieldTransform int
+
+const (
+	transformNone fieldTransform = iota
+	transformIncrement
+	transformArrayUnion
+	transformArrayRemove
+)
+
+// Precondition is a condition on the current state of a document that a
+// write requires. A write whose precondition does not hold fails with a
+// FailedPrecondition error, or NotFound if the document must exist.
+type Precondition struct {
+	exists     bool
+	updateTime time.Time
+}
+
+// Exists requires the document to exist.
+var Exists = Precondition{exists: true}
+
+// LastUpdateTime requires the document to exist and to have last been
+// written at t.
+func LastUpdateTime(t time.Time) Precondition {
+	return Precondition{updateTime: t}
+}
+
+// BackendDocument is a document read from a Backend.
+type BackendDocument interface {
+	// Path returns the full resource name of the document.
+	Path() string
+
+	// Exists reports whether the document exists.
+	Exists() bool
+
+	// Data returns the document's fields as a map.
+	Data() map[string]interface{}
+
+	// DataTo decodes the document's fields into dval, which must be a pointer.
+	DataTo(dval interface{}) error
+
+	// CreateTime returns the time the document was created, or the zero time if it does not exist.
+	CreateTime() time.Time
+
+	// UpdateTime returns the time the document was last written, or the zero time if it does not exist.
+	UpdateTime() time.Time
+
+	// ReadTime returns the time the document was read.
+	ReadTime() time.Time
+}
+
+// BackendDocumentIterator iterates over documents returned by a Backend.
+type BackendDocumentIterator interface {
+	Next() (BackendDocument, error)
+	Stop()
+}
+
+// BackendCollectionIterator iterates over the full resource names of collections.
+type BackendCollectionIterator interface {
+	Next() (string, error)
+}
+
+// BackendQueryIterator iterates over the snapshots of a listened-to query.
+type BackendQueryIterator interface {
+	Next() (*BackendQuerySnapshot, error)
+	Stop()
+}
+
+// BackendQuerySnapshot is the state of a query at a point in time.
+type BackendQuerySnapshot struct {
+	// Docs holds the query results, in query order.
+	Docs []BackendDocument
+
+	// Changes holds the changes since the previous snapshot.
+	Changes []BackendDocumentChange
+
+	// ReadTime is the time the snapshot was taken.
+	ReadTime time.Time
+}
+
+// BackendDocumentChange is a single change to the results of a listened-to query.
+type BackendDocumentChange struct {
+	Kind DocumentChangeKind
+	Doc  BackendDocument
+
+	// OldIndex is the document's position before the change, or -1 if it was not present.
+	OldIndex int
+
+	// NewIndex is the document's position after the change, or -1 if it is no longer present.
+	NewIndex int
+}
+
+// QuerySpec is the backend-neutral description of a query built with Query.
+type QuerySpec struct {
+	// Collection is the collection path, or the collection ID when Group is set.
+	Collection string
+
+	// Group makes the query span every collection with the ID Collection.
+	Group bool
+
+	// Filters are ANDed together.
+	Filters []Filter
+
+	Orders []Order
+
+	// Start and End are the optional query cursors.
+	Start *Cursor
+	End   *Cursor
+
+	// Limit is the maximum number of results, or 0 for no limit.
+	Limit int
+
+	// LimitToLast takes the Limit results from the end of the ordered results.
+	LimitToLast bool
+
+	Offset int
+
+	// Projected is set when Select was called; only Fields are returned.
+	Projected bool
+	Fields    []string
+}
+
+// Filter is a condition on the documents returned by a query: either a
+// PropertyFilter or a CompositeFilter.
+type Filter interface {
+	isFilter()
+}
+
+// PropertyFilter is a single field comparison.
+type PropertyFilter struct {
+	Path  string
+	Op    string
+	Value interface{}
+}
+
+// CompositeFilter combines filters. Op is "and" or "or".
+type CompositeFilter struct {
+	Op      string
+	Filters []Filter
+}
+
+func (PropertyFilter) isFilter()  {}
+func (CompositeFilter) isFilter() {}
+
+// Order is a single OrderBy clause.
+type Order struct {
+	Path string
+	Dir  Direction
+}
+
+// Cursor is a position in the ordered results of a query.
+// Values correspond to the query's OrderBy fields, in order.
+type Cursor struct {
+	Values []interface{}
+
+	// Inclusive is set for StartAt and EndAt, and clear for StartAfter and EndBefore.
+	Inclusive bool
+}
+
+// errorDocumentIterator is returned when a request fails before it can be
+// sent; every call to Next returns the error.
+type errorDocumentIterator struct {
+	err error
+}
+
+func (it *errorDocumentIterator) Next() (BackendDocument, error) {
+	return nil, it.err
+}
+
+func (it *errorDocumentIterator) Stop() {
+}
+
+type errorCollectionIterator struct {
+	err error
+}
+
+func (it *errorCollectionIterator) Next() (string, error) {
+	return "", it.err
+}
+
+type errorQueryIterator struct {
+	err error
+}
+
+func (it *errorQueryIterator) Next() (*BackendQuerySnapshot, error) {
+	return nil, it.err
+}
+
+func (it *errorQueryIterator) Stop() {
+}
+
+// getAll drains a document iterator.
+func getAll(iter BackendDocumentIterator) ([]BackendDocument, error) {
+	docs := make([]BackendDocument, 0)
+	for {
+		doc, err := iter.Next()
+		if err == DBIteratorDone {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+}
+
+// sliceIterator iterates over documents that have already been read.
+type sliceIterator struct {
+	docs []BackendDocument
+}
+
+func (it *sliceIterator) Next() (BackendDocument, error) {
+	if len(it.docs) == 0 {
+		return nil, DBIteratorDone
+	}
+
+	doc := it.docs[0]
+	it.docs = it.docs[1:]
+
+	return doc, nil
+}
+
+func (it *sliceIterator) Stop() {
+	it.docs = nil
+}
@@ -0,0 +1,224 @@
+package fsdb
+
+import (
+	"context"
+	"fmt"
+)
+
+// MaxBatchWrites is the most writes Firestore accepts in a single commit.
+const MaxBatchWrites = 500
+
+// BulkWriter queues writes and sends them to the database in parallel
+// batches. Writes are not atomic: each one succeeds or fails on its own,
+// and its outcome is reported by the BulkWriterJob returned when it was
+// queued. The Firestore backend throttles writes (starting at 500 per
+// second and ramping up) and retries transient failures.
+//
+// Queued writes are sent as batches fill up, but the last writes may wait
+// until Flush or End is called, so call one of them before waiting on a
+// job's Result.
+//
+// A BulkWriter may write each document only once. It is safe for
+// concurrent use.
+type BulkWriter struct {
+	db *DBConnection
+	bw BackendBulkWriter
+}
+
+// BulkWriterJob is the result of a single queued write.
+type BulkWriterJob struct {
+	Path string
+	job  BackendWriteJob
+}
+
+// BulkWriter returns a BulkWriter. End must be called when done with it.
+func (db *DBConnection) BulkWriter(ctx context.Context) *BulkWriter {
+	return &BulkWriter{
+		db: db,
+		bw: db.backend.BulkWriter(ctx),
+	}
+}
+
+// Create queues the creation of a document, which fails if it already exists.
+func (w *BulkWriter) Create(docname string, dval interface{}) (*BulkWriterJob, error) {
+	if err := w.check(docname); err != nil {
+		return nil, err
+	}
+
+	job, err := w.bw.Create(docname, dval)
+
+	return w.add(docname, job, err)
+}
+
+// Set queues the creation or replacement of a document.
+func (w *BulkWriter) Set(docname string, dval interface{}) (*BulkWriterJob, error) {
+	if err := w.check(docname); err != nil {
+		return nil, err
+	}
+
+	job, err := w.bw.Set(docname, dval)
+
+	return w.add(docname, job, err)
+}
+
+// Update queues changes to fields of an existing document.
+func (w *BulkWriter) Update(docname string, updates ...FieldUpdate) (*BulkWriterJob, error) {
+	if err := w.check(docname); err != nil {
+		return nil, err
+	}
+
+	job, err := w.bw.Update(docname, updates)
+
+	return w.add(docname, job, err)
+}
+
+// Delete queues the deletion of a document.
+func (w *BulkWriter) Delete(docname string) (*BulkWriterJob, error) {
+	if err := w.check(docname); err != nil {
+		return nil, err
+	}
+
+	job, err := w.bw.Delete(docname)
+
+	return w.add(docname, job, err)
+}
+
+func (w *BulkWriter) check(docname string) error {
+	if !isDocPath(docname) {
+		return w.db.log.ErrFmt("nil dref: bad docname '%s'?", docname)
+	}
+	return nil
+}
+
+func (w *BulkWriter) add(docname string, job BackendWriteJob, err error) (*BulkWriterJob, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	return &BulkWriterJob{Path: docname, job: job}, nil
+}
+
+// Flush sends all queued writes and waits for them to complete.
+func (w *BulkWriter) Flush() {
+	w.bw.Flush()
+}
+
+// End flushes queued writes and closes the BulkWriter.
+func (w *BulkWriter) End() {
+	w.bw.End()
+}
+
+// Result waits for the write to complete and returns its error, if any. It
+// blocks until the write is sent; see BulkWriter.
+func (j *BulkWriterJob) Result() error {
+	return j.job.Result()
+}
+
+type batchOp int
+
+const (
+	batchCreate batchOp = iota
+	batchSet
+	batchUpdate
+	batchDelete
+)
+
+type batchWrite struct {
+	op      batchOp
+	docname string
+	dval    interface{}
+	updates []FieldUpdate
+}
+
+// Batch collects writes to be sent together with a BulkWriter.
+//
+// Example:
+//
+//	results, err := db.Batch().
+//		Set("users/alice", alice).
+//		Delete("users/bob").
+//		Commit(ctx)
+type Batch struct {
+	db     *DBConnection
+	writes []batchWrite
+}
+
+// Batch returns an empty Batch.
+func (db *DBConnection) Batch() *Batch {
+	return &Batch{db: db}
+}
+
+// Create adds the creation of a document to the batch.
+func (b *Batch) Create(docname string, dval interface{}) *Batch {
+	b.writes = append(b.writes, batchWrite{op: batchCreate, docname: docname, dval: dval})
+	return b
+}
+
+// Set adds the creation or replacement of a document to the batch.
+func (b *Batch) Set(docname string, dval interface{}) *Batch {
+	b.writes = append(b.writes, batchWrite{op: batchSet, docname: docname, dval: dval})
+	return b
+}
+
+// Update adds changes to fields of an existing document to the batch.
+func (b *Batch) Update(docname string, updates ...FieldUpdate) *Batch {
+	b.writes = append(b.writes, batchWrite{op: batchUpdate, docname: docname, updates: updates})
+	return b
+}
+
+// Delete adds the deletion of a document to the batch.
+func (b *Batch) Delete(docname string) *Batch {
+	b.writes = append(b.writes, batchWrite{op: batchDelete, docname: docname})
+	return b
+}
+
+// Len returns the number of writes in the batch.
+func (b *Batch) Len() int {
+	return len(b.writes)
+}
+
+// Commit sends every write in the batch. The returned slice holds the
+// outcome of each write, in the order they were added; the error is
+// non-nil if any write failed.
+func (b *Batch) Commit(ctx context.Context) ([]error, error) {
+	w := b.db.BulkWriter(ctx)
+
+	results := make([]error, len(b.writes))
+	jobs := make([]*BulkWriterJob, len(b.writes))
+	for i, bw := range b.writes {
+		var err error
+		switch bw.op {
+		case batchCreate:
+			jobs[i], err = w.Create(bw.docname, bw.dval)
+		case batchSet:
+			jobs[i], err = w.Set(bw.docname, bw.dval)
+		case batchUpdate:
+			jobs[i], err = w.Update(bw.docname, bw.updates...)
+		case batchDelete:
+			jobs[i], err = w.Delete(bw.docname)
+		}
+		results[i] = err
+	}
+
+	w.End()
+
+	failed := 0
+	var first error
+	for i, job := range jobs {
+		if job != nil {
+			results[i] = job.Result()
+		}
+		if results[i] != nil {
+			if first == nil {
+				first = fmt.Errorf("%s: %w", b.writes[i].docname, results[i])
+			}
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return results, b.db.log.ErrFmt("batch: %d of %d writes failed: %w", failed, len(b.writes), first)
+	}
+
+	return results, nil
+}
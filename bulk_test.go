@@ -0,0 +1,236 @@
+package fsdb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+func TestBulkWriter(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	n := MaxBatchWrites + 10
+
+	bw := db.BulkWriter(ctx)
+	jobs := make([]*BulkWriterJob, 0, n)
+	for i := 0; i < n; i++ {
+		job, err := bw.Create(fmt.Sprintf("items/%04d", i), map[string]interface{}{"n": i})
+		if err != nil {
+			t.Fatalf("create %d: %v", i, err)
+		}
+		jobs = append(jobs, job)
+	}
+
+	_, err := bw.Set("items/0000", map[string]interface{}{"n": -1})
+	if err == nil {
+		t.Fatalf("duplicate write: expected error")
+	}
+
+	_, err = bw.Create("items", map[string]interface{}{})
+	if err == nil {
+		t.Fatalf("create with collection path: expected error")
+	}
+
+	// As with Firestore, writes are only sent once the writer is flushed.
+	result := make(chan error, 1)
+	go func() { result <- jobs[0].Result() }()
+	select {
+	case err := <-result:
+		t.Fatalf("result before End: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	bw.End()
+
+	if err := <-result; err != nil {
+		t.Fatalf("%s: %v", jobs[0].Path, err)
+	}
+	for _, job := range jobs {
+		err := job.Result()
+		if err != nil {
+			t.Fatalf("%s: %v", job.Path, err)
+		}
+	}
+
+	_, err = bw.Delete("items/0001")
+	if err == nil {
+		t.Fatalf("write after End: expected error")
+	}
+
+	count, err := db.DocumentCount(ctx, "items")
+	if err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if count != int64(n) {
+		t.Fatalf("count: got %d, want %d", count, n)
+	}
+
+	err = db.DeleteCollection(ctx, "items")
+	if err != nil {
+		t.Fatalf("delete collection: %v", err)
+	}
+	count, err = db.DocumentCount(ctx, "items")
+	if err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if count != 0 {
+		t.Fatalf("count after delete: got %d, want 0", count)
+	}
+}
+
+func TestBulkWriterConcurrent(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	workers, each := 4, MaxBatchWrites/2+1
+
+	bw := db.BulkWriter(ctx)
+	jobs := make([][]*BulkWriterJob, workers)
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := 0; i < each; i++ {
+				job, err := bw.Create(fmt.Sprintf("items/%d-%04d", w, i), map[string]interface{}{"n": i})
+				if err != nil {
+					errs <- err
+					return
+				}
+				jobs[w] = append(jobs[w], job)
+			}
+			errs <- nil
+		}()
+	}
+	for w := 0; w < workers; w++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+	bw.End()
+
+	for _, list := range jobs {
+		for _, job := range list {
+			if err := job.Result(); err != nil {
+				t.Fatalf("%s: %v", job.Path, err)
+			}
+		}
+	}
+
+	count, err := db.DocumentCount(ctx, "items")
+	if err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if count != int64(workers*each) {
+		t.Fatalf("count: got %d, want %d", count, workers*each)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	err := db.Add(ctx, "users/alice", &testUser{Name: "alice", Age: 30, Tags: []string{"admin"}})
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	err = db.Add(ctx, "users/bob", &testUser{Name: "bob"})
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	b := db.Batch().
+		Create("users/carol", &testUser{Name: "carol"}).
+		Create("users/alice", &testUser{Name: "alice2"}).
+		Set("users/bob", &testUser{Name: "bob", Age: 40}).
+		Delete("users/erin")
+	if b.Len() != 4 {
+		t.Fatalf("len: got %d, want 4", b.Len())
+	}
+
+	results, err := b.Commit(ctx)
+	if err == nil {
+		t.Fatalf("commit: expected error")
+	}
+	if len(results) != 4 {
+		t.Fatalf("commit: got %d results, want 4", len(results))
+	}
+	if results[0] != nil || results[2] != nil || results[3] != nil {
+		t.Fatalf("commit: unexpected failures %v", results)
+	}
+	if !ErrorIsAlreadyExists(results[1]) {
+		t.Fatalf("create existing: expected AlreadyExists, got %v", results[1])
+	}
+
+	u := &testUser{}
+	err = db.Get(ctx, "users/bob", u)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if u.Name != "bob" || u.Age != 40 {
+		t.Fatalf("set: unexpected %#v", u)
+	}
+
+	err = db.Get(ctx, "users/alice", u)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if u.Name != "alice" || u.Age != 30 {
+		t.Fatalf("create existing: unexpected %#v", u)
+	}
+}
+
+func TestBatchUpdate(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	err := db.Add(ctx, "users/alice", &testUser{Name: "alice", Age: 30, Tags: []string{"admin"}})
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	err = db.Add(ctx, "users/bob", &testUser{Name: "bob"})
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	results, err := db.Batch().
+		Update("users/bob", FieldUpdate{Path: "Age", Value: 40}, FieldUpdate{Path: "meta.by", Value: "batch"}).
+		Update("users/dave", FieldUpdate{Path: "Age", Value: 1}).
+		Commit(ctx)
+	if err == nil {
+		t.Fatalf("commit: expected error")
+	}
+	if len(results) != 2 || results[0] != nil {
+		t.Fatalf("commit: unexpected results %v", results)
+	}
+	if !ErrorIsNotFound(results[1]) {
+		t.Fatalf("update missing: expected NotFound, got %v", results[1])
+	}
+
+	m := map[string]interface{}{}
+	err = db.Get(ctx, "users/bob", &m)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if m["Name"] != "bob" || m["Age"] != int64(40) || fmt.Sprint(m["meta"]) != "map[by:batch]" {
+		t.Fatalf("update: unexpected %#v", m)
+	}
+
+	_, err = db.Batch().
+		Update("users/alice", FieldUpdate{Path: "tags", Value: firestore.Delete}, FieldUpdate{Path: "created", Value: firestore.ServerTimestamp}).
+		Commit(ctx)
+	if err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	u := &testUser{}
+	err = db.Get(ctx, "users/alice", u)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if u.Name != "alice" || u.Age != 30 || u.Tags != nil || u.Created.IsZero() {
+		t.Fatalf("update: unexpected %#v", u)
+	}
+}
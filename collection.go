@@ -0,0 +1,162 @@
+package fsdb
+
+import (
+	"context"
+	"iter"
+)
+
+// TypedCollection is a collection whose documents all decode into T.
+//
+// Example:
+//
+//	users := fsdb.Collection[User](db, "users")
+//	u, err := users.Get(ctx, "alice")
+type TypedCollection[T any] struct {
+	db   *DBConnection
+	path string
+}
+
+// Collection returns a typed view of the collection at path.
+func Collection[T any](db *DBConnection, path string) *TypedCollection[T] {
+	return &TypedCollection[T]{
+		db:   db,
+		path: path,
+	}
+}
+
+// Path returns the collection's path.
+func (c *TypedCollection[T]) Path() string {
+	return c.path
+}
+
+// Get reads the document with the given ID.
+func (c *TypedCollection[T]) Get(ctx context.Context, id string) (*T, error) {
+	dval := new(T)
+
+	err := c.db.Get(ctx, c.docPath(id), dval)
+	if err != nil {
+		return nil, err
+	}
+
+	return dval, nil
+}
+
+// Add creates the document with the given ID, failing if it already exists.
+func (c *TypedCollection[T]) Add(ctx context.Context, id string, dval *T) error {
+	return c.db.Add(ctx, c.docPath(id), dval)
+}
+
+// Set creates or replaces the document with the given ID.
+func (c *TypedCollection[T]) Set(ctx context.Context, id string, dval *T) error {
+	return c.db.AddOrReplace(ctx, c.docPath(id), dval)
+}
+
+// Delete removes the document with the given ID.
+func (c *TypedCollection[T]) Delete(ctx context.Context, id string) error {
+	return c.db.Delete(ctx, c.docPath(id))
+}
+
+// Query returns a typed query builder over the collection.
+func (c *TypedCollection[T]) Query() *TypedQuery[T] {
+	return &TypedQuery[T]{c.db.Query(c.path)}
+}
+
+// All reads every document in the collection.
+func (c *TypedCollection[T]) All(ctx context.Context) ([]*T, error) {
+	return c.Query().All(ctx)
+}
+
+// Documents returns an iterator over every document in the collection.
+func (c *TypedCollection[T]) Documents(ctx context.Context) iter.Seq2[*T, error] {
+	return c.Query().Documents(ctx)
+}
+
+func (c *TypedCollection[T]) docPath(id string) string {
+	return c.path + "/" + id
+}
+
+// TypedQuery is a Query whose results decode into T.
+type TypedQuery[T any] struct {
+	q *Query
+}
+
+// Where adds a filter condition to the query. See Query.Where.
+func (tq *TypedQuery[T]) Where(path, op string, value interface{}) *TypedQuery[T] {
+	tq.q.Where(path, op, value)
+	return tq
+}
+
+// OrderBy adds a sort ordering to the query. See Query.OrderBy.
+func (tq *TypedQuery[T]) OrderBy(path string, dir Direction) *TypedQuery[T] {
+	tq.q.OrderBy(path, dir)
+	return tq
+}
+
+// Limit sets the maximum number of results to return.
+func (tq *TypedQuery[T]) Limit(n int) *TypedQuery[T] {
+	tq.q.Limit(n)
+	return tq
+}
+
+// LimitToLast sets the maximum number of results to return from the end
+// of the ordered result set. Requires at least one OrderBy clause.
+func (tq *TypedQuery[T]) LimitToLast(n int) *TypedQuery[T] {
+	tq.q.LimitToLast(n)
+	return tq
+}
+
+// Offset sets the number of results to skip before returning results.
+func (tq *TypedQuery[T]) Offset(n int) *TypedQuery[T] {
+	tq.q.Offset(n)
+	return tq
+}
+
+// StartAt sets the query cursor to start at the given field values (inclusive).
+func (tq *TypedQuery[T]) StartAt(values ...interface{}) *TypedQuery[T] {
+	tq.q.StartAt(values...)
+	return tq
+}
+
+// StartAfter sets the query cursor to start after the given field values (exclusive).
+func (tq *TypedQuery[T]) StartAfter(values ...interface{}) *TypedQuery[T] {
+	tq.q.StartAfter(values...)
+	return tq
+}
+
+// EndAt sets the query cursor to end at the given field values (inclusive).
+func (tq *TypedQuery[T]) EndAt(values ...interface{}) *TypedQuery[T] {
+	tq.q.EndAt(values...)
+	return tq
+}
+
+// EndBefore sets the query cursor to end before the given field values (exclusive).
+func (tq *TypedQuery[T]) EndBefore(values ...interface{}) *TypedQuery[T] {
+	tq.q.EndBefore(values...)
+	return tq
+}
+
+// Untyped returns the underlying Query.
+func (tq *TypedQuery[T]) Untyped() *Query {
+	return tq.q
+}
+
+// Documents executes the query and returns an iterator over the decoded
+// results. The underlying DocumentIterator is stopped when the loop ends,
+// including on an early break. Iteration ends after the first error.
+func (tq *TypedQuery[T]) Documents(ctx context.Context) iter.Seq2[*T, error] {
+	return Decode[T](tq.q.Documents(ctx))
+}
+
+// All executes the query and returns every result.
+func (tq *TypedQuery[T]) All(ctx context.Context) ([]*T, error) {
+	results := make([]*T, 0)
+
+	for dval, err := range tq.Documents(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, dval)
+	}
+
+	return results, nil
+}
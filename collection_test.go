@@ -0,0 +1,83 @@
+package fsdb
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTypedCollection(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	users := Collection[testUser](db, "users")
+
+	for _, u := range []*testUser{{Name: "alice", Age: 30}, {Name: "bob", Age: 25}, {Name: "carol", Age: 35}} {
+		err := users.Add(ctx, u.Name, u)
+		if err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	u, err := users.Get(ctx, "bob")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if u.Name != "bob" || u.Age != 25 {
+		t.Fatalf("get: unexpected %#v", u)
+	}
+
+	_, err = users.Get(ctx, "zed")
+	if !ErrorIsNotFound(err) {
+		t.Fatalf("get missing: expected NotFound, got %v", err)
+	}
+
+	u.Age = 26
+	err = users.Set(ctx, "bob", u)
+	if err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	all, err := users.All(ctx)
+	if err != nil {
+		t.Fatalf("all: %v", err)
+	}
+	if len(all) != 3 {
+		t.Fatalf("all: got %d, want 3", len(all))
+	}
+
+	older, err := users.Query().Where("Age", ">", 25).OrderBy("Age", Desc).All(ctx)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if len(older) != 3 || older[0].Name != "carol" || older[2].Name != "bob" {
+		t.Fatalf("query: unexpected results %v", older)
+	}
+
+	n := 0
+	for u, err := range users.Query().OrderBy("Name", Asc).Documents(ctx) {
+		if err != nil {
+			t.Fatalf("iterate: %v", err)
+		}
+		if u.Name != "alice" {
+			t.Fatalf("iterate: got %s first", u.Name)
+		}
+		n++
+		break
+	}
+	if n != 1 {
+		t.Fatalf("iterate: got %d results before break", n)
+	}
+
+	err = users.Delete(ctx, "alice")
+	if err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	all, err = users.All(ctx)
+	if err != nil {
+		t.Fatalf("all: %v", err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("all after delete: got %d, want 2", len(all))
+	}
+}
@@ -4,17 +4,23 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/firestore"
-	"cloud.google.com/go/firestore/apiv1/firestorepb"
 
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 
 	"github.com/tadhunt/logger"
 	"github.com/tadhunt/retry"
@@ -24,20 +30,51 @@ type DBConnection struct {
         log     logger.CompatLogWriter
 	project string
 	Client  *firestore.Client
+	backend Backend
+
+	pageKeyMu sync.Mutex
+	pageKey   []byte // signs page tokens; see SetPageTokenKey
+
+	recorderMu sync.Mutex
+	recorder   *IndexRecorder
 }
 
 type DocumentIterator struct {
+	// DocumentIterator is the underlying Firestore iterator of a query
+	// run by the Firestore backend, and nil otherwise.
 	*firestore.DocumentIterator
+
+	it BackendDocumentIterator
 }
 
 type CollectionIterator struct {
+	// CollectionIterator is the underlying Firestore iterator when the
+	// connection uses the Firestore backend, and nil otherwise.
 	*firestore.CollectionIterator
+
+	it BackendCollectionIterator
+}
+
+func newDocumentIterator(it BackendDocumentIterator) *DocumentIterator {
+	iter := &DocumentIterator{it: it}
+	if fit, ok := it.(*firestoreDocumentIterator); ok {
+		iter.DocumentIterator = fit.it
+	}
+	return iter
+}
+
+func newCollectionIterator(it BackendCollectionIterator) *CollectionIterator {
+	iter := &CollectionIterator{it: it}
+	if fit, ok := it.(*firestoreCollectionIterator); ok {
+		iter.CollectionIterator = fit.it
+	}
+	return iter
 }
 
 type DbWhere struct {
 	Attr       string
 	Comparison string
-	Val        string
+	Val        interface{} // any value Where accepts, e.g. a string, number or time.Time
 }
 
 var DBIteratorDone = iterator.Done
@@ -46,9 +83,52 @@ type Credentials struct {
 	File          *string
 	JSON          []byte
 	AccessTokenFile *string
+
+	// EmulatorHost is the host:port of a Firestore emulator. When set, the
+	// connection talks to the emulator without authenticating, and the other
+	// fields are ignored. If unset, the FIRESTORE_EMULATOR_HOST environment
+	// variable is honored as usual by the firestore client.
+	EmulatorHost *string
+}
+
+// emulatorHost returns the address of the Firestore emulator in use, or "" for Cloud Firestore.
+func emulatorHost(credentials *Credentials) string {
+	if credentials != nil && credentials.EmulatorHost != nil {
+		return *credentials.EmulatorHost
+	}
+
+	return os.Getenv("FIRESTORE_EMULATOR_HOST")
+}
+
+// emulatorCreds authenticates to the emulator as an administrator, the same
+// way the firestore client does when FIRESTORE_EMULATOR_HOST is set.
+type emulatorCreds struct{}
+
+func (ec emulatorCreds) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer owner"}, nil
+}
+
+func (ec emulatorCreds) RequireTransportSecurity() bool {
+	return false
 }
 
 func credentialOptions(ctx context.Context, credentials *Credentials) ([]option.ClientOption, error) {
+	if credentials == nil {
+		return nil, nil
+	}
+
+	if credentials.EmulatorHost != nil {
+		conn, err := grpc.NewClient(*credentials.EmulatorHost,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithPerRPCCredentials(emulatorCreds{}),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		return []option.ClientOption{option.WithGRPCConn(conn)}, nil
+	}
+
 	var jsonBytes []byte
 
 	if credentials.File != nil {
@@ -88,6 +168,7 @@ func NewDBConnection(ctx context.Context, log logger.CompatLogWriter, project st
 		log:     log,
 		project: project,
 		Client:  client,
+		backend: NewFirestoreBackend(client),
 	}
 
 	return dbc, nil
@@ -100,9 +181,25 @@ func NewDBConnectionFromClient(log logger.CompatLogWriter, project string, clien
 		log:     log,
 		project: project,
 		Client:  client,
+		backend: NewFirestoreBackend(client),
 	}
 }
 
+// NewDBConnectionFromBackend creates a DBConnection that stores its data in the given Backend.
+// The Client field of the returned connection is nil.
+func NewDBConnectionFromBackend(log logger.CompatLogWriter, project string, backend Backend) *DBConnection {
+	return &DBConnection{
+		log:     log,
+		project: project,
+		backend: backend,
+	}
+}
+
+// Backend returns the storage backend used by this connection.
+func (db *DBConnection) Backend() Backend {
+	return db.backend
+}
+
 func NewDBConnectionWithDatabase(ctx context.Context, log logger.CompatLogWriter, project string, dbID string, credentials *Credentials) (*DBConnection, error) {
 	options, err := credentialOptions(ctx, credentials)
 	if err != nil {
@@ -118,44 +215,40 @@ func NewDBConnectionWithDatabase(ctx context.Context, log logger.CompatLogWriter
 		log:     log,
 		project: project,
 		Client:  client,
+		backend: NewFirestoreBackend(client),
 	}
 
 	return dbc, nil
 }
 
 func (db *DBConnection) Add(ctx context.Context, docname string, dval interface{}) error {
-	dref := db.Client.Doc(docname)
-	if dref == nil {
+	if !isDocPath(docname) {
 		return db.log.ErrFmt("nil dref: bad docname '%s'?", docname)
 	}
 
-	wr, err := dref.Create(ctx, dval)
+	err := db.backend.Create(ctx, docname, dval)
 	if err != nil {
 		return err
 	}
 
-	db.log.Debugf("docname %s dval %#v: wr: %#v", docname, dval, wr)
+	db.log.Debugf("docname %s dval %#v", docname, dval)
 
 	return nil
 }
 
 func (db *DBConnection) AddOrReplace(ctx context.Context, docname string, dval interface{}) error {
-	dref := db.Client.Doc(docname)
-
-	wr, err := dref.Set(ctx, dval)
+	err := db.backend.Set(ctx, docname, dval)
 	if err != nil {
 		return err
 	}
 
-	db.log.Debugf("docname %s dval %#v: wr: %#v", docname, dval, wr)
+	db.log.Debugf("docname %s dval %#v", docname, dval)
 
 	return nil
 }
 
-func (db *DBConnection) Delete(ctx context.Context, docname string) error {
-	dref := db.Client.Doc(docname)
-
-	_, err := dref.Delete(ctx)
+func (db *DBConnection) Delete(ctx context.Context, docname string, preconds ...Precondition) error {
+	err := db.backend.Delete(ctx, docname, preconds...)
 	if err != nil {
 		return err
 	}
@@ -163,84 +256,99 @@ func (db *DBConnection) Delete(ctx context.Context, docname string) error {
 	return nil
 }
 
-func (db *DBConnection) DeleteCollection(ctx context.Context, path string) error {
-	col := db.Client.Collection(path)
-	iter := col.Select().Documents(ctx)
-	defer iter.Stop()
-
-	docs, err := iter.GetAll()
+/*
+ * Deletes a document only if it has not been written since snap was read
+ * (or, if snap is nil, only if it exists). Fails with an error for which
+ * ErrorIsPreconditionFailed is true otherwise.
+ */
+func (db *DBConnection) DeleteIfUnchanged(ctx context.Context, docname string, snap *Snapshot) error {
+	err := db.backend.Delete(ctx, docname, unchanged(snap))
 	if err != nil {
-		return err
+		return preconditionFailed(docname, err)
 	}
-	for _, doc := range docs {
-		_, err := doc.Ref.Delete(ctx)
-		if err != nil {
-			return err
-		}
+
+	return nil
+}
+
+/*
+ * Updates fields of a document only if it has not been written since snap
+ * was read (or, if snap is nil, only if it exists). Fails with an error for
+ * which ErrorIsPreconditionFailed is true otherwise.
+ */
+func (db *DBConnection) UpdateIfUnchanged(ctx context.Context, docname string, snap *Snapshot, updates ...FieldUpdate) error {
+	err := db.backend.Update(ctx, docname, updates, unchanged(snap))
+	if err != nil {
+		return preconditionFailed(docname, err)
 	}
 
+	db.log.Debugf("docname %s updates %d", docname, len(updates))
+
 	return nil
 }
 
-func (db *DBConnection) Get(ctx context.Context, docname string, dval interface{}) error {
-	dref := db.Client.Doc(docname)
+func unchanged(snap *Snapshot) Precondition {
+	if snap == nil {
+		return Exists
+	}
+	return LastUpdateTime(snap.UpdateTime)
+}
 
-	dsnap, err := dref.Get(ctx)
+// preconditionFailed reports a document that has been deleted as a failed precondition.
+func preconditionFailed(docname string, err error) error {
+	if ErrorIsNotFound(err) {
+		return status.Errorf(codes.FailedPrecondition, "%s no longer exists: %v", docname, err)
+	}
+	return err
+}
+
+// DeleteCollection deletes every document in a collection, a page at a
+// time. See DeleteCollectionWithOptions.
+func (db *DBConnection) DeleteCollection(ctx context.Context, path string) error {
+	_, err := db.DeleteCollectionWithOptions(ctx, path, nil)
+	return err
+}
+
+func (db *DBConnection) Get(ctx context.Context, docname string, dval interface{}) error {
+	doc, err := db.backend.Get(ctx, docname)
 	if err != nil {
 		return err
 	}
 
-	return dsnap.DataTo(dval)
+	return doc.DataTo(dval)
 }
 
 func (db *DBConnection) QueryIterator(ctx context.Context, colname string, attr string, comparison string, val string) *DocumentIterator {
-	col := db.Client.Collection(colname)
-
-	query := col.Where(attr, comparison, val)
-
-	iter := query.Documents(ctx)
-
-	return &DocumentIterator{iter}
+	return db.Query(colname).Where(attr, comparison, val).Documents(ctx)
 }
 
 /*
  * Adds a new [automatically named] document to a collection group
  */
 func (db *DBConnection) CollectionGroupAdd(ctx context.Context, colname string, dval interface{}) error {
-	col := db.Client.Collection(colname)
-
-	dref := col.NewDoc()
+	dpath := colname + "/" + newDocID()
 
-	wr, err := dref.Set(ctx, dval)
+	err := db.backend.Set(ctx, dpath, dval)
 	if err != nil {
 		return err
 	}
 
-	db.log.Debugf("colname %s dpath %s dval %#v: wr: %#v", colname, dref.Path, dval, wr)
+	db.log.Debugf("colname %s dpath %s dval %#v", colname, dpath, dval)
 
 	return nil
 }
 
 func (db *DBConnection) CollectionGroupQuery(ctx context.Context, colname string, wheres []*DbWhere) *DocumentIterator {
-	col := db.Client.CollectionGroup(colname)
+	query := db.QueryGroup(colname)
 
-	var query firestore.Query
-
-	for i, w := range wheres {
-		if i == 0 {
-			query = col.Where(w.Attr, w.Comparison, w.Val)
-		} else {
-			query = query.Where(w.Attr, w.Comparison, w.Val)
-		}
+	for _, w := range wheres {
+		query = query.Where(w.Attr, w.Comparison, w.Val)
 	}
 
-	iter := query.Documents(ctx)
-
-	return &DocumentIterator{iter}
+	return query.Documents(ctx)
 }
 
 func (db *DBConnection) NextDoc(ctx context.Context, iter *DocumentIterator, dval interface{}) error {
-	dsnap, err := iter.Next()
+	doc, err := iter.it.Next()
 	if err == iterator.Done {
 		return DBIteratorDone
 	}
@@ -248,7 +356,7 @@ func (db *DBConnection) NextDoc(ctx context.Context, iter *DocumentIterator, dva
 		return err
 	}
 
-	err = dsnap.DataTo(dval)
+	err = doc.DataTo(dval)
 	if err != nil {
 		return err
 	}
@@ -257,7 +365,7 @@ func (db *DBConnection) NextDoc(ctx context.Context, iter *DocumentIterator, dva
 }
 
 func (db *DBConnection) NextDocPath(ctx context.Context, iter *DocumentIterator, dval interface{}) (string, error) {
-	dsnap, err := iter.Next()
+	doc, err := iter.it.Next()
 	if err == iterator.Done {
 		return "", DBIteratorDone
 	}
@@ -265,48 +373,116 @@ func (db *DBConnection) NextDocPath(ctx context.Context, iter *DocumentIterator,
 		return "", err
 	}
 
-	err = dsnap.DataTo(dval)
+	err = doc.DataTo(dval)
 	if err != nil {
 		return "", err
 	}
 
-	return dsnap.Ref.Path, nil
+	return doc.Path(), nil
 }
 
 func (db *DBConnection) DocumentIterator(ctx context.Context, path string) *DocumentIterator {
-	iter := db.Client.Collection(path).Documents(ctx)
-	if iter == nil {
-		return nil
-	}
-
-	return &DocumentIterator{iter}
+	return db.Query(path).Documents(ctx)
 }
 
 func (db *DBConnection) CollectionIterator(ctx context.Context, docname string) *CollectionIterator {
-	iter := db.Client.Doc(docname).Collections(ctx)
-	if iter == nil {
-		return nil
-	}
-
-	return &CollectionIterator{iter}
+	return newCollectionIterator(db.backend.Collections(ctx, docname))
 }
 
 // DocumentCount returns the number of documents in a collection using an aggregation query
 func (db *DBConnection) DocumentCount(ctx context.Context, path string) (int64, error) {
-	col := db.Client.Collection(path)
-	result, err := col.NewAggregationQuery().WithCount("count").Get(ctx)
+	count, err := db.Query(path).Count(ctx)
 	if err != nil {
 		return 0, db.log.ErrFmt("count aggregation failed: %w", err)
 	}
-	val, ok := result["count"]
-	if !ok {
-		return 0, db.log.ErrFmt("count field not found in aggregation result")
+	return count, nil
+}
+
+// Stop releases the resources held by the iterator.
+// It is safe to call Stop more than once.
+func (it *DocumentIterator) Stop() {
+	it.it.Stop()
+}
+
+// Next returns the next document as a Firestore snapshot, or DBIteratorDone.
+// Only documents read through the Firestore backend have snapshots; with
+// other backends use NextDoc or All.
+func (it *DocumentIterator) Next() (*firestore.DocumentSnapshot, error) {
+	if it.DocumentIterator != nil {
+		return it.DocumentIterator.Next()
 	}
-	count, ok := val.(*firestorepb.Value)
+
+	doc, err := it.it.Next()
+	if err != nil {
+		return nil, err
+	}
+	fdoc, ok := doc.(*firestoreDocument)
 	if !ok {
-		return 0, db.log.ErrFmt("unexpected count type: %T", val)
+		return nil, fmt.Errorf("document %s is not from the Firestore backend", doc.Path())
 	}
-	return count.GetIntegerValue(), nil
+	return fdoc.snap, nil
+}
+
+// GetAll returns the remaining documents as Firestore snapshots, and stops
+// the iterator. See Next.
+func (it *DocumentIterator) GetAll() ([]*firestore.DocumentSnapshot, error) {
+	defer it.Stop()
+
+	snaps := make([]*firestore.DocumentSnapshot, 0)
+	for {
+		snap, err := it.Next()
+		if err == DBIteratorDone {
+			return snaps, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		snaps = append(snaps, snap)
+	}
+}
+
+// Next returns the next collection, or DBIteratorDone. With backends other
+// than Firestore, only the ID, Path and Parent of the reference are set.
+func (it *CollectionIterator) Next() (*firestore.CollectionRef, error) {
+	if it.CollectionIterator != nil {
+		return it.CollectionIterator.Next()
+	}
+
+	name, err := it.it.Next()
+	if err != nil {
+		return nil, err
+	}
+	return collectionRef(name), nil
+}
+
+// GetAll returns the remaining collections. See Next.
+func (it *CollectionIterator) GetAll() ([]*firestore.CollectionRef, error) {
+	refs := make([]*firestore.CollectionRef, 0)
+	for {
+		ref, err := it.Next()
+		if err == DBIteratorDone {
+			return refs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+}
+
+// collectionRef returns a reference, without a client, to the collection
+// with the given full resource name.
+func collectionRef(name string) *firestore.CollectionRef {
+	parent, id := name, name
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		parent, id = name[:i], name[i+1:]
+	}
+
+	ref := &firestore.CollectionRef{Path: name, ID: id}
+	if !strings.HasSuffix(parent, "/documents") {
+		ref.Parent = &firestore.DocumentRef{Path: parent, ID: parent[strings.LastIndex(parent, "/")+1:]}
+	}
+	return ref
 }
 
 func (db *DBConnection) Escape(raw string) string {
@@ -356,7 +532,21 @@ func (db *DBConnection) Unescape(s string) string {
 	return r
 }
 
+// CreateDatabase creates a Firestore database using gcloud.
+//
+// The Firestore emulator creates databases on first use, so when an emulator
+// is in use CreateDatabase only validates the database ID.
 func CreateDatabase(ctx context.Context, log logger.CompatLogWriter, project string, dbID string, credentials *Credentials) ([]string, error) {
+	if host := emulatorHost(credentials); host != "" {
+		if !validDatabaseID(dbID) {
+			return nil, errors.New("invalid database ID " + dbID)
+		}
+
+		log.Debugf("emulator %s: database %s is created on first use", host, dbID)
+
+		return nil, nil
+	}
+
 	exists, err := dbExists(ctx, log, project, dbID, credentials)
 	if err != nil {
 		return nil, err
@@ -429,6 +619,10 @@ func dbExistsRetry(ctx context.Context, log logger.CompatLogWriter, project stri
 }
 
 func dbExists(ctx context.Context, log logger.CompatLogWriter, project string, dbID string, credentials *Credentials) (bool, error) {
+	if emulatorHost(credentials) != "" {
+		return true, nil
+	}
+
 	c, err := NewDBConnectionWithDatabase(ctx, log, project, dbID, credentials)
 	if err != nil {
 		return false, err
@@ -455,3 +649,56 @@ func dbExists(ctx context.Context, log logger.CompatLogWriter, project string, d
 
 	return true, nil
 }
+
+// validDatabaseID reports whether id follows Firestore's database naming rules:
+// 4 to 63 lowercase letters, digits or hyphens, starting with a letter and
+// ending with a letter or digit. "(default)" is also accepted.
+func validDatabaseID(id string) bool {
+	if id == firestore.DefaultDatabaseID {
+		return true
+	}
+
+	if len(id) < 4 || len(id) > 63 {
+		return false
+	}
+
+	for i, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9' && i > 0:
+		case c == '-' && i > 0 && i < len(id)-1:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// ResetEmulator deletes every document in a database on the Firestore
+// emulator listening at host. An empty dbID means the default database.
+func ResetEmulator(ctx context.Context, host string, project string, dbID string) error {
+	if dbID == "" {
+		dbID = firestore.DefaultDatabaseID
+	}
+
+	url := fmt.Sprintf("http://%s/emulator/v1/projects/%s/databases/%s/documents", host, project, dbID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("reset emulator %s: %s: %s", host, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
@@ -15,7 +15,7 @@ func TestCreateDatabase(t *testing.T) {
 	tokenFile := os.Getenv("FSDB_TEST_ACCESS_TOKEN_FILE")
 
 	if project == "" {
-		t.Fatalf("FSDB_TEST_PROJECT unset")
+		t.Skip("FSDB_TEST_PROJECT unset")
 	}
 
 	if db == "" {
@@ -47,3 +47,71 @@ func TestCreateDatabase(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 }
+
+func TestEmulator(t *testing.T) {
+	host := os.Getenv("FIRESTORE_EMULATOR_HOST")
+	if host == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST unset")
+	}
+
+	project := "fsdb-test"
+	credentials := &Credentials{
+		EmulatorHost: &host,
+	}
+
+	ctx := context.Background()
+	log := logger.NewTestCompatLogWriter(t)
+
+	_, err := CreateDatabase(ctx, log, project, "fsdb-test-db", credentials)
+	if err != nil {
+		t.Fatalf("create database: %v", err)
+	}
+
+	db, err := NewDBConnectionWithDatabase(ctx, log, project, "fsdb-test-db", credentials)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+
+	err = ResetEmulator(ctx, host, project, "fsdb-test-db")
+	if err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+
+	type doc struct {
+		N int
+	}
+
+	err = db.Add(ctx, "docs/a", &doc{N: 1})
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	err = ResetEmulator(ctx, host, project, "fsdb-test-db")
+	if err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+
+	err = db.Get(ctx, "docs/a", &doc{})
+	if !ErrorIsNotFound(err) {
+		t.Fatalf("expected NotFound after reset, got %v", err)
+	}
+}
+
+func TestValidDatabaseID(t *testing.T) {
+	tests := map[string]bool{
+		"(default)": true,
+		"my-db":     true,
+		"db2":       false,
+		"db-2":      true,
+		"2db-":      false,
+		"my-db-":    false,
+		"My-db":     false,
+		"my_db":     false,
+	}
+
+	for id, want := range tests {
+		if got := validDatabaseID(id); got != want {
+			t.Errorf("validDatabaseID(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package fsdb
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"cloud.google.com/go/firestore"
+)
+
+// DefaultRecursiveDeleteParallelism is the number of documents RecursiveDelete
+// works on at once when RecursiveDeleteOptions.Parallelism is not set.
+const DefaultRecursiveDeleteParallelism = 10
+
+// RecursiveDeleteOptions controls RecursiveDeleteWithOptions.
+type RecursiveDeleteOptions struct {
+	// Parallelism bounds the number of documents processed at once.
+	Parallelism int
+
+	// Progress, if set, is called after each document is deleted. Calls
+	// are serialized.
+	Progress func(p RecursiveDeleteProgress)
+}
+
+// RecursiveDeleteProgress reports the progress of a RecursiveDelete.
+type RecursiveDeleteProgress struct {
+	Path    string // the document that was just deleted
+	Deleted int64  // the number of documents deleted so far
+}
+
+// RecursiveDelete deletes the document or collection at path along with all
+// of its nested subcollections. See RecursiveDeleteWithOptions.
+func (db *DBConnection) RecursiveDelete(ctx context.Context, path string) (int64, error) {
+	return db.RecursiveDeleteWithOptions(ctx, path, nil)
+}
+
+// RecursiveDeleteWithOptions deletes the document or collection at path
+// along with all of its nested subcollections, returning the number of
+// documents deleted. Missing documents that only have subcollections are
+// counted too.
+//
+// Descendants are deleted depth-first: a document is only deleted once
+// everything below it is gone. If the delete is interrupted, calling it
+// again with the same path resumes where it left off.
+func (db *DBConnection) RecursiveDeleteWithOptions(ctx context.Context, path string, opts *RecursiveDeleteOptions) (int64, error) {
+	if opts == nil {
+		opts = &RecursiveDeleteOptions{}
+	}
+
+	n := opts.Parallelism
+	if n <= 0 {
+		n = DefaultRecursiveDeleteParallelism
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	rd := &recursiveDelete{
+		db:       db,
+		ctx:      ctx,
+		cancel:   cancel,
+		bw:       db.BulkWriter(ctx),
+		slots:    make(chan struct{}, n),
+		progress: opts.Progress,
+	}
+
+	var err error
+	if isDocPath(path) {
+		err = rd.deleteDocument(path)
+	} else if len(splitPath(path))%2 == 1 {
+		err = rd.deleteCollection(path)
+	} else {
+		err = db.log.ErrFmt("bad path '%s'", path)
+	}
+
+	rd.bw.End()
+
+	if err == nil {
+		err = rd.failed()
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	return rd.deleted, err
+}
+
+type recursiveDelete struct {
+	db       *DBConnection
+	ctx      context.Context
+	cancel   context.CancelFunc
+	bw       *BulkWriter
+	slots    chan struct{}
+	progress func(p RecursiveDeleteProgress)
+
+	mu      sync.Mutex
+	deleted int64
+	err     error
+}
+
+// deleteCollection deletes every document in a collection, working on up to
+// cap(rd.slots) documents in parallel.
+func (rd *recursiveDelete) deleteCollection(path string) error {
+	var wg sync.WaitGroup
+
+	jobs := make(chan *BulkWriterJob)
+	results := make([]*BulkWriterJob, 0)
+	collected := make(chan struct{})
+	go func() {
+		for job := range jobs {
+			results = append(results, job)
+		}
+		close(collected)
+	}()
+
+	it := rd.db.backend.DocumentRefs(rd.ctx, path)
+	for {
+		name, err := it.Next()
+		if errors.Is(err, DBIteratorDone) {
+			break
+		}
+		if err != nil {
+			rd.fail(err)
+			break
+		}
+		if rd.ctx.Err() != nil {
+			break
+		}
+
+		docname := relativePath(name)
+		work := func() {
+			job, err := rd.deleteTree(docname)
+			if err != nil {
+				rd.fail(err)
+				return
+			}
+			jobs <- job
+		}
+
+		// Use a free slot if there is one, otherwise do the work here, so
+		// nested collections can never wait on their ancestors for a slot.
+		select {
+		case rd.slots <- struct{}{}:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-rd.slots }()
+				work()
+			}()
+		default:
+			work()
+		}
+	}
+
+	wg.Wait()
+	close(jobs)
+	<-collected
+
+	// Queued deletes are only sent in full batches, so send the rest
+	// before waiting on them.
+	rd.bw.Flush()
+	for _, job := range results {
+		rd.done(job)
+	}
+
+	return rd.failed()
+}
+
+// deleteDocument deletes a document and everything below it.
+func (rd *recursiveDelete) deleteDocument(path string) error {
+	job, err := rd.deleteTree(path)
+	if err != nil {
+		rd.fail(err)
+		return err
+	}
+
+	rd.bw.Flush()
+	rd.done(job)
+
+	return rd.failed()
+}
+
+// deleteTree deletes the subcollections of a document, then queues the
+// deletion of the document itself.
+func (rd *recursiveDelete) deleteTree(path string) (*BulkWriterJob, error) {
+	it := rd.db.backend.Collections(rd.ctx, path)
+	for {
+		name, err := it.Next()
+		if errors.Is(err, DBIteratorDone) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		err = rd.deleteCollection(relativePath(name))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := rd.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return rd.bw.Delete(path)
+}
+
+// done waits for a queued delete and reports progress.
+func (rd *recursiveDelete) done(job *BulkWriterJob) {
+	err := job.Result()
+	if err != nil {
+		rd.fail(rd.db.log.ErrFmt("delete %s: %w", job.Path, err))
+		return
+	}
+
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	rd.deleted++
+	if rd.progress != nil {
+		rd.progress(RecursiveDeleteProgress{Path: job.Path, Deleted: rd.deleted})
+	}
+}
+
+// fail records the first error and stops the delete.
+func (rd *recursiveDelete) fail(err error) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	if rd.err == nil {
+		rd.err = err
+		rd.cancel()
+	}
+}
+
+func (rd *recursiveDelete) failed() error {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	return rd.err
+}
+
+// DefaultDeletePageSize is the number of documents DeleteCollection reads per
+// page when DeleteCollectionOptions.PageSize is not set.
+const DefaultDeletePageSize = MaxBatchWrites
+
+// DefaultDeleteWorkers is the number of pages DeleteCollection deletes at
+// once when DeleteCollectionOptions.Workers is not set.
+const DefaultDeleteWorkers = 4
+
+// DeleteCollectionOptions controls DeleteCollectionWithOptions.
+type DeleteCollectionOptions struct {
+	// PageSize is the number of documents read from the collection at a time.
+	PageSize int
+
+	// Workers bounds the number of pages being deleted at once.
+	Workers int
+}
+
+// DeleteCollectionWithOptions deletes every document in a collection and
+// returns the number deleted. Documents are read a page at a time, so only a
+// few pages are held in memory at once, and the context is checked between
+// pages. Subcollections are not deleted; see RecursiveDelete.
+func (db *DBConnection) DeleteCollectionWithOptions(ctx context.Context, path string, opts *DeleteCollectionOptions) (int64, error) {
+	if opts == nil {
+		opts = &DeleteCollectionOptions{}
+	}
+
+	pageSize := opts.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultDeletePageSize
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = DefaultDeleteWorkers
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	bw := db.BulkWriter(ctx)
+
+	var mu sync.Mutex
+	var deleted int64
+	var first error
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if first == nil {
+			first = err
+			cancel()
+		}
+	}
+
+	pages := make(chan []string, workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for page := range pages {
+				jobs := make([]*BulkWriterJob, 0, len(page))
+				for _, docname := range page {
+					job, err := bw.Delete(docname)
+					if err != nil {
+						fail(err)
+						break
+					}
+					jobs = append(jobs, job)
+				}
+				bw.Flush()
+
+				n := int64(0)
+				for _, job := range jobs {
+					err := job.Result()
+					if err != nil {
+						fail(db.log.ErrFmt("delete %s: %w", job.Path, err))
+						continue
+					}
+					n++
+				}
+
+				mu.Lock()
+				deleted += n
+				mu.Unlock()
+			}
+		}()
+	}
+
+	q := &QuerySpec{
+		Collection: path,
+		Projected:  true,
+		Orders:     []Order{{Path: firestore.DocumentID, Dir: firestore.Asc}},
+		Limit:      pageSize,
+	}
+	for ctx.Err() == nil {
+		iter := db.backend.Documents(ctx, q)
+		docs, err := getAll(iter)
+		iter.Stop()
+		if err != nil {
+			fail(err)
+			break
+		}
+		if len(docs) == 0 {
+			break
+		}
+
+		page := make([]string, len(docs))
+		for i, doc := range docs {
+			page[i] = relativePath(doc.Path())
+		}
+
+		select {
+		case pages <- page:
+		case <-ctx.Done():
+		}
+
+		if len(docs) < pageSize {
+			break
+		}
+
+		// Continue after the last document read rather than from the start,
+		// since the deletes may not have been applied yet.
+		last := splitPath(page[len(page)-1])
+		q.Start = &Cursor{Values: []interface{}{last[len(last)-1]}}
+	}
+
+	close(pages)
+	wg.Wait()
+	bw.End()
+
+	if first == nil {
+		first = ctx.Err()
+	}
+
+	return deleted, first
+}
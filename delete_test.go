@@ -0,0 +1,249 @@
+package fsdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func addTree(t *testing.T, db *DBConnection) int {
+	ctx := context.Background()
+
+	n := 0
+	for i := 0; i < 5; i++ {
+		user := fmt.Sprintf("users/u%d", i)
+		paths := []string{user, user + "/posts/p1", user + "/posts/p2", user + "/posts/p1/comments/c1"}
+		if i == 0 {
+			// A missing document that only has a subcollection. It is
+			// still counted, since RecursiveDelete deletes it.
+			paths = paths[1:]
+			n++
+		}
+		for _, path := range paths {
+			err := db.Add(ctx, path, map[string]interface{}{"path": path})
+			if err != nil {
+				t.Fatalf("add %s: %v", path, err)
+			}
+			n++
+		}
+	}
+
+	err := db.Add(ctx, "other/keep", map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	return n
+}
+
+func TestRecursiveDelete(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	n := addTree(t, db)
+
+	deleted := make(map[string]int)
+	last := int64(0)
+	count, err := db.RecursiveDeleteWithOptions(ctx, "users", &RecursiveDeleteOptions{
+		Parallelism: 2,
+		Progress: func(p RecursiveDeleteProgress) {
+			if p.Deleted != last+1 {
+				t.Errorf("progress: got %d after %d", p.Deleted, last)
+			}
+			last = p.Deleted
+			deleted[p.Path] = len(deleted)
+		},
+	})
+	if err != nil {
+		t.Fatalf("recursive delete: %v", err)
+	}
+	if count != int64(n) || len(deleted) != n {
+		t.Fatalf("recursive delete: deleted %d (%d reported), want %d", count, len(deleted), n)
+	}
+	for path, i := range deleted {
+		for child, j := range deleted {
+			if strings.HasPrefix(child, path+"/") && j > i {
+				t.Fatalf("recursive delete: %s deleted before %s", path, child)
+			}
+		}
+	}
+
+	err = db.Get(ctx, "users/u0/posts/p1/comments/c1", &map[string]interface{}{})
+	if !ErrorIsNotFound(err) {
+		t.Fatalf("nested document: expected NotFound, got %v", err)
+	}
+	err = db.Get(ctx, "other/keep", &map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("unrelated document: %v", err)
+	}
+
+	count, err = db.RecursiveDelete(ctx, "other/keep")
+	if err != nil || count != 1 {
+		t.Fatalf("delete document: got %d, %v", count, err)
+	}
+
+	_, err = db.RecursiveDelete(ctx, "")
+	if err == nil {
+		t.Fatalf("empty path: expected error")
+	}
+}
+
+func TestRecursiveDeleteResume(t *testing.T) {
+	db := newTestDB(t)
+
+	n := addTree(t, db)
+
+	// Cancel on the first delete. users/u0/posts/p1 is only queued once
+	// its comment is deleted, so the interrupted delete never empties the
+	// missing users/u0, and the resumed delete counts it.
+	ctx, cancel := context.WithCancel(context.Background())
+	first, err := db.RecursiveDeleteWithOptions(ctx, "users", &RecursiveDeleteOptions{
+		Parallelism: 1,
+		Progress: func(p RecursiveDeleteProgress) {
+			cancel()
+		},
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("interrupted delete: expected Canceled, got %v", err)
+	}
+	if first < 1 || first >= int64(n) {
+		t.Fatalf("interrupted delete: deleted %d of %d", first, n)
+	}
+
+	second, err := db.RecursiveDelete(context.Background(), "users")
+	if err != nil {
+		t.Fatalf("resumed delete: %v", err)
+	}
+	if first+second != int64(n) {
+		t.Fatalf("resumed delete: deleted %d+%d, want %d", first, second, n)
+	}
+
+	for _, group := range []string{"users", "posts", "comments"} {
+		for doc, err := range db.QueryGroup(group).Documents(context.Background()).All() {
+			if err != nil {
+				t.Fatalf("group %s: %v", group, err)
+			}
+			t.Fatalf("group %s: %s not deleted", group, doc.Path())
+		}
+	}
+}
+
+// TestRecursiveDeleteFlush checks that RecursiveDelete flushes its writes
+// before waiting on them, which the memory backend, like Firestore, requires.
+func TestRecursiveDeleteFlush(t *testing.T) {
+	db := newTestDB(t)
+
+	n := addTree(t, db)
+
+	type result struct {
+		count int64
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		count, err := db.RecursiveDelete(context.Background(), "users")
+		done <- result{count, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil || r.count != int64(n) {
+			t.Fatalf("recursive delete: got %d, %v, want %d", r.count, r.err, n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("recursive delete: waiting on writes that were never flushed")
+	}
+}
+
+func TestDeleteCollectionPaged(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	n := 53
+	for i := 0; i < n; i++ {
+		path := fmt.Sprintf("items/%03d", i)
+		err := db.Add(ctx, path, map[string]interface{}{"n": i})
+		if err != nil {
+			t.Fatalf("add %s: %v", path, err)
+		}
+	}
+	err := db.Add(ctx, "items/000/sub/1", map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	count, err := db.DeleteCollectionWithOptions(ctx, "items", &DeleteCollectionOptions{PageSize: 10, Workers: 3})
+	if err != nil {
+		t.Fatalf("delete collection: %v", err)
+	}
+	if count != int64(n) {
+		t.Fatalf("delete collection: deleted %d, want %d", count, n)
+	}
+
+	left, err := db.DocumentCount(ctx, "items")
+	if err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if left != 0 {
+		t.Fatalf("count after delete: got %d, want 0", left)
+	}
+	err = db.Get(ctx, "items/000/sub/1", &map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("subcollection document: %v", err)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = db.DeleteCollectionWithOptions(cctx, "items", nil)
+	if !ErrorIsCanceled(err) {
+		t.Fatalf("canceled delete: expected Canceled, got %v", err)
+	}
+}
+
+func TestTransactionDeleteCollectionLimit(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	bw := db.BulkWriter(ctx)
+	for i := 0; i < MaxBatchWrites; i++ {
+		_, err := bw.Set(fmt.Sprintf("items/%03d", i), map[string]interface{}{"n": i})
+		if err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	bw.End()
+
+	err := db.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		return tx.DeleteCollection("items")
+	})
+	if err != nil {
+		t.Fatalf("delete %d documents: %v", MaxBatchWrites, err)
+	}
+
+	bw = db.BulkWriter(ctx)
+	for i := 0; i <= MaxBatchWrites; i++ {
+		_, err := bw.Set(fmt.Sprintf("large/%03d", i), map[string]interface{}{"n": i})
+		if err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	bw.End()
+
+	err = db.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		return tx.DeleteCollection("large")
+	})
+	if !errors.Is(err, ErrTransactionTooLarge) {
+		t.Fatalf("delete over limit: expected ErrTransactionTooLarge, got %v", err)
+	}
+
+	count, err := db.DocumentCount(ctx, "large")
+	if err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if count != MaxBatchWrites+1 {
+		t.Fatalf("count after refused delete: got %d, want %d", count, MaxBatchWrites+1)
+	}
+}
@@ -7,6 +7,21 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+// ErrTransactionTooLarge is returned when an operation would take a
+// transaction over Firestore's limit of MaxBatchWrites writes.
+var ErrTransactionTooLarge = errors.New("transaction write limit exceeded")
+
+// ErrInvalidPageToken is returned by Query.Page when a token was modified,
+// signed with a different key, or issued for a different query.
+var ErrInvalidPageToken = errors.New("invalid page token")
+
+// ErrNoPageTokenKey is returned by Query.Page when the connection has no page
+// token key. See DBConnection.SetPageTokenKey.
+var ErrNoPageTokenKey = errors.New("no page token key set")
+
+// ErrSlowConsumer ends a watch using WatchFail when its consumer falls behind.
+var ErrSlowConsumer = errors.New("watch consumer too slow")
+
 func ErrorIsNotFound(err error) bool {
 	return status.Code(err) == codes.NotFound
 }
@@ -15,6 +30,10 @@ func ErrorIsAlreadyExists(err error) bool {
 	return status.Code(err) == codes.AlreadyExists
 }
 
+func ErrorIsPreconditionFailed(err error) bool {
+	return status.Code(err) == codes.FailedPrecondition
+}
+
 func ErrorIsCanceled(err error) bool {
 	if errors.Is(err, context.Canceled) {
 		return true
@@ -28,3 +47,18 @@ func ErrorIsCanceled(err error) bool {
 
 	return false
 }
+
+func ErrorIsMissingIndex(err error) bool {
+	var mie *MissingIndexError
+	return errors.As(err, &mie)
+}
+
+// ErrorIsRetryable reports whether err is a transient failure, such as the
+// database being briefly unavailable, that may succeed if tried again.
+func ErrorIsRetryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Internal:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,225 @@
+package fsdb
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/firestore/apiv1/admin/adminpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Explanation describes how the database plans, and optionally ran, a query.
+type Explanation struct {
+	// IndexesUsed lists the indexes the query planner chose.
+	IndexesUsed []IndexUsed
+
+	// Stats holds the query's execution statistics. It is only set if the
+	// query was run, by calling Explain with analyze set.
+	Stats *ExecutionStats
+}
+
+// IndexUsed is an index chosen by the query planner.
+type IndexUsed struct {
+	QueryScope string // e.g. "Collection" or "Collection group"
+	Properties string // e.g. "(age ASC, __name__ ASC)"
+}
+
+// ExecutionStats are the statistics from running a query.
+type ExecutionStats struct {
+	ResultsReturned     int64
+	ReadOperations      int64 // billable reads
+	DocumentsScanned    int64
+	IndexEntriesScanned int64
+	ExecutionDuration   time.Duration
+
+	// DebugStats holds every statistic the database reported, including
+	// those above. Its contents vary between Firestore versions.
+	DebugStats map[string]interface{}
+}
+
+// String summarizes the plan and statistics on a single line.
+func (e *Explanation) String() string {
+	indexes := make([]string, len(e.IndexesUsed))
+	for i, idx := range e.IndexesUsed {
+		indexes[i] = idx.QueryScope + " " + idx.Properties
+	}
+
+	s := fmt.Sprintf("indexes [%s]", strings.Join(indexes, ", "))
+	if e.Stats != nil {
+		s += fmt.Sprintf(" results %d reads %d documents scanned %d index entries scanned %d duration %v",
+			e.Stats.ResultsReturned, e.Stats.ReadOperations, e.Stats.DocumentsScanned,
+			e.Stats.IndexEntriesScanned, e.Stats.ExecutionDuration)
+	}
+
+	return s
+}
+
+// Explain returns the query plan. If analyze is set the query is also run,
+// and billed, and its execution statistics are returned; the results
+// themselves are discarded. Explain is not supported in transactions.
+//
+// Example:
+//
+//	plan, err := db.Query("users").Where("age", ">=", 18).Explain(ctx, true)
+//	log.Printf("%v", plan)
+func (q *Query) Explain(ctx context.Context, analyze bool) (*Explanation, error) {
+	if q.tx != nil {
+		return nil, fmt.Errorf("explain: not supported in transactions")
+	}
+
+	q.db.recordQuery(&q.spec)
+	return q.backend.Explain(ctx, &q.spec, analyze)
+}
+
+// MissingIndexError is returned when a query needs a composite index that
+// does not exist. It wraps the database's FailedPrecondition error.
+//
+// Example:
+//
+//	var mie *fsdb.MissingIndexError
+//	if errors.As(err, &mie) && mie.Index != nil {
+//		indexes.Add(mie.Index)
+//	}
+type MissingIndexError struct {
+	// URL is the Firebase console link that creates the index.
+	URL string
+
+	// Index is the index the database suggested, or nil if it could not be
+	// decoded from URL.
+	Index *Index
+
+	err error
+}
+
+func (e *MissingIndexError) Error() string {
+	return e.err.Error()
+}
+
+func (e *MissingIndexError) Unwrap() error {
+	return e.err
+}
+
+var consoleURLPattern = regexp.MustCompile(`https://console\.firebase\.google\.com/\S+`)
+
+// missingIndexError returns err as a *MissingIndexError if it reports a
+// missing index, and otherwise returns it unchanged.
+func missingIndexError(err error) error {
+	if err == nil || status.Code(err) != codes.FailedPrecondition {
+		return err
+	}
+	var mie *MissingIndexError
+	if errors.As(err, &mie) {
+		return err
+	}
+
+	msg := status.Convert(err).Message()
+	if !strings.Contains(msg, "requires an index") {
+		return err
+	}
+
+	mie = &MissingIndexError{
+		URL: consoleURLPattern.FindString(msg),
+		err: err,
+	}
+	if mie.URL != "" {
+		mie.Index, _ = indexFromConsoleURL(mie.URL)
+	}
+
+	return mie
+}
+
+// indexFromConsoleURL decodes the index in the create_composite parameter of
+// a console link, which holds a base64 encoded admin API Index message.
+func indexFromConsoleURL(link string) (*Index, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := u.Query().Get("create_composite")
+	if encoded == "" {
+		return nil, fmt.Errorf("no create_composite parameter in %s", link)
+	}
+
+	var b []byte
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		b, err = enc.DecodeString(encoded)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pb := &adminpb.Index{}
+	err = proto.Unmarshal(b, pb)
+	if err != nil {
+		return nil, err
+	}
+
+	return indexFromProto(pb)
+}
+
+// indexFromProto converts an admin API Index. A trailing document ID field
+// in the same direction as the ordered field before it, or with no ordered
+// field before it, is implied, so it is dropped.
+func indexFromProto(pb *adminpb.Index) (*Index, error) {
+	parts := strings.Split(pb.GetName(), "/")
+	group := ""
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "collectionGroups" {
+			group = parts[i+1]
+		}
+	}
+	if group == "" {
+		return nil, fmt.Errorf("no collection group in index name %q", pb.GetName())
+	}
+
+	idx := NewIndex(group)
+	switch pb.GetQueryScope() {
+	case adminpb.Index_COLLECTION:
+	case adminpb.Index_COLLECTION_GROUP:
+		idx.Scope(ScopeCollectionGroup)
+	default:
+		return nil, fmt.Errorf("unsupported query scope %v", pb.GetQueryScope())
+	}
+
+	for _, f := range pb.GetFields() {
+		switch {
+		case f.GetOrder() == adminpb.Index_IndexField_ASCENDING:
+			idx.Asc(f.GetFieldPath())
+		case f.GetOrder() == adminpb.Index_IndexField_DESCENDING:
+			idx.Desc(f.GetFieldPath())
+		case f.GetArrayConfig() == adminpb.Index_IndexField_CONTAINS:
+			idx.ArrayContains(f.GetFieldPath())
+		default:
+			return nil, fmt.Errorf("unsupported index field %v", f)
+		}
+	}
+
+	n := len(idx.Fields)
+	if n > 0 && idx.Fields[n-1].FieldPath == firestore.DocumentID {
+		dir := idx.Fields[n-1].Order
+		for i := n - 2; i >= 0; i-- {
+			if idx.Fields[i].Order != "" {
+				dir = idx.Fields[i].Order
+				break
+			}
+		}
+		if idx.Fields[n-1].Order == dir {
+			idx.Fields = idx.Fields[:n-1]
+		}
+	}
+
+	return idx, nil
+}
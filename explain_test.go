@@ -0,0 +1,96 @@
+package fsdb
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+
+	"cloud.google.com/go/firestore/apiv1/admin/adminpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestExplain(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	for _, name := range []string{"alice", "bob", "carol"} {
+		err := db.Add(ctx, "users/"+name, &testUser{Name: name, Age: len(name)})
+		if err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	plan, err := db.Query("users").Where("Age", ">", 3).Explain(ctx, false)
+	if err != nil || plan.Stats != nil {
+		t.Fatalf("explain: got %v, %v", plan, err)
+	}
+
+	plan, err = db.Query("users").Where("Age", ">", 3).Explain(ctx, true)
+	if err != nil {
+		t.Fatalf("explain analyze: %v", err)
+	}
+	if plan.Stats == nil || plan.Stats.ResultsReturned != 2 || plan.Stats.DocumentsScanned != 3 {
+		t.Fatalf("explain analyze: unexpected %v", plan)
+	}
+
+	_, err = db.Query("users").Where("Age", "~", 3).Explain(ctx, true)
+	if err == nil {
+		t.Fatalf("bad operator: expected error")
+	}
+
+	err = db.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		_, err := tx.Query("users").Explain(ctx, false)
+		return err
+	})
+	if err == nil {
+		t.Fatalf("explain in transaction: expected error")
+	}
+}
+
+func TestMissingIndexError(t *testing.T) {
+	pb := &adminpb.Index{
+		Name:       "projects/p/databases/(default)/collectionGroups/users/indexes/_",
+		QueryScope: adminpb.Index_COLLECTION_GROUP,
+		Fields: []*adminpb.Index_IndexField{
+			{FieldPath: "tags", ValueMode: &adminpb.Index_IndexField_ArrayConfig_{ArrayConfig: adminpb.Index_IndexField_CONTAINS}},
+			{FieldPath: "age", ValueMode: &adminpb.Index_IndexField_Order_{Order: adminpb.Index_IndexField_DESCENDING}},
+			{FieldPath: "__name__", ValueMode: &adminpb.Index_IndexField_Order_{Order: adminpb.Index_IndexField_DESCENDING}},
+		},
+	}
+	b, err := proto.Marshal(pb)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	link := "https://console.firebase.google.com/v1/r/project/p/firestore/indexes?create_composite=" + base64.RawURLEncoding.EncodeToString(b)
+	cause := status.Error(codes.FailedPrecondition, "The query requires an index. You can create it here: "+link)
+
+	err = fmt.Errorf("query: %w", missingIndexError(cause))
+	var mie *MissingIndexError
+	if !errors.As(err, &mie) || !ErrorIsMissingIndex(err) {
+		t.Fatalf("expected MissingIndexError, got %v", err)
+	}
+	if mie.URL != link || status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("unexpected URL %q or code %v", mie.URL, status.Code(err))
+	}
+
+	want := NewIndex("users").Scope(ScopeCollectionGroup).ArrayContains("tags").Desc("age")
+	if mie.Index == nil || !indexEqual(mie.Index, want) {
+		t.Fatalf("suggested index: got %#v, want %#v", mie.Index, want)
+	}
+
+	pb.Fields[1].ValueMode = &adminpb.Index_IndexField_Order_{Order: adminpb.Index_IndexField_ASCENDING}
+	idx, err := indexFromProto(pb)
+	want = NewIndex("users").Scope(ScopeCollectionGroup).ArrayContains("tags").Asc("age").Desc("__name__")
+	if err != nil || !indexEqual(idx, want) {
+		t.Fatalf("opposite document ID order: got %#v, %v, want %#v", idx, err, want)
+	}
+
+	other := status.Error(codes.FailedPrecondition, "too much contention")
+	if missingIndexError(other) != other || ErrorIsMissingIndex(other) {
+		t.Fatalf("other precondition failure: wrapped as missing index")
+	}
+}
@@ -0,0 +1,618 @@
+package fsdb
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/firestore/apiv1/firestorepb"
+)
+
+// firestoreBackend is the default Backend, talking to Cloud Firestore through a firestore.Client.
+type firestoreBackend struct {
+	client *firestore.Client
+}
+
+// NewFirestoreBackend returns a Backend that uses the given client.
+func NewFirestoreBackend(client *firestore.Client) Backend {
+	return &firestoreBackend{client: client}
+}
+
+func (b *firestoreBackend) Get(ctx context.Context, path string) (BackendDocument, error) {
+	dsnap, err := b.client.Doc(path).Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &firestoreDocument{dsnap}, nil
+}
+
+func (b *firestoreBackend) Create(ctx context.Context, path string, dval interface{}) error {
+	_, err := b.client.Doc(path).Create(ctx, dval)
+	return err
+}
+
+func (b *firestoreBackend) Set(ctx context.Context, path string, dval interface{}) error {
+	_, err := b.client.Doc(path).Set(ctx, dval)
+	return err
+}
+
+func (b *firestoreBackend) SetMerge(ctx context.Context, path string, dval interface{}, fields []string) error {
+	_, err := b.client.Doc(path).Set(ctx, dval, firestoreMerge(fields))
+	return err
+}
+
+func (b *firestoreBackend) Update(ctx context.Context, path string, updates []FieldUpdate, preconds ...Precondition) error {
+	_, err := b.client.Doc(path).Update(ctx, firestoreUpdates(updates), firestorePreconditions(preconds)...)
+	return err
+}
+
+func (b *firestoreBackend) Delete(ctx context.Context, path string, preconds ...Precondition) error {
+	_, err := b.client.Doc(path).Delete(ctx, firestorePreconditions(preconds)...)
+	return err
+}
+
+func firestorePreconditions(preconds []Precondition) []firestore.Precondition {
+	fp := make([]firestore.Precondition, len(preconds))
+	for i, p := range preconds {
+		if p.exists {
+			fp[i] = firestore.Exists
+		} else {
+			fp[i] = firestore.LastUpdateTime(p.updateTime)
+		}
+	}
+	return fp
+}
+
+func (b *firestoreBackend) Documents(ctx context.Context, q *QuerySpec) BackendDocumentIterator {
+	query, err := b.query(q)
+	if err != nil {
+		return &errorDocumentIterator{err}
+	}
+
+	return &firestoreDocumentIterator{query.Documents(ctx)}
+}
+
+func (b *firestoreBackend) Collections(ctx context.Context, path string) BackendCollectionIterator {
+	dref := b.client.Doc(path)
+	if dref == nil {
+		return &errorCollectionIterator{fmt.Errorf("nil dref: bad docname '%s'?", path)}
+	}
+
+	return &firestoreCollectionIterator{dref.Collections(ctx)}
+}
+
+func (b *firestoreBackend) DocumentRefs(ctx context.Context, path string) BackendCollectionIterator {
+	cref := b.client.Collection(path)
+	if cref == nil {
+		return &errorCollectionIterator{fmt.Errorf("nil collection: bad path '%s'?", path)}
+	}
+
+	return &firestoreDocumentRefIterator{cref.DocumentRefs(ctx)}
+}
+
+func (b *firestoreBackend) Aggregate(ctx context.Context, q *QuerySpec, aggs []Aggregation) (AggregationResult, error) {
+	aq, err := b.aggregationQuery(q, aggs)
+	if err != nil {
+		return nil, err
+	}
+
+	return firestoreAggregate(ctx, aq, aggs)
+}
+
+func (b *firestoreBackend) Explain(ctx context.Context, q *QuerySpec, analyze bool) (*Explanation, error) {
+	query, err := b.query(q)
+	if err != nil {
+		return nil, err
+	}
+
+	iter := query.WithRunOptions(firestore.ExplainOptions{Analyze: analyze}).Documents(ctx)
+	defer iter.Stop()
+
+	for {
+		_, err := iter.Next()
+		if err == DBIteratorDone {
+			break
+		}
+		if err != nil {
+			return nil, missingIndexError(err)
+		}
+	}
+
+	metrics, err := iter.ExplainMetrics()
+	if err != nil {
+		return nil, err
+	}
+
+	return firestoreExplanation(metrics), nil
+}
+
+// firestoreExplanation converts the metrics of an explained query.
+func firestoreExplanation(metrics *firestore.ExplainMetrics) *Explanation {
+	e := &Explanation{}
+
+	if metrics.PlanSummary != nil {
+		for _, m := range metrics.PlanSummary.IndexesUsed {
+			if m == nil {
+				continue
+			}
+			scope, _ := (*m)["query_scope"].(string)
+			props, _ := (*m)["properties"].(string)
+			e.IndexesUsed = append(e.IndexesUsed, IndexUsed{QueryScope: scope, Properties: props})
+		}
+	}
+
+	if es := metrics.ExecutionStats; es != nil {
+		e.Stats = &ExecutionStats{
+			ResultsReturned: es.ResultsReturned,
+			ReadOperations:  es.ReadOperations,
+			DebugStats:      map[string]interface{}{},
+		}
+		if es.ExecutionDuration != nil {
+			e.Stats.ExecutionDuration = *es.ExecutionDuration
+		}
+		if es.DebugStats != nil {
+			e.Stats.DebugStats = *es.DebugStats
+		}
+		e.Stats.DocumentsScanned = debugStat(e.Stats.DebugStats, "documents_scanned")
+		e.Stats.IndexEntriesScanned = debugStat(e.Stats.DebugStats, "index_entries_scanned")
+	}
+
+	return e
+}
+
+// debugStat returns a count from the debug statistics, which Firestore
+// reports as decimal strings.
+func debugStat(stats map[string]interface{}, name string) int64 {
+	switch v := stats[name].(type) {
+	case string:
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	case float64:
+		return int64(v)
+	case int64:
+		return v
+	}
+	return 0
+}
+
+func (b *firestoreBackend) aggregationQuery(q *QuerySpec, aggs []Aggregation) (*firestore.AggregationQuery, error) {
+	query, err := b.query(q)
+	if err != nil {
+		return nil, err
+	}
+
+	aq := query.NewAggregationQuery()
+	for _, a := range aggs {
+		switch a.op {
+		case aggregateCount:
+			aq = aq.WithCount(a.Alias)
+		case aggregateSum:
+			aq = aq.WithSum(a.Field, a.Alias)
+		case aggregateAvg:
+			aq = aq.WithAvg(a.Field, a.Alias)
+		}
+	}
+
+	return aq, nil
+}
+
+func firestoreAggregate(ctx context.Context, aq *firestore.AggregationQuery, aggs []Aggregation) (AggregationResult, error) {
+	result, err := aq.Get(ctx)
+	if err != nil {
+		return nil, missingIndexError(err)
+	}
+
+	values := make(AggregationResult, len(aggs))
+	for _, a := range aggs {
+		val, ok := result[a.Alias]
+		if !ok {
+			return nil, fmt.Errorf("%s field not found in aggregation result", a.Alias)
+		}
+		pv, ok := val.(*firestorepb.Value)
+		if !ok {
+			return nil, fmt.Errorf("unexpected %s type: %T", a.Alias, val)
+		}
+		switch v := pv.GetValueType().(type) {
+		case *firestorepb.Value_IntegerValue:
+			values[a.Alias] = v.IntegerValue
+		case *firestorepb.Value_DoubleValue:
+			values[a.Alias] = v.DoubleValue
+		case *firestorepb.Value_NullValue:
+			values[a.Alias] = nil
+		default:
+			return nil, fmt.Errorf("unexpected %s value: %v", a.Alias, pv)
+		}
+	}
+
+	return values, nil
+}
+
+func (b *firestoreBackend) RunTransaction(ctx context.Context, f func(ctx context.Context, tx BackendTransaction) error) error {
+	return b.client.RunTransaction(ctx, func(ctx context.Context, ft *firestore.Transaction) error {
+		return f(ctx, &firestoreTransaction{b: b, ctx: ctx, ft: ft})
+	})
+}
+
+func (b *firestoreBackend) ListenDocument(ctx context.Context, path string) BackendDocumentIterator {
+	dref := b.client.Doc(path)
+	if dref == nil {
+		return &errorDocumentIterator{fmt.Errorf("nil dref: bad docname '%s'?", path)}
+	}
+
+	return &firestoreDocumentSnapshotIterator{dref.Snapshots(ctx)}
+}
+
+func (b *firestoreBackend) ListenQuery(ctx context.Context, q *QuerySpec) BackendQueryIterator {
+	query, err := b.query(q)
+	if err != nil {
+		return &errorQueryIterator{err}
+	}
+
+	return &firestoreQuerySnapshotIterator{query.Snapshots(ctx)}
+}
+
+func (b *firestoreBackend) BulkWriter(ctx context.Context) BackendBulkWriter {
+	return &firestoreBulkWriter{b: b, bw: b.client.BulkWriter(ctx)}
+}
+
+// query translates a QuerySpec into a firestore.Query.
+func (b *firestoreBackend) query(q *QuerySpec) (firestore.Query, error) {
+	var query firestore.Query
+
+	if q.Group {
+		query = b.client.CollectionGroup(q.Collection).Query
+	} else {
+		col := b.client.Collection(q.Collection)
+		if col == nil {
+			return query, fmt.Errorf("nil collection: bad path '%s'?", q.Collection)
+		}
+		query = col.Query
+	}
+
+	for _, f := range q.Filters {
+		ef, err := firestoreFilter(f)
+		if err != nil {
+			return query, err
+		}
+		query = query.WhereEntity(ef)
+	}
+	for _, o := range q.Orders {
+		query = query.OrderBy(o.Path, o.Dir)
+	}
+	if q.Projected {
+		query = query.Select(q.Fields...)
+	}
+	if q.Offset != 0 {
+		query = query.Offset(q.Offset)
+	}
+	if q.Limit != 0 {
+		if q.LimitToLast {
+			query = query.LimitToLast(q.Limit)
+		} else {
+			query = query.Limit(q.Limit)
+		}
+	}
+	if q.Start != nil {
+		if q.Start.Inclusive {
+			query = query.StartAt(q.Start.Values...)
+		} else {
+			query = query.StartAfter(q.Start.Values...)
+		}
+	}
+	if q.End != nil {
+		if q.End.Inclusive {
+			query = query.EndAt(q.End.Values...)
+		} else {
+			query = query.EndBefore(q.End.Values...)
+		}
+	}
+
+	return query, nil
+}
+
+type firestoreTransaction struct {
+	b   *firestoreBackend
+	ctx context.Context
+	ft  *firestore.Transaction
+}
+
+func (t *firestoreTransaction) Get(path string) (BackendDocument, error) {
+	dsnap, err := t.ft.Get(t.b.client.Doc(path))
+	if err != nil {
+		return nil, err
+	}
+
+	return &firestoreDocument{dsnap}, nil
+}
+
+func (t *firestoreTransaction) Documents(q *QuerySpec) BackendDocumentIterator {
+	query, err := t.b.query(q)
+	if err != nil {
+		return &errorDocumentIterator{err}
+	}
+
+	return &firestoreDocumentIterator{t.ft.Documents(query)}
+}
+
+func (t *firestoreTransaction) Aggregate(q *QuerySpec, aggs []Aggregation) (AggregationResult, error) {
+	aq, err := t.b.aggregationQuery(q, aggs)
+	if err != nil {
+		return nil, err
+	}
+
+	return firestoreAggregate(t.ctx, aq.Transaction(t.ft), aggs)
+}
+
+func (t *firestoreTransaction) Create(path string, dval interface{}) error {
+	return t.ft.Create(t.b.client.Doc(path), dval)
+}
+
+func (t *firestoreTransaction) Set(path string, dval interface{}) error {
+	return t.ft.Set(t.b.client.Doc(path), dval)
+}
+
+func (t *firestoreTransaction) SetMerge(path string, dval interface{}, fields []string) error {
+	return t.ft.Set(t.b.client.Doc(path), dval, firestoreMerge(fields))
+}
+
+func (t *firestoreTransaction) Update(path string, updates []FieldUpdate) error {
+	return t.ft.Update(t.b.client.Doc(path), firestoreUpdates(updates))
+}
+
+func (t *firestoreTransaction) Delete(path string) error {
+	return t.ft.Delete(t.b.client.Doc(path))
+}
+
+func firestoreFilter(f Filter) (firestore.EntityFilter, error) {
+	switch f := f.(type) {
+	case PropertyFilter:
+		return firestore.PropertyFilter{Path: f.Path, Operator: f.Op, Value: f.Value}, nil
+	case CompositeFilter:
+		filters := make([]firestore.EntityFilter, len(f.Filters))
+		for i, sub := range f.Filters {
+			ef, err := firestoreFilter(sub)
+			if err != nil {
+				return nil, err
+			}
+			filters[i] = ef
+		}
+		switch f.Op {
+		case "and":
+			return firestore.AndFilter{Filters: filters}, nil
+		case "or":
+			return firestore.OrFilter{Filters: filters}, nil
+		}
+		return nil, fmt.Errorf("invalid composite filter operator %q", f.Op)
+	}
+	return nil, fmt.Errorf("unsupported filter type %T", f)
+}
+
+func firestoreUpdates(updates []FieldUpdate) []firestore.Update {
+	fu := make([]firestore.Update, len(updates))
+	for i, u := range updates {
+		value := u.Value
+		switch u.transform {
+		case transformIncrement:
+			value = firestore.Increment(u.Value)
+		case transformArrayUnion:
+			value = firestore.ArrayUnion(u.Value.([]interface{})...)
+		case transformArrayRemove:
+			value = firestore.ArrayRemove(u.Value.([]interface{})...)
+		}
+		fu[i] = firestore.Update{Path: u.Path, Value: value}
+	}
+	return fu
+}
+
+func firestoreMerge(fields []string) firestore.SetOption {
+	if len(fields) == 0 {
+		return firestore.MergeAll
+	}
+
+	paths := make([]firestore.FieldPath, len(fields))
+	for i, f := range fields {
+		paths[i] = strings.Split(f, ".")
+	}
+
+	return firestore.Merge(paths...)
+}
+
+type firestoreBulkWriter struct {
+	b  *firestoreBackend
+	bw *firestore.BulkWriter
+}
+
+func (w *firestoreBulkWriter) Create(path string, dval interface{}) (BackendWriteJob, error) {
+	return firestoreJob(w.bw.Create(w.b.client.Doc(path), dval))
+}
+
+func (w *firestoreBulkWriter) Set(path string, dval interface{}) (BackendWriteJob, error) {
+	return firestoreJob(w.bw.Set(w.b.client.Doc(path), dval))
+}
+
+func (w *firestoreBulkWriter) Update(path string, updates []FieldUpdate) (BackendWriteJob, error) {
+	return firestoreJob(w.bw.Update(w.b.client.Doc(path), firestoreUpdates(updates)))
+}
+
+func (w *firestoreBulkWriter) Delete(path string) (BackendWriteJob, error) {
+	return firestoreJob(w.bw.Delete(w.b.client.Doc(path)))
+}
+
+func (w *firestoreBulkWriter) Flush() {
+	w.bw.Flush()
+}
+
+func (w *firestoreBulkWriter) End() {
+	w.bw.End()
+}
+
+type firestoreWriteJob struct {
+	job *firestore.BulkWriterJob
+}
+
+func firestoreJob(job *firestore.BulkWriterJob, err error) (BackendWriteJob, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &firestoreWriteJob{job}, nil
+}
+
+func (j *firestoreWriteJob) Result() error {
+	_, err := j.job.Results()
+	return err
+}
+
+type firestoreDocument struct {
+	snap *firestore.DocumentSnapshot
+}
+
+func (d *firestoreDocument) Path() string {
+	return d.snap.Ref.Path
+}
+
+func (d *firestoreDocument) Exists() bool {
+	return d.snap.Exists()
+}
+
+func (d *firestoreDocument) Data() map[string]interface{} {
+	return d.snap.Data()
+}
+
+func (d *firestoreDocument) DataTo(dval interface{}) error {
+	return d.snap.DataTo(dval)
+}
+
+func (d *firestoreDocument) CreateTime() time.Time {
+	return d.snap.CreateTime
+}
+
+func (d *firestoreDocument) UpdateTime() time.Time {
+	return d.snap.UpdateTime
+}
+
+func (d *firestoreDocument) ReadTime() time.Time {
+	return d.snap.ReadTime
+}
+
+type firestoreDocumentIterator struct {
+	it *firestore.DocumentIterator
+}
+
+func (it *firestoreDocumentIterator) Next() (BackendDocument, error) {
+	dsnap, err := it.it.Next()
+	if err != nil {
+		return nil, missingIndexError(err)
+	}
+
+	return &firestoreDocument{dsnap}, nil
+}
+
+func (it *firestoreDocumentIterator) Stop() {
+	it.it.Stop()
+}
+
+type firestoreCollectionIterator struct {
+	it *firestore.CollectionIterator
+}
+
+func (it *firestoreCollectionIterator) Next() (string, error) {
+	col, err := it.it.Next()
+	if err != nil {
+		return "", err
+	}
+
+	return col.Path, nil
+}
+
+type firestoreDocumentRefIterator struct {
+	it *firestore.DocumentRefIterator
+}
+
+func (it *firestoreDocumentRefIterator) Next() (string, error) {
+	dref, err := it.it.Next()
+	if err != nil {
+		return "", err
+	}
+
+	return dref.Path, nil
+}
+
+type firestoreDocumentSnapshotIterator struct {
+	it *firestore.DocumentSnapshotIterator
+}
+
+func (it *firestoreDocumentSnapshotIterator) Next() (BackendDocument, error) {
+	dsnap, err := it.it.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	return &firestoreDocument{dsnap}, nil
+}
+
+func (it *firestoreDocumentSnapshotIterator) Stop() {
+	it.it.Stop()
+}
+
+type firestoreQuerySnapshotIterator struct {
+	it *firestore.QuerySnapshotIterator
+}
+
+func (it *firestoreQuerySnapshotIterator) Next() (*BackendQuerySnapshot, error) {
+	snap, err := it.it.Next()
+	if err != nil {
+		return nil, missingIndexError(err)
+	}
+
+	dsnaps, err := snap.Documents.GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	bsnap := &BackendQuerySnapshot{
+		Docs:     make([]BackendDocument, 0, len(dsnaps)),
+		Changes:  make([]BackendDocumentChange, 0, len(snap.Changes)),
+		ReadTime: snap.ReadTime,
+	}
+
+	for _, dsnap := range dsnaps {
+		bsnap.Docs = append(bsnap.Docs, &firestoreDocument{dsnap})
+	}
+
+	for _, fc := range snap.Changes {
+		kind, err := firestoreKindRemap(fc.Kind)
+		if err != nil {
+			return nil, err
+		}
+
+		bsnap.Changes = append(bsnap.Changes, BackendDocumentChange{
+			Kind:     kind,
+			Doc:      &firestoreDocument{fc.Doc},
+			OldIndex: fc.OldIndex,
+			NewIndex: fc.NewIndex,
+		})
+	}
+
+	return bsnap, nil
+}
+
+func (it *firestoreQuerySnapshotIterator) Stop() {
+	it.it.Stop()
+}
+
+func firestoreKindRemap(kind firestore.DocumentChangeKind) (DocumentChangeKind, error) {
+	switch kind {
+	case firestore.DocumentAdded:
+		return DBCHANGE_DOC_ADDED, nil
+	case firestore.DocumentRemoved:
+		return DBCHANGE_DOC_REMOVED, nil
+	case firestore.DocumentModified:
+		return DBCHANGE_DOC_CHANGED, nil
+	}
+
+	return DBCHANGE_ERROR, fmt.Errorf("fsdb: unknown firestore document change kind %d", kind)
+}
@@ -0,0 +1,337 @@
+// Package fsdbtest provides fakes for testing code that uses fsdb.
+package fsdbtest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/firestore/apiv1/admin/adminpb"
+	"cloud.google.com/go/longrunning/autogen/longrunningpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// FakeAdminServer is an in-process Firestore Admin API server that keeps
+// composite indexes and field overrides in memory, for testing
+// fsdb.IndexSet.Apply without a real project. Only the calls Apply makes are
+// supported.
+//
+// Example:
+//
+//	srv, err := fsdbtest.NewFakeAdminServer()
+//	...
+//	defer srv.Close()
+//	addr := srv.Addr()
+//	added, removed, err := indexes.Apply(ctx, "test", "", &fsdb.Credentials{EmulatorHost: &addr}, nil)
+type FakeAdminServer struct {
+	mu      sync.Mutex
+	pending int
+	nextID  int
+	indexes map[string]*adminpb.Index
+	fields  map[string]*adminpb.Field
+	ops     map[string]*fakeOperation
+
+	lis net.Listener
+	srv *grpc.Server
+}
+
+type fakeOperation struct {
+	op       *longrunningpb.Operation
+	result   proto.Message
+	meta     func(state adminpb.OperationState, progress *adminpb.Progress) proto.Message
+	polls    int
+	required int
+}
+
+// NewFakeAdminServer starts a FakeAdminServer listening on a local port.
+func NewFakeAdminServer() (*FakeAdminServer, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FakeAdminServer{
+		indexes: make(map[string]*adminpb.Index),
+		fields:  make(map[string]*adminpb.Field),
+		ops:     make(map[string]*fakeOperation),
+		lis:     lis,
+		srv:     grpc.NewServer(),
+	}
+	adminpb.RegisterFirestoreAdminServer(s.srv, &fakeAdminService{s: s})
+	longrunningpb.RegisterOperationsServer(s.srv, &fakeOperationsService{s: s})
+
+	go s.srv.Serve(lis)
+
+	return s, nil
+}
+
+// Addr returns the host:port the server is listening on.
+func (s *FakeAdminServer) Addr() string {
+	return s.lis.Addr().String()
+}
+
+// Close stops the server.
+func (s *FakeAdminServer) Close() {
+	s.srv.Stop()
+}
+
+// SetPendingPolls makes each operation started from now on report that it
+// is still running the first n times it is polled.
+func (s *FakeAdminServer) SetPendingPolls(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending = n
+}
+
+// Indexes returns the composite indexes the server holds, sorted by name.
+func (s *FakeAdminServer) Indexes() []*adminpb.Index {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	indexes := make([]*adminpb.Index, 0, len(s.indexes))
+	for _, name := range sortedNames(s.indexes) {
+		indexes = append(indexes, proto.Clone(s.indexes[name]).(*adminpb.Index))
+	}
+
+	return indexes
+}
+
+// Fields returns the field configurations the server holds, sorted by name.
+func (s *FakeAdminServer) Fields() []*adminpb.Field {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fields := make([]*adminpb.Field, 0, len(s.fields))
+	for _, name := range sortedNames(s.fields) {
+		fields = append(fields, proto.Clone(s.fields[name]).(*adminpb.Field))
+	}
+
+	return fields
+}
+
+func sortedNames[T any](m map[string]T) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// startOperation records a new operation. s.mu must be held.
+func (s *FakeAdminServer) startOperation(result proto.Message, meta func(state adminpb.OperationState, progress *adminpb.Progress) proto.Message) (*longrunningpb.Operation, error) {
+	s.nextID++
+	fop := &fakeOperation{
+		op:       &longrunningpb.Operation{Name: fmt.Sprintf("operations/fake-%d", s.nextID)},
+		result:   result,
+		meta:     meta,
+		required: s.pending,
+	}
+	s.ops[fop.op.Name] = fop
+
+	err := fop.update()
+	if err != nil {
+		return nil, err
+	}
+
+	return proto.Clone(fop.op).(*longrunningpb.Operation), nil
+}
+
+// update sets the operation's metadata, and its result once it has been
+// polled enough times.
+func (fop *fakeOperation) update() error {
+	done := fop.polls >= fop.required
+	state := adminpb.OperationState_PROCESSING
+	if done {
+		state = adminpb.OperationState_SUCCESSFUL
+	}
+	progress := &adminpb.Progress{EstimatedWork: int64(fop.required), CompletedWork: int64(fop.polls)}
+
+	meta, err := anypb.New(fop.meta(state, progress))
+	if err != nil {
+		return err
+	}
+	fop.op.Metadata = meta
+
+	if done {
+		resp, err := anypb.New(fop.result)
+		if err != nil {
+			return err
+		}
+		fop.op.Done = true
+		fop.op.Result = &longrunningpb.Operation_Response{Response: resp}
+	}
+
+	return nil
+}
+
+// inDatabase reports whether a resource name is below a parent that may use
+// "-" as a wildcard collection group.
+func inDatabase(name string, parent string) bool {
+	if db, ok := strings.CutSuffix(parent, "/collectionGroups/-"); ok {
+		return strings.HasPrefix(name, db+"/collectionGroups/")
+	}
+	return strings.HasPrefix(name, parent+"/")
+}
+
+type fakeAdminService struct {
+	adminpb.UnimplementedFirestoreAdminServer
+	s *FakeAdminServer
+}
+
+func (f *fakeAdminService) ListIndexes(ctx context.Context, req *adminpb.ListIndexesRequest) (*adminpb.ListIndexesResponse, error) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+
+	resp := &adminpb.ListIndexesResponse{}
+	for _, name := range sortedNames(f.s.indexes) {
+		if inDatabase(name, req.GetParent()) {
+			resp.Indexes = append(resp.Indexes, proto.Clone(f.s.indexes[name]).(*adminpb.Index))
+		}
+	}
+
+	return resp, nil
+}
+
+func (f *fakeAdminService) CreateIndex(ctx context.Context, req *adminpb.CreateIndexRequest) (*longrunningpb.Operation, error) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+
+	idx := proto.Clone(req.GetIndex()).(*adminpb.Index)
+	if len(idx.GetFields()) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "index has no fields")
+	}
+	for _, existing := range f.s.indexes {
+		if strings.HasPrefix(existing.GetName(), req.GetParent()+"/") && existing.GetQueryScope() == idx.GetQueryScope() &&
+			proto.Equal(&adminpb.Index{Fields: existing.GetFields()}, &adminpb.Index{Fields: idx.GetFields()}) {
+			return nil, status.Errorf(codes.AlreadyExists, "index already exists")
+		}
+	}
+
+	f.s.nextID++
+	idx.Name = fmt.Sprintf("%s/indexes/fake-%d", req.GetParent(), f.s.nextID)
+	idx.ApiScope = adminpb.Index_ANY_API
+	idx.State = adminpb.Index_READY
+	f.s.indexes[idx.Name] = idx
+
+	return f.s.startOperation(idx, func(state adminpb.OperationState, progress *adminpb.Progress) proto.Message {
+		return &adminpb.IndexOperationMetadata{
+			Index:             idx.Name,
+			State:             state,
+			ProgressDocuments: progress,
+		}
+	})
+}
+
+func (f *fakeAdminService) DeleteIndex(ctx context.Context, req *adminpb.DeleteIndexRequest) (*emptypb.Empty, error) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+
+	if _, ok := f.s.indexes[req.GetName()]; !ok {
+		return nil, status.Errorf(codes.NotFound, "index %s not found", req.GetName())
+	}
+	delete(f.s.indexes, req.GetName())
+
+	return &emptypb.Empty{}, nil
+}
+
+func (f *fakeAdminService) ListFields(ctx context.Context, req *adminpb.ListFieldsRequest) (*adminpb.ListFieldsResponse, error) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+
+	resp := &adminpb.ListFieldsResponse{}
+	for _, name := range sortedNames(f.s.fields) {
+		if inDatabase(name, req.GetParent()) {
+			resp.Fields = append(resp.Fields, proto.Clone(f.s.fields[name]).(*adminpb.Field))
+		}
+	}
+
+	return resp, nil
+}
+
+// UpdateField sets the parts of a field's configuration named by the update
+// mask, or all of them if there is no mask. A field without an index
+// configuration reverts to the default indexing.
+func (f *fakeAdminService) UpdateField(ctx context.Context, req *adminpb.UpdateFieldRequest) (*longrunningpb.Operation, error) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+
+	name := req.GetField().GetName()
+	if !strings.Contains(name, "/fields/") {
+		return nil, status.Errorf(codes.InvalidArgument, "bad field name %q", name)
+	}
+
+	field := &adminpb.Field{Name: name}
+	if existing, ok := f.s.fields[name]; ok {
+		field = proto.Clone(existing).(*adminpb.Field)
+	}
+
+	paths := req.GetUpdateMask().GetPaths()
+	if len(paths) == 0 {
+		paths = []string{"index_config", "ttl_config"}
+	}
+	for _, path := range paths {
+		switch path {
+		case "index_config":
+			field.IndexConfig = proto.Clone(req.GetField().GetIndexConfig()).(*adminpb.Field_IndexConfig)
+		case "ttl_config":
+			field.TtlConfig = proto.Clone(req.GetField().GetTtlConfig()).(*adminpb.Field_TtlConfig)
+			if field.TtlConfig != nil {
+				field.TtlConfig.State = adminpb.Field_TtlConfig_ACTIVE
+			}
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "unsupported update mask path %q", path)
+		}
+	}
+
+	if field.GetIndexConfig().GetUsesAncestorConfig() {
+		field.IndexConfig = nil
+	}
+	if field.GetIndexConfig() == nil && field.GetTtlConfig() == nil {
+		delete(f.s.fields, name)
+	} else {
+		f.s.fields[name] = field
+	}
+
+	return f.s.startOperation(field, func(state adminpb.OperationState, progress *adminpb.Progress) proto.Message {
+		return &adminpb.FieldOperationMetadata{
+			Field:             field.GetName(),
+			State:             state,
+			ProgressDocuments: progress,
+		}
+	})
+}
+
+type fakeOperationsService struct {
+	longrunningpb.UnimplementedOperationsServer
+	s *FakeAdminServer
+}
+
+func (f *fakeOperationsService) GetOperation(ctx context.Context, req *longrunningpb.GetOperationRequest) (*longrunningpb.Operation, error) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+
+	fop, ok := f.s.ops[req.GetName()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "operation %s not found", req.GetName())
+	}
+
+	if !fop.op.Done {
+		fop.polls++
+		err := fop.update()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return proto.Clone(fop.op).(*longrunningpb.Operation), nil
+}
@@ -0,0 +1,568 @@
+package fsdb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	admin "cloud.google.com/go/firestore/apiv1/admin"
+	"cloud.google.com/go/firestore/apiv1/admin/adminpb"
+	"github.com/tadhunt/logger"
+	"google.golang.org/api/iterator"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// DefaultApplyPollInterval is how often Apply checks on index builds.
+const DefaultApplyPollInterval = 5 * time.Second
+
+// ApplyAction is a change Apply makes to a database's indexes.
+type ApplyAction string
+
+const (
+	ApplyCreateIndex         ApplyAction = "create index"
+	ApplyDeleteIndex         ApplyAction = "delete index"
+	ApplyUpdateFieldOverride ApplyAction = "update field override"
+	ApplyResetFieldOverride  ApplyAction = "reset field override"
+)
+
+// ApplyOptions control IndexSet.Apply.
+type ApplyOptions struct {
+	// Delete removes deployed indexes and field overrides that are not in
+	// the set. Otherwise they are reported but left alone.
+	Delete bool
+
+	// DryRun computes and returns the changes without making them.
+	DryRun bool
+
+	// PollInterval is how often to check on long-running operations.
+	// If zero, DefaultApplyPollInterval is used.
+	PollInterval time.Duration
+
+	// Progress, if set, is called when each change starts, each time its
+	// operation is checked, and when it finishes.
+	Progress func(ApplyProgress)
+
+	// Log, if set, is warned about deployed indexes that Apply skips.
+	Log logger.CompatLogWriter
+}
+
+// ApplyProgress reports the state of one change made by Apply.
+type ApplyProgress struct {
+	Action ApplyAction
+
+	// Index is set for index actions, FieldOverride for field override actions.
+	Index         *Index
+	FieldOverride *FieldOverride
+
+	// CompletedDocuments and EstimatedDocuments measure an index build, when
+	// the database reports them.
+	CompletedDocuments int64
+	EstimatedDocuments int64
+
+	// Done is set once the change has finished, successfully if Err is nil.
+	Done bool
+	Err  error
+}
+
+// Apply makes the composite indexes and field overrides of a database match
+// the set, using the Firestore Admin API. It creates missing indexes, updates
+// field overrides and their TTL policies, and if opts.Delete is set deletes
+// those that are not in the set, then waits for the changes to finish. It
+// returns what was, or in a dry run would be, added and removed; removed
+// lists the extras even if they were not deleted. Deployed indexes that
+// cannot be represented in an IndexSet, such as vector indexes, are skipped
+// with a warning to opts.Log. If several deployed indexes are equivalent,
+// e.g. because one ends with an explicit document ID field, Delete removes
+// all of them. The set is validated before anything is changed.
+//
+// dbID may be "" for the default database. If credentials names an
+// emulator, or FIRESTORE_EMULATOR_HOST is set, Apply talks to that host
+// without authenticating; see fsdbtest.FakeAdminServer.
+//
+// Example:
+//
+//	added, removed, err := indexes.Apply(ctx, "my-project", "", creds, &fsdb.ApplyOptions{
+//		Progress: func(p fsdb.ApplyProgress) { log.Printf("%s %v", p.Action, p.Done) },
+//	})
+func (s *IndexSet) Apply(ctx context.Context, project string, dbID string, credentials *Credentials, opts *ApplyOptions) (*IndexSet, *IndexSet, error) {
+	err := s.Validate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if opts == nil {
+		opts = &ApplyOptions{}
+	}
+	if dbID == "" {
+		dbID = "(default)"
+	}
+	if host := emulatorHost(credentials); host != "" {
+		credentials = &Credentials{EmulatorHost: &host}
+	}
+
+	options, err := credentialOptions(ctx, credentials)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client, err := admin.NewFirestoreAdminClient(ctx, options...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer client.Close()
+
+	a := &indexApplier{
+		client:   client,
+		database: "projects/" + project + "/databases/" + dbID,
+		opts:     opts,
+	}
+
+	return a.apply(ctx, s)
+}
+
+// indexApplier holds the state of one call to IndexSet.Apply.
+type indexApplier struct {
+	client   *admin.FirestoreAdminClient
+	database string
+	opts     *ApplyOptions
+
+	// names maps deployed indexes to their resource names.
+	names map[*Index]string
+}
+
+func (a *indexApplier) apply(ctx context.Context, want *IndexSet) (*IndexSet, *IndexSet, error) {
+	deployed, err := a.list(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	added, removed := deployed.Diff(want)
+	if a.opts.DryRun {
+		return added, removed, nil
+	}
+
+	waits := make([]func() error, 0)
+
+	for _, idx := range added.Indexes {
+		wait, err := a.createIndex(ctx, idx)
+		if err != nil {
+			return added, removed, err
+		}
+		waits = append(waits, wait)
+	}
+
+	updated := make(map[string]bool)
+	for _, fo := range added.FieldOverrides {
+		wait, err := a.updateField(ctx, fo, ApplyUpdateFieldOverride)
+		if err != nil {
+			return added, removed, err
+		}
+		waits = append(waits, wait)
+		updated[fo.CollectionGroup+"/"+fo.FieldPath] = true
+	}
+
+	if a.opts.Delete {
+		for _, idx := range deployed.Indexes {
+			if !indexMatchesAny(idx, removed.Indexes) {
+				continue
+			}
+			err := a.deleteIndex(ctx, idx)
+			if err != nil {
+				return added, removed, err
+			}
+		}
+
+		for _, fo := range removed.FieldOverrides {
+			if updated[fo.CollectionGroup+"/"+fo.FieldPath] {
+				continue
+			}
+			wait, err := a.updateField(ctx, fo, ApplyResetFieldOverride)
+			if err != nil {
+				return added, removed, err
+			}
+			waits = append(waits, wait)
+		}
+	}
+
+	for _, wait := range waits {
+		err := wait()
+		if err != nil {
+			return added, removed, err
+		}
+	}
+
+	return added, removed, nil
+}
+
+// list reads the deployed composite indexes and field overrides.
+func (a *indexApplier) list(ctx context.Context) (*IndexSet, error) {
+	deployed := NewIndexSet()
+	a.names = make(map[*Index]string)
+
+	it := a.client.ListIndexes(ctx, &adminpb.ListIndexesRequest{Parent: a.database + "/collectionGroups/-"})
+	for {
+		pb, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if pb.GetApiScope() != adminpb.Index_ANY_API {
+			continue
+		}
+
+		idx, err := indexFromProto(pb)
+		if err != nil {
+			if a.opts.Log != nil {
+				a.opts.Log.Warnf("apply: skipping index %s: %v", pb.GetName(), err)
+			}
+			continue
+		}
+		deployed.Indexes = append(deployed.Indexes, idx)
+		a.names[idx] = pb.GetName()
+	}
+
+	fit := a.client.ListFields(ctx, &adminpb.ListFieldsRequest{
+		Parent: a.database + "/collectionGroups/-",
+		Filter: "indexConfig.usesAncestorConfig:false OR ttlConfig:*",
+	})
+	for {
+		pb, err := fit.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		fo := fieldOverrideFromProto(pb)
+		if fo != nil {
+			deployed.AddFieldOverride(fo)
+		}
+	}
+
+	return deployed, nil
+}
+
+func (a *indexApplier) progress(p ApplyProgress) {
+	if a.opts.Progress != nil {
+		a.opts.Progress(p)
+	}
+}
+
+func (a *indexApplier) pollInterval() time.Duration {
+	if a.opts.PollInterval > 0 {
+		return a.opts.PollInterval
+	}
+	return DefaultApplyPollInterval
+}
+
+// createIndex starts building an index, returning a function that waits for it.
+func (a *indexApplier) createIndex(ctx context.Context, idx *Index) (func() error, error) {
+	a.progress(ApplyProgress{Action: ApplyCreateIndex, Index: idx})
+
+	op, err := a.client.CreateIndex(ctx, &adminpb.CreateIndexRequest{
+		Parent: a.database + "/collectionGroups/" + idx.CollectionGroup,
+		Index:  indexToProto(idx),
+	})
+	if err != nil {
+		err = fmt.Errorf("create index %s: %w", idx, err)
+		a.progress(ApplyProgress{Action: ApplyCreateIndex, Index: idx, Done: true, Err: err})
+		return nil, err
+	}
+
+	return func() error {
+		err := a.wait(ctx, ApplyProgress{Action: ApplyCreateIndex, Index: idx}, op.Done, func() (*adminpb.Progress, error) {
+			_, err := op.Poll(ctx)
+			meta, _ := op.Metadata()
+			return meta.GetProgressDocuments(), err
+		})
+		if err != nil {
+			return fmt.Errorf("create index %s: %w", idx, err)
+		}
+		return nil
+	}, nil
+}
+
+func (a *indexApplier) deleteIndex(ctx context.Context, idx *Index) error {
+	a.progress(ApplyProgress{Action: ApplyDeleteIndex, Index: idx})
+
+	err := a.client.DeleteIndex(ctx, &adminpb.DeleteIndexRequest{Name: a.names[idx]})
+	if err != nil {
+		err = fmt.Errorf("delete index %s: %w", idx, err)
+	}
+
+	a.progress(ApplyProgress{Action: ApplyDeleteIndex, Index: idx, Done: true, Err: err})
+
+	return err
+}
+
+// updateField sets a field override, or resets a field to the default
+// indexing without a TTL policy, returning a function that waits for the
+// change.
+func (a *indexApplier) updateField(ctx context.Context, fo *FieldOverride, action ApplyAction) (func() error, error) {
+	a.progress(ApplyProgress{Action: action, FieldOverride: fo})
+
+	field := &adminpb.Field{Name: a.database + "/collectionGroups/" + fo.CollectionGroup + "/fields/" + quoteFieldPath(fo.FieldPath, isSimpleSegment)}
+	if action == ApplyUpdateFieldOverride {
+		field = fieldOverrideToProto(field.Name, fo)
+	}
+
+	req := &adminpb.UpdateFieldRequest{
+		Field:      field,
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"index_config", "ttl_config"}},
+	}
+
+	op, err := a.client.UpdateField(ctx, req)
+	if err != nil {
+		err = fmt.Errorf("%s %s: %w", action, fo, err)
+		a.progress(ApplyProgress{Action: action, FieldOverride: fo, Done: true, Err: err})
+		return nil, err
+	}
+
+	return func() error {
+		err := a.wait(ctx, ApplyProgress{Action: action, FieldOverride: fo}, op.Done, func() (*adminpb.Progress, error) {
+			_, err := op.Poll(ctx)
+			meta, _ := op.Metadata()
+			return meta.GetProgressDocuments(), err
+		})
+		if err != nil {
+			return fmt.Errorf("%s %s: %w", action, fo, err)
+		}
+		return nil
+	}, nil
+}
+
+// wait polls a long-running operation until it is done, reporting progress
+// after every poll.
+func (a *indexApplier) wait(ctx context.Context, p ApplyProgress, done func() bool, poll func() (*adminpb.Progress, error)) error {
+	for !done() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(a.pollInterval()):
+		}
+
+		progress, err := poll()
+		p.CompletedDocuments = progress.GetCompletedWork()
+		p.EstimatedDocuments = progress.GetEstimatedWork()
+		if err != nil {
+			p.Done = true
+			p.Err = err
+			a.progress(p)
+			return err
+		}
+		if !done() {
+			a.progress(p)
+		}
+	}
+
+	p.Done = true
+	a.progress(p)
+
+	return nil
+}
+
+// String describes the index in the style of the Firebase console, e.g.
+// "users (team ASC, age DESC)".
+func (idx *Index) String() string {
+	fields := make([]string, len(idx.Fields))
+	for i, f := range idx.Fields {
+		fields[i] = f.FieldPath + " " + indexFieldMode(f)
+	}
+
+	scope := ""
+	if idx.QueryScope == ScopeCollectionGroup {
+		scope = " collection group"
+	}
+
+	return fmt.Sprintf("%s%s (%s)", idx.CollectionGroup, scope, strings.Join(fields, ", "))
+}
+
+// String describes the field override, e.g. "users.bio [ASC DESC]", or
+// "sessions.expireAt [] ttl" for an exempt field with a TTL policy.
+func (fo *FieldOverride) String() string {
+	s := fo.CollectionGroup + "." + fo.FieldPath
+
+	if fo.Indexes != nil {
+		modes := make([]string, len(fo.Indexes))
+		for i, f := range fo.Indexes {
+			modes[i] = indexFieldMode(f)
+			if f.QueryScope == ScopeCollectionGroup {
+				modes[i] += " group"
+			}
+		}
+		s += " [" + strings.Join(modes, " ") + "]"
+	}
+
+	if fo.TTLEnabled {
+		s += " ttl"
+	}
+
+	return s
+}
+
+func indexFieldMode(f IndexField) string {
+	switch {
+	case f.ArrayConfig == "CONTAINS":
+		return "CONTAINS"
+	case f.Order == "DESCENDING":
+		return "DESC"
+	}
+	return "ASC"
+}
+
+func indexToProto(idx *Index) *adminpb.Index {
+	pb := &adminpb.Index{QueryScope: queryScopeToProto(idx.QueryScope)}
+	for _, f := range idx.Fields {
+		pb.Fields = append(pb.Fields, indexFieldToProto(f.FieldPath, f))
+	}
+	return pb
+}
+
+func queryScopeToProto(scope QueryScope) adminpb.Index_QueryScope {
+	if scope == ScopeCollectionGroup {
+		return adminpb.Index_COLLECTION_GROUP
+	}
+	return adminpb.Index_COLLECTION
+}
+
+func indexFieldToProto(path string, f IndexField) *adminpb.Index_IndexField {
+	pf := &adminpb.Index_IndexField{FieldPath: path}
+	switch {
+	case f.ArrayConfig == "CONTAINS":
+		pf.ValueMode = &adminpb.Index_IndexField_ArrayConfig_{ArrayConfig: adminpb.Index_IndexField_CONTAINS}
+	case f.Order == "DESCENDING":
+		pf.ValueMode = &adminpb.Index_IndexField_Order_{Order: adminpb.Index_IndexField_DESCENDING}
+	default:
+		pf.ValueMode = &adminpb.Index_IndexField_Order_{Order: adminpb.Index_IndexField_ASCENDING}
+	}
+	return pf
+}
+
+// fieldOverrideToProto converts a field override. A nil IndexConfig resets
+// the field to the default indexing.
+func fieldOverrideToProto(name string, fo *FieldOverride) *adminpb.Field {
+	field := &adminpb.Field{Name: name}
+
+	if fo.Indexes != nil {
+		field.IndexConfig = &adminpb.Field_IndexConfig{Indexes: make([]*adminpb.Index, 0, len(fo.Indexes))}
+		for _, f := range fo.Indexes {
+			field.IndexConfig.Indexes = append(field.IndexConfig.Indexes, &adminpb.Index{
+				QueryScope: queryScopeToProto(f.QueryScope),
+				Fields:     []*adminpb.Index_IndexField{indexFieldToProto(fo.FieldPath, f)},
+			})
+		}
+	}
+
+	if fo.TTLEnabled {
+		field.TtlConfig = &adminpb.Field_TtlConfig{}
+	}
+
+	return field
+}
+
+// fieldOverrideFromProto converts a deployed field, returning nil if it has
+// neither indexes nor a TTL policy of its own, or is the database's default
+// field settings.
+func fieldOverrideFromProto(pb *adminpb.Field) *FieldOverride {
+	_, rest, ok := strings.Cut(pb.GetName(), "/collectionGroups/")
+	if !ok {
+		return nil
+	}
+	group, path, ok := strings.Cut(rest, "/fields/")
+	if !ok || group == "__default__" {
+		return nil
+	}
+
+	// Resource names quote every segment that is not a simple identifier;
+	// field overrides only quote those that could not be read back.
+	path = quoteFieldPath(path, func(seg string) bool {
+		return seg != "" && !strings.ContainsAny(seg, ".`\\")
+	})
+
+	fo := &FieldOverride{CollectionGroup: group, FieldPath: path, TTLEnabled: pb.GetTtlConfig() != nil}
+	if pb.GetIndexConfig() == nil || pb.GetIndexConfig().GetUsesAncestorConfig() {
+		if !fo.TTLEnabled {
+			return nil
+		}
+		return fo
+	}
+
+	fo.Indexes = []IndexField{}
+	for _, idx := range pb.GetIndexConfig().GetIndexes() {
+		for _, f := range idx.GetFields() {
+			field := IndexField{QueryScope: ScopeCollection}
+			if idx.GetQueryScope() == adminpb.Index_COLLECTION_GROUP {
+				field.QueryScope = ScopeCollectionGroup
+			}
+			switch {
+			case f.GetArrayConfig() == adminpb.Index_IndexField_CONTAINS:
+				field.ArrayConfig = "CONTAINS"
+			case f.GetOrder() == adminpb.Index_IndexField_DESCENDING:
+				field.Order = "DESCENDING"
+			default:
+				field.Order = "ASCENDING"
+			}
+			fo.Indexes = append(fo.Indexes, field)
+		}
+	}
+
+	return fo
+}
+
+// quoteFieldPath rewrites a dotted field path, whose segments may be quoted
+// with backticks, quoting the segments for which plain returns false. For
+// example, with isSimpleSegment "a.b-c" becomes "a.`b-c`", the form the
+// Admin API expects in field resource names.
+func quoteFieldPath(path string, plain func(seg string) bool) string {
+	segs := splitFieldPath(path)
+	for i, seg := range segs {
+		if !plain(seg) {
+			seg = strings.ReplaceAll(seg, `\`, `\\`)
+			seg = strings.ReplaceAll(seg, "`", "\\`")
+			segs[i] = "`" + seg + "`"
+		}
+	}
+	return strings.Join(segs, ".")
+}
+
+// splitFieldPath splits a dotted field path into its unquoted segments.
+func splitFieldPath(path string) []string {
+	segs := make([]string, 0)
+	var seg strings.Builder
+	quoted := false
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(path):
+			i++
+			seg.WriteByte(path[i])
+		case c == '`':
+			quoted = !quoted
+		case c == '.' && !quoted:
+			segs = append(segs, seg.String())
+			seg.Reset()
+		default:
+			seg.WriteByte(c)
+		}
+	}
+	return append(segs, seg.String())
+}
+
+// isSimpleSegment reports whether a field path segment can be used without
+// quoting: a letter or underscore followed by letters, digits and
+// underscores.
+func isSimpleSegment(seg string) bool {
+	if seg == "" {
+		return false
+	}
+	for i, c := range seg {
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
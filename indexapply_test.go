@@ -0,0 +1,210 @@
+package fsdb
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tadhunt/fsdb/fsdbtest"
+)
+
+func newFakeAdminServer(t *testing.T) (*fsdbtest.FakeAdminServer, *Credentials) {
+	srv, err := fsdbtest.NewFakeAdminServer()
+	if err != nil {
+		t.Fatalf("fake admin server: %v", err)
+	}
+	t.Cleanup(srv.Close)
+
+	addr := srv.Addr()
+	return srv, &Credentials{EmulatorHost: &addr}
+}
+
+// fakeIndexSet returns the indexes and field overrides srv holds.
+func fakeIndexSet(srv *fsdbtest.FakeAdminServer) *IndexSet {
+	set := NewIndexSet()
+	for _, pb := range srv.Indexes() {
+		idx, err := indexFromProto(pb)
+		if err == nil {
+			set.Add(idx)
+		}
+	}
+	for _, pb := range srv.Fields() {
+		fo := fieldOverrideFromProto(pb)
+		if fo != nil {
+			set.AddFieldOverride(fo)
+		}
+	}
+	return set
+}
+
+func TestIndexSetApply(t *testing.T) {
+	ctx := context.Background()
+
+	srv, creds := newFakeAdminServer(t)
+
+	keep := NewIndex("users").Asc("team").Desc("age")
+	extra := NewIndex("posts").Scope(ScopeCollectionGroup).ArrayContains("tags").Desc("at")
+	bio := &FieldOverride{CollectionGroup: "users", FieldPath: "bio", Indexes: []IndexField{}}
+
+	initial := NewIndexSet()
+	initial.Add(keep, extra)
+	initial.AddFieldOverride(bio)
+	added, removed, err := initial.Apply(ctx, "test", "", creds, nil)
+	if err != nil {
+		t.Fatalf("initial apply: %v", err)
+	}
+	if len(added.Indexes) != 2 || len(added.FieldOverrides) != 1 || !removed.Empty() {
+		t.Fatalf("initial apply: added %v, removed %v", added, removed)
+	}
+
+	wanted := NewIndexSet()
+	wanted.Add(keep, NewIndex("users").Asc("age").Asc("name"))
+	wanted.AddFieldOverride(
+		&FieldOverride{CollectionGroup: "users", FieldPath: "bio", Indexes: []IndexField{{Order: "ASCENDING"}}},
+		&FieldOverride{CollectionGroup: "posts", FieldPath: "body", Indexes: []IndexField{}},
+	)
+
+	added, removed, err = wanted.Apply(ctx, "test", "", creds, &ApplyOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if len(added.Indexes) != 1 || len(added.FieldOverrides) != 2 || len(removed.Indexes) != 1 || len(removed.FieldOverrides) != 1 {
+		t.Fatalf("dry run: added %v, removed %v", added, removed)
+	}
+	if len(fakeIndexSet(srv).Indexes) != 2 {
+		t.Fatalf("dry run changed the database")
+	}
+
+	srv.SetPendingPolls(2)
+	events := make([]ApplyProgress, 0)
+	_, _, err = wanted.Apply(ctx, "test", "", creds, &ApplyOptions{
+		PollInterval: time.Millisecond,
+		Progress:     func(p ApplyProgress) { events = append(events, p) },
+	})
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+
+	got := fakeIndexSet(srv)
+	if !indexMatchesAny(extra, got.Indexes) || len(got.Indexes) != 3 {
+		t.Fatalf("apply without Delete: got %v", got.Indexes)
+	}
+
+	started, done, polled := 0, 0, 0
+	for _, p := range events {
+		switch {
+		case p.Err != nil:
+			t.Fatalf("progress: %s %v: %v", p.Action, p.Index, p.Err)
+		case p.Done:
+			done++
+		case p.EstimatedDocuments > 0:
+			polled++
+		default:
+			started++
+		}
+	}
+	if started != 3 || done != 3 || polled != 3 {
+		t.Fatalf("progress: %d started, %d polled, %d done: %v", started, polled, done, events)
+	}
+
+	_, _, err = wanted.Apply(ctx, "test", "", creds, &ApplyOptions{Delete: true, PollInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("apply with Delete: %v", err)
+	}
+
+	added, removed = fakeIndexSet(srv).Diff(wanted)
+	if !added.Empty() || !removed.Empty() {
+		t.Fatalf("after apply: missing %v, extra %v", added, removed)
+	}
+
+	added, removed, err = wanted.Apply(ctx, "test", "other", creds, &ApplyOptions{DryRun: true})
+	if err != nil || len(added.Indexes) != 2 || !removed.Empty() {
+		t.Fatalf("other database: added %v, removed %v, %v", added, removed, err)
+	}
+}
+
+func TestIndexSetApplyDuplicates(t *testing.T) {
+	ctx := context.Background()
+
+	srv, creds := newFakeAdminServer(t)
+
+	// The document ID field is implied, so both are read back as the same
+	// index.
+	initial := NewIndexSet()
+	initial.Add(NewIndex("users").Asc("team").Asc("age"), NewIndex("users").Asc("team").Asc("age").Asc("__name__"))
+	_, _, err := initial.Apply(ctx, "test", "", creds, &ApplyOptions{PollInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("initial apply: %v", err)
+	}
+	if len(srv.Indexes()) != 2 {
+		t.Fatalf("initial apply: got %d indexes, want 2", len(srv.Indexes()))
+	}
+
+	_, removed, err := NewIndexSet().Apply(ctx, "test", "", creds, &ApplyOptions{Delete: true, PollInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("apply with Delete: %v", err)
+	}
+	if len(removed.Indexes) != 1 || len(srv.Indexes()) != 0 {
+		t.Fatalf("apply with Delete: removed %v, left %v", removed.Indexes, srv.Indexes())
+	}
+}
+
+func TestIndexSetApplyTTL(t *testing.T) {
+	ctx := context.Background()
+
+	srv, creds := newFakeAdminServer(t)
+
+	opts := &ApplyOptions{Delete: true, PollInterval: time.Millisecond}
+	steps := [][]*FieldOverride{
+		{NewFieldOverride("sessions", "expireAt").TTL(true), NewFieldOverride("posts", "body").Exempt(), NewFieldOverride("posts", "meta.`a.b`.x-y").Exempt()},
+		{NewFieldOverride("sessions", "expireAt").Exempt().TTL(true)},
+		{NewFieldOverride("sessions", "expireAt").Desc()},
+		{},
+	}
+	for i, overrides := range steps {
+		wanted := NewIndexSet()
+		wanted.AddFieldOverride(overrides...)
+
+		_, _, err := wanted.Apply(ctx, "test", "", creds, opts)
+		if err != nil {
+			t.Fatalf("step %d: apply: %v", i, err)
+		}
+
+		added, removed := fakeIndexSet(srv).Diff(wanted)
+		if !added.Empty() || !removed.Empty() {
+			t.Fatalf("step %d: missing %v, extra %v", i, added.FieldOverrides, removed.FieldOverrides)
+		}
+
+		if i == 0 {
+			quoted := false
+			for _, f := range srv.Fields() {
+				quoted = quoted || strings.HasSuffix(f.GetName(), "/fields/meta.`a.b`.`x-y`")
+			}
+			if !quoted {
+				t.Fatalf("step %d: field path not quoted in %v", i, srv.Fields())
+			}
+		}
+	}
+}
+
+func TestQuoteFieldPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"age", "age"},
+		{"address.city", "address.city"},
+		{"meta.x-y", "meta.`x-y`"},
+		{"_a1.1a", "_a1.`1a`"},
+		{"`a.b`.c", "`a.b`.c"},
+		{"`a\\`b`", "`a\\`b`"},
+		{"`back\\\\slash`", "`back\\\\slash`"},
+	}
+
+	for _, tc := range tests {
+		if got := quoteFieldPath(tc.path, isSimpleSegment); got != tc.want {
+			t.Fatalf("quote %s: got %s, want %s", tc.path, got, tc.want)
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"io"
 	"os"
+	"sort"
+	"strings"
 )
 
 // QueryScope defines the scope of a Firestore index.
@@ -16,11 +18,14 @@ const (
 	ScopeCollectionGroup QueryScope = "COLLECTION_GROUP"
 )
 
-// IndexField defines a single field within a composite index.
+// IndexField defines a single field within a composite index, or one of the
+// indexes of a field override. QueryScope is only used by field overrides,
+// where it defaults to COLLECTION.
 type IndexField struct {
-	FieldPath   string `json:"fieldPath"`
-	Order       string `json:"order,omitempty"`
-	ArrayConfig string `json:"arrayConfig,omitempty"`
+	FieldPath   string     `json:"fieldPath"`
+	Order       string     `json:"order,omitempty"`
+	ArrayConfig string     `json:"arrayConfig,omitempty"`
+	QueryScope  QueryScope `json:"queryScope,omitempty"`
 }
 
 // Index defines a Firestore composite index.
@@ -30,10 +35,13 @@ type Index struct {
 	Fields          []IndexField `json:"fields"`
 }
 
-// FieldOverride defines a single-field index override.
+// FieldOverride defines a single-field index override. An empty Indexes
+// exempts the field from indexing, while a nil Indexes leaves the default
+// indexing alone, for overrides that only set a TTL policy.
 type FieldOverride struct {
 	CollectionGroup string       `json:"collectionGroup"`
 	FieldPath       string       `json:"fieldPath"`
+	TTLEnabled      bool         `json:"ttl,omitempty"`
 	Indexes         []IndexField `json:"indexes"`
 }
 
@@ -86,6 +94,81 @@ func (idx *Index) ArrayContains(fieldPath string) *Index {
 	return idx
 }
 
+// NewFieldOverride creates a new field override builder for the given field.
+// Until an index is added, or Exempt is called, the field keeps the default
+// indexing.
+//
+// Example:
+//
+//	fsdb.NewFieldOverride("sessions", "expireAt").Exempt().TTL(true)
+func NewFieldOverride(collectionGroup string, fieldPath string) *FieldOverride {
+	return &FieldOverride{
+		CollectionGroup: collectionGroup,
+		FieldPath:       fieldPath,
+	}
+}
+
+// Asc adds an ascending index on the field, in each of the given scopes,
+// or COLLECTION if none are given.
+func (fo *FieldOverride) Asc(scopes ...QueryScope) *FieldOverride {
+	return fo.addIndexes(IndexField{Order: "ASCENDING"}, scopes)
+}
+
+// Desc adds a descending index on the field, in each of the given scopes,
+// or COLLECTION if none are given.
+func (fo *FieldOverride) Desc(scopes ...QueryScope) *FieldOverride {
+	return fo.addIndexes(IndexField{Order: "DESCENDING"}, scopes)
+}
+
+// ArrayContains adds an array-contains index on the field, in each of the
+// given scopes, or COLLECTION if none are given.
+func (fo *FieldOverride) ArrayContains(scopes ...QueryScope) *FieldOverride {
+	return fo.addIndexes(IndexField{ArrayConfig: "CONTAINS"}, scopes)
+}
+
+// Exempt removes all indexes from the field, exempting it from indexing.
+func (fo *FieldOverride) Exempt() *FieldOverride {
+	fo.Indexes = []IndexField{}
+	return fo
+}
+
+// TTL enables or disables a TTL policy on the field, which must hold a
+// timestamp. Documents are deleted some time after it has passed.
+func (fo *FieldOverride) TTL(enabled bool) *FieldOverride {
+	fo.TTLEnabled = enabled
+	return fo
+}
+
+func (fo *FieldOverride) addIndexes(f IndexField, scopes []QueryScope) *FieldOverride {
+	if len(scopes) == 0 {
+		scopes = []QueryScope{ScopeCollection}
+	}
+	for _, scope := range scopes {
+		f.QueryScope = scope
+		fo.Indexes = append(fo.Indexes, f)
+	}
+	return fo
+}
+
+// MarshalJSON omits Indexes when it is nil, so that an override that only
+// sets a TTL policy does not exempt the field.
+func (fo *FieldOverride) MarshalJSON() ([]byte, error) {
+	out := struct {
+		CollectionGroup string        `json:"collectionGroup"`
+		FieldPath       string        `json:"fieldPath"`
+		TTLEnabled      bool          `json:"ttl,omitempty"`
+		Indexes         *[]IndexField `json:"indexes,omitempty"`
+	}{
+		CollectionGroup: fo.CollectionGroup,
+		FieldPath:       fo.FieldPath,
+		TTLEnabled:      fo.TTLEnabled,
+	}
+	if fo.Indexes != nil {
+		out.Indexes = &fo.Indexes
+	}
+	return json.Marshal(out)
+}
+
 // NewIndexSet creates an empty IndexSet.
 func NewIndexSet() *IndexSet {
 	return &IndexSet{
@@ -94,7 +177,8 @@ func NewIndexSet() *IndexSet {
 	}
 }
 
-// Add appends one or more index definitions to the set.
+// Add appends one or more index definitions to the set. Use Merge or
+// Dedupe to avoid duplicates.
 func (s *IndexSet) Add(indexes ...*Index) {
 	s.Indexes = append(s.Indexes, indexes...)
 }
@@ -115,14 +199,127 @@ func (s *IndexSet) AddFieldOverride(overrides ...*FieldOverride) {
 	s.FieldOverrides = append(s.FieldOverrides, overrides...)
 }
 
-// WriteJSON writes the index set as JSON to the given writer.
+// RemoveFieldOverride removes field overrides that are equal to any of the provided overrides.
+func (s *IndexSet) RemoveFieldOverride(overrides ...*FieldOverride) {
+	filtered := make([]*FieldOverride, 0, len(s.FieldOverrides))
+	for _, existing := range s.FieldOverrides {
+		if !fieldOverrideMatchesAny(existing, overrides) {
+			filtered = append(filtered, existing)
+		}
+	}
+	s.FieldOverrides = filtered
+}
+
+// Merge adds the indexes and field overrides of other that are not already in the set.
+func (s *IndexSet) Merge(other *IndexSet) {
+	for _, idx := range other.Indexes {
+		if !indexMatchesAny(idx, s.Indexes) {
+			s.Indexes = append(s.Indexes, idx)
+		}
+	}
+	for _, fo := range other.FieldOverrides {
+		if !fieldOverrideMatchesAny(fo, s.FieldOverrides) {
+			s.FieldOverrides = append(s.FieldOverrides, fo)
+		}
+	}
+}
+
+// Dedupe removes duplicate indexes and field overrides, keeping the first of each.
+func (s *IndexSet) Dedupe() {
+	all := &IndexSet{Indexes: s.Indexes, FieldOverrides: s.FieldOverrides}
+	s.Indexes, s.FieldOverrides = []*Index{}, []*FieldOverride{}
+	s.Merge(all)
+}
+
+// Diff compares the set with other. It returns the indexes and field
+// overrides that are in other but not in the set, and those that are in the
+// set but not in other, i.e. what must be added to and removed from the set
+// to make it match other. A field override whose indexes changed appears in
+// both.
+//
+// Example:
+//
+//	deployed, _ := fsdb.ReadFile("firestore.indexes.json")
+//	added, removed := deployed.Diff(wanted)
+func (s *IndexSet) Diff(other *IndexSet) (added, removed *IndexSet) {
+	added, removed = NewIndexSet(), NewIndexSet()
+
+	for _, idx := range other.Indexes {
+		if !indexMatchesAny(idx, s.Indexes) && !indexMatchesAny(idx, added.Indexes) {
+			added.Add(idx)
+		}
+	}
+	for _, idx := range s.Indexes {
+		if !indexMatchesAny(idx, other.Indexes) && !indexMatchesAny(idx, removed.Indexes) {
+			removed.Add(idx)
+		}
+	}
+
+	for _, fo := range other.FieldOverrides {
+		if !fieldOverrideMatchesAny(fo, s.FieldOverrides) && !fieldOverrideMatchesAny(fo, added.FieldOverrides) {
+			added.AddFieldOverride(fo)
+		}
+	}
+	for _, fo := range s.FieldOverrides {
+		if !fieldOverrideMatchesAny(fo, other.FieldOverrides) && !fieldOverrideMatchesAny(fo, removed.FieldOverrides) {
+			removed.AddFieldOverride(fo)
+		}
+	}
+
+	return added, removed
+}
+
+// Empty reports whether the set has no indexes and no field overrides.
+func (s *IndexSet) Empty() bool {
+	return len(s.Indexes) == 0 && len(s.FieldOverrides) == 0
+}
+
+// Sort puts the indexes and field overrides into a canonical order: by
+// collection group, then scope and fields for indexes, and field path for
+// overrides. The indexes of each override are sorted too. The order of an
+// index's own fields is significant, and is left alone.
+func (s *IndexSet) Sort() {
+	sort.SliceStable(s.Indexes, func(i, j int) bool {
+		return compareIndexes(s.Indexes[i], s.Indexes[j]) < 0
+	})
+
+	for _, fo := range s.FieldOverrides {
+		sort.SliceStable(fo.Indexes, func(i, j int) bool {
+			return compareIndexFields(fo.Indexes[i], fo.Indexes[j]) < 0
+		})
+	}
+	sort.SliceStable(s.FieldOverrides, func(i, j int) bool {
+		return compareFieldOverrides(s.FieldOverrides[i], s.FieldOverrides[j]) < 0
+	})
+}
+
+// WriteJSON writes the index set as JSON to the given writer, in the
+// canonical order described by Sort. The set itself is not reordered.
 func (s *IndexSet) WriteJSON(w io.Writer) error {
+	sorted := s.clone()
+	sorted.Sort()
+
 	enc := json.NewEncoder(w)
 	enc.SetIndent("", "  ")
-	return enc.Encode(s)
+	return enc.Encode(sorted)
 }
 
-// ReadJSON decodes an IndexSet from the given reader.
+// clone returns a copy of the set that can be reordered without affecting it.
+func (s *IndexSet) clone() *IndexSet {
+	c := NewIndexSet()
+	c.Indexes = append(c.Indexes, s.Indexes...)
+	for _, fo := range s.FieldOverrides {
+		cfo := *fo
+		if fo.Indexes != nil {
+			cfo.Indexes = append([]IndexField{}, fo.Indexes...)
+		}
+		c.FieldOverrides = append(c.FieldOverrides, &cfo)
+	}
+	return c
+}
+
+// ReadJSON decodes an IndexSet from the given reader. The set is not
+// validated; see ReadJSONStrict.
 func ReadJSON(r io.Reader) (*IndexSet, error) {
 	s := NewIndexSet()
 	if err := json.NewDecoder(r).Decode(s); err != nil {
@@ -131,6 +328,19 @@ func ReadJSON(r io.Reader) (*IndexSet, error) {
 	return s, nil
 }
 
+// ReadJSONStrict is like ReadJSON, but returns an IndexErrors if the set is
+// not valid.
+func ReadJSONStrict(r io.Reader) (*IndexSet, error) {
+	s, err := ReadJSON(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
 // ReadFile loads an IndexSet from the named file.
 func ReadFile(path string) (*IndexSet, error) {
 	f, err := os.Open(path)
@@ -142,7 +352,20 @@ func ReadFile(path string) (*IndexSet, error) {
 	return ReadJSON(f)
 }
 
-// WriteFile writes the index set as JSON to the named file.
+// ReadFileStrict loads an IndexSet from the named file, returning an
+// IndexErrors if the set is not valid.
+func ReadFileStrict(path string) (*IndexSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadJSONStrict(f)
+}
+
+// WriteFile writes the index set as JSON to the named file. The set is
+// written as is; call Validate first to check it.
 func (s *IndexSet) WriteFile(path string) error {
 	f, err := os.Create(path)
 	if err != nil {
@@ -176,3 +399,83 @@ func indexEqual(a, b *Index) bool {
 	}
 	return true
 }
+
+func fieldOverrideMatchesAny(fo *FieldOverride, targets []*FieldOverride) bool {
+	for _, t := range targets {
+		if fieldOverrideEqual(fo, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldOverrideEqual compares two field overrides. The order of their
+// indexes is not significant.
+func fieldOverrideEqual(a, b *FieldOverride) bool {
+	if a.CollectionGroup != b.CollectionGroup || a.FieldPath != b.FieldPath || a.TTLEnabled != b.TTLEnabled {
+		return false
+	}
+	if (a.Indexes == nil) != (b.Indexes == nil) || len(a.Indexes) != len(b.Indexes) {
+		return false
+	}
+
+	used := make([]bool, len(b.Indexes))
+	for _, f := range a.Indexes {
+		found := false
+		for j, g := range b.Indexes {
+			if !used[j] && overrideIndex(f) == overrideIndex(g) {
+				used[j] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// overrideIndex fills in the defaults of one of a field override's indexes.
+func overrideIndex(f IndexField) IndexField {
+	f.FieldPath = ""
+	if f.QueryScope == "" {
+		f.QueryScope = ScopeCollection
+	}
+	return f
+}
+
+func compareIndexes(a, b *Index) int {
+	if c := strings.Compare(a.CollectionGroup, b.CollectionGroup); c != 0 {
+		return c
+	}
+	if c := strings.Compare(string(a.QueryScope), string(b.QueryScope)); c != 0 {
+		return c
+	}
+	for i := 0; i < len(a.Fields) && i < len(b.Fields); i++ {
+		if c := compareIndexFields(a.Fields[i], b.Fields[i]); c != 0 {
+			return c
+		}
+	}
+	return cmpInt(len(a.Fields), len(b.Fields))
+}
+
+func compareIndexFields(a, b IndexField) int {
+	if c := strings.Compare(a.FieldPath, b.FieldPath); c != 0 {
+		return c
+	}
+	if c := strings.Compare(a.Order, b.Order); c != 0 {
+		return c
+	}
+	if c := strings.Compare(a.ArrayConfig, b.ArrayConfig); c != 0 {
+		return c
+	}
+	return strings.Compare(string(a.QueryScope), string(b.QueryScope))
+}
+
+func compareFieldOverrides(a, b *FieldOverride) int {
+	if c := strings.Compare(a.CollectionGroup, b.CollectionGroup); c != 0 {
+		return c
+	}
+	return strings.Compare(a.FieldPath, b.FieldPath)
+}
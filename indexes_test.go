@@ -0,0 +1,181 @@
+package fsdb
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestIndexSetDiff(t *testing.T) {
+	a := NewIndex("users").Asc("team").Desc("age")
+	b := NewIndex("users").Asc("team").Asc("age")
+	c := NewIndex("posts").Scope(ScopeCollectionGroup).ArrayContains("tags").Desc("at")
+	body := &FieldOverride{CollectionGroup: "posts", FieldPath: "body", Indexes: []IndexField{}}
+	bio := &FieldOverride{CollectionGroup: "users", FieldPath: "bio", Indexes: []IndexField{
+		{FieldPath: "", Order: "ASCENDING"}, {FieldPath: "", ArrayConfig: "CONTAINS"},
+	}}
+	bioReordered := &FieldOverride{CollectionGroup: "users", FieldPath: "bio", Indexes: []IndexField{
+		{FieldPath: "", ArrayConfig: "CONTAINS"}, {FieldPath: "", Order: "ASCENDING"},
+	}}
+	bioAsc := &FieldOverride{CollectionGroup: "users", FieldPath: "bio", Indexes: []IndexField{
+		{FieldPath: "", Order: "ASCENDING"},
+	}}
+
+	deployed := NewIndexSet()
+	deployed.Add(a, b, NewIndex("users").Asc("team").Desc("age"))
+	deployed.AddFieldOverride(body, bio, bioReordered)
+	if len(deployed.Indexes) != 3 || len(deployed.FieldOverrides) != 3 {
+		t.Fatalf("add: duplicates dropped: %d indexes, %d overrides", len(deployed.Indexes), len(deployed.FieldOverrides))
+	}
+
+	added, removed := deployed.Diff(NewIndexSet())
+	if !added.Empty() || len(removed.Indexes) != 2 || len(removed.FieldOverrides) != 2 {
+		t.Fatalf("diff with duplicates: %#v %#v", added, removed)
+	}
+
+	deployed.Dedupe()
+	if len(deployed.Indexes) != 2 || len(deployed.FieldOverrides) != 2 {
+		t.Fatalf("dedupe: duplicates kept: %d indexes, %d overrides", len(deployed.Indexes), len(deployed.FieldOverrides))
+	}
+
+	wanted := NewIndexSet()
+	wanted.Add(b, c)
+	wanted.AddFieldOverride(body, bioAsc)
+
+	added, removed = deployed.Diff(wanted)
+	if len(added.Indexes) != 1 || !indexEqual(added.Indexes[0], c) {
+		t.Fatalf("added indexes: %#v", added.Indexes)
+	}
+	if len(removed.Indexes) != 1 || !indexEqual(removed.Indexes[0], a) {
+		t.Fatalf("removed indexes: %#v", removed.Indexes)
+	}
+	if len(added.FieldOverrides) != 1 || added.FieldOverrides[0] != bioAsc {
+		t.Fatalf("added overrides: %#v", added.FieldOverrides)
+	}
+	if len(removed.FieldOverrides) != 1 || removed.FieldOverrides[0] != bio {
+		t.Fatalf("removed overrides: %#v", removed.FieldOverrides)
+	}
+
+	added, removed = deployed.Diff(deployed)
+	if !added.Empty() || !removed.Empty() {
+		t.Fatalf("diff with self: %#v %#v", added, removed)
+	}
+
+	merged := NewIndexSet()
+	merged.Merge(deployed)
+	merged.Merge(wanted)
+	if len(merged.Indexes) != 3 || len(merged.FieldOverrides) != 3 {
+		t.Fatalf("merge: %d indexes, %d overrides", len(merged.Indexes), len(merged.FieldOverrides))
+	}
+
+	dup := &IndexSet{Indexes: []*Index{a, b, a}, FieldOverrides: []*FieldOverride{bio, bioReordered}}
+	dup.Dedupe()
+	if len(dup.Indexes) != 2 || dup.Indexes[0] != a || len(dup.FieldOverrides) != 1 {
+		t.Fatalf("dedupe: %#v", dup)
+	}
+}
+
+func TestIndexSetWriteJSONSorted(t *testing.T) {
+	s1 := NewIndexSet()
+	s1.Add(
+		NewIndex("users").Desc("age").Asc("name"),
+		NewIndex("posts").Asc("at").Asc("title"),
+		NewIndex("users").Scope(ScopeCollectionGroup).Asc("age").Asc("name"),
+		NewIndex("users").Asc("age").Asc("name"),
+	)
+	s1.AddFieldOverride(
+		&FieldOverride{CollectionGroup: "users", FieldPath: "b", Indexes: []IndexField{}},
+		&FieldOverride{CollectionGroup: "users", FieldPath: "a", Indexes: []IndexField{{Order: "DESCENDING"}, {Order: "ASCENDING"}}},
+	)
+
+	s2 := NewIndexSet()
+	for i := len(s1.Indexes) - 1; i >= 0; i-- {
+		s2.Add(s1.Indexes[i])
+	}
+	s2.AddFieldOverride(
+		&FieldOverride{CollectionGroup: "users", FieldPath: "a", Indexes: []IndexField{{Order: "ASCENDING"}, {Order: "DESCENDING"}}},
+		&FieldOverride{CollectionGroup: "users", FieldPath: "b", Indexes: []IndexField{}},
+	)
+
+	var b1, b2 bytes.Buffer
+	if err := s1.WriteJSON(&b1); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := s2.WriteJSON(&b2); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if b1.String() != b2.String() {
+		t.Fatalf("output depends on order:\n%s\n%s", b1.String(), b2.String())
+	}
+	if s1.Indexes[0].CollectionGroup != "users" {
+		t.Fatalf("WriteJSON reordered the set")
+	}
+
+	out := b1.String()
+	if !(strings.Index(out, `"posts"`) < strings.Index(out, `"users"`)) {
+		t.Fatalf("indexes not sorted by collection group:\n%s", out)
+	}
+
+	s3, err := ReadJSON(&b1)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	added, removed := s1.Diff(s3)
+	if !added.Empty() || !removed.Empty() {
+		t.Fatalf("round trip changed the set: %#v %#v", added, removed)
+	}
+}
+
+func TestFieldOverrideBuilder(t *testing.T) {
+	tags := NewFieldOverride("posts", "tags").Asc().ArrayContains(ScopeCollection, ScopeCollectionGroup)
+	want := &FieldOverride{CollectionGroup: "posts", FieldPath: "tags", Indexes: []IndexField{
+		{Order: "ASCENDING", QueryScope: ScopeCollection},
+		{ArrayConfig: "CONTAINS", QueryScope: ScopeCollection},
+		{ArrayConfig: "CONTAINS", QueryScope: ScopeCollectionGroup},
+	}}
+	if !fieldOverrideEqual(tags, want) {
+		t.Fatalf("builder: got %v, want %v", tags, want)
+	}
+
+	body := NewFieldOverride("posts", "body").Desc().Exempt()
+	expire := NewFieldOverride("sessions", "expireAt").TTL(true)
+	expireExempt := NewFieldOverride("sessions", "expireAt").Exempt().TTL(true)
+	if body.Indexes == nil || len(body.Indexes) != 0 || expire.Indexes != nil {
+		t.Fatalf("exempt: %#v %#v", body, expire)
+	}
+	if fieldOverrideEqual(expire, expireExempt) || fieldOverrideEqual(expireExempt, NewFieldOverride("sessions", "expireAt").Exempt()) {
+		t.Fatalf("TTL and exemption not compared")
+	}
+
+	s := NewIndexSet()
+	s.AddFieldOverride(tags, body, expire)
+
+	var buf bytes.Buffer
+	if err := s.WriteJSON(&buf); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, `"fieldPath": "expireAt",
+      "ttl": true
+    }`) || !strings.Contains(out, `"fieldPath": "body",
+      "indexes": []`) {
+		t.Fatalf("unexpected JSON:\n%s", out)
+	}
+
+	read, err := ReadJSON(&buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	added, removed := s.Diff(read)
+	if !added.Empty() || !removed.Empty() {
+		t.Fatalf("round trip changed the set: %v %v", added.FieldOverrides, removed.FieldOverrides)
+	}
+
+	changed := NewIndexSet()
+	changed.AddFieldOverride(tags, body, expireExempt)
+	added, removed = s.Diff(changed)
+	if len(added.FieldOverrides) != 1 || added.FieldOverrides[0] != expireExempt ||
+		len(removed.FieldOverrides) != 1 || removed.FieldOverrides[0] != expire {
+		t.Fatalf("diff: added %v, removed %v", added.FieldOverrides, removed.FieldOverrides)
+	}
+}
@@ -0,0 +1,217 @@
+package fsdb
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/firestore"
+)
+
+// RequiredIndex returns the composite index the query needs, or nil if
+// Firestore's automatic single-field indexes are enough. That is the case
+// when the query only has equality and array-contains filters, or when it
+// orders by (or has inequality filters on) a single field and has no other
+// filters.
+//
+// The index has the query's equality and "in" fields in ascending order,
+// then its array-contains or array-contains-any field, then its ordered and
+// inequality fields in the order Firestore sorts the results. Firestore runs
+// a query with Or filters as one query per branch; RequiredIndex returns the
+// first index one of the branches needs, and an IndexRecorder records them all.
+//
+// Example:
+//
+//	idx := db.Query("users").
+//		Where("team", "==", "a").
+//		OrderBy("age", fsdb.Desc).
+//		RequiredIndex()
+//	// idx is NewIndex("users").Asc("team").Desc("age")
+func (q *Query) RequiredIndex() *Index {
+	indexes := requiredIndexes(&q.spec)
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	return indexes[0]
+}
+
+// requiredIndexes returns the distinct composite indexes needed by the
+// branches of a query.
+func requiredIndexes(spec *QuerySpec) []*Index {
+	indexes := make([]*Index, 0)
+	for _, branch := range disjunctions(spec.Filters) {
+		b := *spec
+		b.Filters = make([]Filter, len(branch))
+		for i, f := range branch {
+			b.Filters[i] = f
+		}
+
+		idx := branchIndex(&b)
+		if idx != nil && !indexMatchesAny(idx, indexes) {
+			indexes = append(indexes, idx)
+		}
+	}
+
+	return indexes
+}
+
+// disjunctions rewrites ANDed filters in disjunctive normal form, returning
+// the property filters of each branch.
+func disjunctions(filters []Filter) [][]PropertyFilter {
+	branches := [][]PropertyFilter{{}}
+	for _, f := range filters {
+		var alternatives [][]PropertyFilter
+		switch x := f.(type) {
+		case PropertyFilter:
+			alternatives = [][]PropertyFilter{{x}}
+		case CompositeFilter:
+			if x.Op == "or" {
+				for _, sub := range x.Filters {
+					alternatives = append(alternatives, disjunctions([]Filter{sub})...)
+				}
+			} else {
+				alternatives = disjunctions(x.Filters)
+			}
+		}
+
+		product := make([][]PropertyFilter, 0, len(branches)*len(alternatives))
+		for _, b := range branches {
+			for _, a := range alternatives {
+				product = append(product, append(append([]PropertyFilter(nil), b...), a...))
+			}
+		}
+		branches = product
+	}
+
+	return branches
+}
+
+// branchIndex returns the composite index needed by a query without Or filters.
+func branchIndex(spec *QuerySpec) *Index {
+	orders := pageOrders(spec)
+
+	// The document ID is implicitly the last field of every index, in the
+	// direction of the field before it. Ordering it the other way needs it
+	// in the index.
+	if n := len(orders); orders[n-1].Path == firestore.DocumentID && (n == 1 || orders[n-1].Dir == orders[n-2].Dir) {
+		orders = orders[:n-1]
+	}
+
+	ordered := make(map[string]bool)
+	for _, o := range orders {
+		ordered[o.Path] = true
+	}
+
+	equality := make([]string, 0)
+	array := ""
+	for _, f := range spec.Filters {
+		pf := f.(PropertyFilter)
+		if pf.Path == firestore.DocumentID || ordered[pf.Path] {
+			continue
+		}
+		switch pf.Op {
+		case "==", "in":
+			if !contains(equality, pf.Path) {
+				equality = append(equality, pf.Path)
+			}
+		case "array-contains", "array-contains-any":
+			array = pf.Path
+		}
+	}
+	sort.Strings(equality)
+
+	filtered := len(equality) > 0 || array != ""
+	if len(orders) == 0 || (len(orders) == 1 && !filtered) {
+		return nil
+	}
+
+	idx := NewIndex(spec.Collection[strings.LastIndex(spec.Collection, "/")+1:])
+	if spec.Group {
+		idx.Scope(ScopeCollectionGroup)
+	}
+	for _, path := range equality {
+		idx.Asc(path)
+	}
+	if array != "" {
+		idx.ArrayContains(array)
+	}
+	for _, o := range orders {
+		if o.Dir == firestore.Desc {
+			idx.Desc(o.Path)
+		} else {
+			idx.Asc(o.Path)
+		}
+	}
+
+	return idx
+}
+
+// IndexRecorder collects the composite indexes needed by the queries run on
+// the connections it is attached to with SetIndexRecorder. It is safe for
+// concurrent use.
+//
+// Example:
+//
+//	rec := fsdb.NewIndexRecorder()
+//	db.SetIndexRecorder(rec)
+//	// ... run the test suite ...
+//	err := rec.IndexSet().WriteFile("firestore.indexes.json")
+type IndexRecorder struct {
+	mu      sync.Mutex
+	indexes []*Index
+}
+
+// NewIndexRecorder creates an empty IndexRecorder.
+func NewIndexRecorder() *IndexRecorder {
+	return &IndexRecorder{}
+}
+
+// SetIndexRecorder makes the connection record the indexes needed by every
+// query it runs in rec, or stops recording if rec is nil.
+func (db *DBConnection) SetIndexRecorder(rec *IndexRecorder) {
+	db.recorderMu.Lock()
+	defer db.recorderMu.Unlock()
+
+	db.recorder = rec
+}
+
+// recordQuery passes a query about to be run to the connection's IndexRecorder, if any.
+func (db *DBConnection) recordQuery(spec *QuerySpec) {
+	db.recorderMu.Lock()
+	rec := db.recorder
+	db.recorderMu.Unlock()
+
+	if rec != nil {
+		rec.record(spec)
+	}
+}
+
+func (r *IndexRecorder) record(spec *QuerySpec) {
+	indexes := requiredIndexes(spec)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, idx := range indexes {
+		if !indexMatchesAny(idx, r.indexes) {
+			r.indexes = append(r.indexes, idx)
+		}
+	}
+}
+
+// IndexSet returns the distinct indexes recorded so far, in the order they
+// were first needed.
+func (r *IndexRecorder) IndexSet() *IndexSet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := NewIndexSet()
+	for _, idx := range r.indexes {
+		c := *idx
+		c.Fields = append([]IndexField(nil), idx.Fields...)
+		s.Add(&c)
+	}
+
+	return s
+}
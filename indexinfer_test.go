@@ -0,0 +1,102 @@
+package fsdb
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRequiredIndex(t *testing.T) {
+	db := newTestDB(t)
+
+	tests := []struct {
+		name string
+		q    *Query
+		want *Index
+	}{
+		{"no filters", db.Query("users"), nil},
+		{"equality only", db.Query("users").Where("team", "==", "a").Where("role", "==", "admin"), nil},
+		{"array and equality", db.Query("users").Where("tags", "array-contains", "x").Where("team", "==", "a"), nil},
+		{"single order", db.Query("users").OrderBy("age", Desc), nil},
+		{"single inequality", db.Query("users").Where("age", ">", 18), nil},
+		{"document ID order", db.Query("users").OrderBy("age", Asc).OrderBy("__name__", Asc), nil},
+		{"opposite document ID order",
+			db.Query("users").OrderBy("age", Asc).OrderBy("__name__", Desc),
+			NewIndex("users").Asc("age").Desc("__name__")},
+		{"equality and order",
+			db.Query("teams/a/users").Where("team", "==", "a").OrderBy("age", Desc),
+			NewIndex("users").Asc("team").Desc("age")},
+		{"in and inequality",
+			db.Query("users").Where("role", "in", []string{"a", "b"}).Where("age", ">=", 18),
+			NewIndex("users").Asc("role").Asc("age")},
+		{"array and order",
+			db.QueryGroup("users").Where("tags", "array-contains-any", []string{"x"}).Where("team", "==", "a").OrderBy("name", Asc),
+			NewIndex("users").Scope(ScopeCollectionGroup).Asc("team").ArrayContains("tags").Asc("name")},
+		{"two orders",
+			db.Query("users").OrderBy("age", Desc).OrderBy("name", Asc),
+			NewIndex("users").Desc("age").Asc("name")},
+		{"implicit inequality order",
+			db.Query("users").Where("score", "!=", 0).OrderBy("age", Desc),
+			NewIndex("users").Desc("age").Desc("score")},
+		{"or branches",
+			db.Query("users").WhereFilter(Or(Where("team", "==", "a"), And(Where("role", "==", "x"), Where("age", ">", 3)))),
+			NewIndex("users").Asc("role").Asc("age")},
+	}
+
+	for _, tc := range tests {
+		got := tc.q.RequiredIndex()
+		if (got == nil) != (tc.want == nil) || (got != nil && !indexEqual(got, tc.want)) {
+			t.Errorf("%s: got %#v, want %#v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestIndexRecorder(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	err := db.Add(ctx, "users/alice", &testUser{Name: "alice", Age: 30})
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	queryNames(t, db, db.Query("users").Where("Name", "==", "alice").OrderBy("Age", Asc))
+
+	rec := NewIndexRecorder()
+	db.SetIndexRecorder(rec)
+
+	queryNames(t, db, db.Query("users").Where("Name", "==", "alice").OrderBy("Age", Asc))
+	queryNames(t, db, db.Query("users").Where("Name", "==", "bob").OrderBy("Age", Asc))
+	queryNames(t, db, db.Query("users").Where("Name", "==", "alice"))
+	_, err = db.Query("users").WhereFilter(Or(
+		And(Where("Name", "==", "alice"), Where("Age", ">", 1)),
+		And(Where("tags", "array-contains", "a"), Where("Age", ">", 1)))).Count(ctx)
+	if err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	db.SetPageTokenKey([]byte("key"))
+	err = db.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		_, _, err := tx.QueryGroup("users").OrderBy("Age", Desc).OrderBy("Name", Desc).Page(ctx, 10, "")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("transaction: %v", err)
+	}
+
+	db.SetIndexRecorder(nil)
+	queryNames(t, db, db.Query("users").OrderBy("Age", Asc).OrderBy("Name", Asc))
+
+	want := []*Index{
+		NewIndex("users").Asc("Name").Asc("Age"),
+		NewIndex("users").ArrayContains("tags").Asc("Age"),
+		NewIndex("users").Scope(ScopeCollectionGroup).Desc("Age").Desc("Name"),
+	}
+	got := rec.IndexSet().Indexes
+	if len(got) != len(want) {
+		t.Fatalf("recorded %d indexes, want %d: %#v", len(got), len(want), got)
+	}
+	for i := range want {
+		if !indexEqual(got[i], want[i]) {
+			t.Fatalf("index %d: got %#v, want %#v", i, got[i], want[i])
+		}
+	}
+}
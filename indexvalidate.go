@@ -0,0 +1,290 @@
+package fsdb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+)
+
+// MaxIndexFields is the largest number of fields Firestore allows in a
+// composite index.
+const MaxIndexFields = 100
+
+// ErrInvalidIndex is wrapped by every IndexError, so errors.Is(err,
+// ErrInvalidIndex) reports whether validation failed.
+var ErrInvalidIndex = errors.New("invalid index")
+
+// IndexError describes one rule that an index or field override breaks.
+type IndexError struct {
+	// Index is the invalid index, or nil if the error is in FieldOverride.
+	Index *Index
+
+	// FieldOverride is the invalid field override, or nil if the error is
+	// in Index.
+	FieldOverride *FieldOverride
+
+	// Position is the position of the index or field override within its
+	// IndexSet, or -1 if it was validated on its own.
+	Position int
+
+	// Field is the position of the offending entry in Index.Fields or
+	// FieldOverride.Indexes, or -1 if the error is not about one entry.
+	Field int
+
+	// Reason describes the broken rule.
+	Reason string
+}
+
+func (e *IndexError) Error() string {
+	var b strings.Builder
+
+	if e.Index != nil {
+		if e.Position >= 0 {
+			fmt.Fprintf(&b, "indexes[%d] ", e.Position)
+		}
+		fmt.Fprintf(&b, "%s", e.Index)
+		if e.Field >= 0 {
+			fmt.Fprintf(&b, ": fields[%d]", e.Field)
+		}
+	} else {
+		if e.Position >= 0 {
+			fmt.Fprintf(&b, "fieldOverrides[%d] ", e.Position)
+		}
+		fmt.Fprintf(&b, "%s", e.FieldOverride)
+		if e.Field >= 0 {
+			fmt.Fprintf(&b, ": indexes[%d]", e.Field)
+		}
+	}
+	fmt.Fprintf(&b, ": %s", e.Reason)
+
+	return b.String()
+}
+
+func (e *IndexError) Unwrap() error {
+	return ErrInvalidIndex
+}
+
+// IndexErrors is returned by the Validate methods when one or more rules
+// are broken. Use errors.As to get at a particular *IndexError.
+type IndexErrors []*IndexError
+
+func (e IndexErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e IndexErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// Validate checks the index against the rules Firestore enforces when
+// creating composite indexes. It returns nil or an IndexErrors listing every
+// broken rule.
+func (idx *Index) Validate() error {
+	return errorsOrNil(idx.validate(-1))
+}
+
+// Validate checks the field override against the rules Firestore enforces
+// for single-field index configuration. It returns nil or an IndexErrors
+// listing every broken rule.
+func (fo *FieldOverride) Validate() error {
+	return errorsOrNil(fo.validate(-1))
+}
+
+// Validate checks every index and field override in the set, that none of
+// them is repeated, and that each collection group has at most one TTL
+// policy. It returns nil or an IndexErrors listing every broken
+// rule.
+//
+// Example:
+//
+//	var ie *fsdb.IndexError
+//	if errors.As(set.Validate(), &ie) {
+//		log.Printf("fix %v: %s", ie.Index, ie.Reason)
+//	}
+func (s *IndexSet) Validate() error {
+	var errs IndexErrors
+
+	for i, idx := range s.Indexes {
+		errs = append(errs, idx.validate(i)...)
+		for j := 0; j < i; j++ {
+			if indexEqual(idx, s.Indexes[j]) {
+				errs = append(errs, &IndexError{Index: idx, Position: i, Field: -1,
+					Reason: fmt.Sprintf("duplicate of indexes[%d]", j)})
+				break
+			}
+		}
+	}
+
+	for i, fo := range s.FieldOverrides {
+		errs = append(errs, fo.validate(i)...)
+		for j := 0; j < i; j++ {
+			other := s.FieldOverrides[j]
+			if fo.CollectionGroup != other.CollectionGroup {
+				continue
+			}
+			if fo.FieldPath == other.FieldPath {
+				errs = append(errs, &IndexError{FieldOverride: fo, Position: i, Field: -1,
+					Reason: fmt.Sprintf("field is already configured by fieldOverrides[%d]", j)})
+				break
+			}
+			if fo.TTLEnabled && other.TTLEnabled {
+				errs = append(errs, &IndexError{FieldOverride: fo, Position: i, Field: -1,
+					Reason: fmt.Sprintf("collection group already has a TTL policy on fieldOverrides[%d]", j)})
+				break
+			}
+		}
+	}
+
+	return errorsOrNil(errs)
+}
+
+func errorsOrNil(errs IndexErrors) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (idx *Index) validate(pos int) IndexErrors {
+	var errs IndexErrors
+	fail := func(field int, format string, args ...interface{}) {
+		errs = append(errs, &IndexError{Index: idx, Position: pos, Field: field, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	if reason := collectionGroupProblem(idx.CollectionGroup); reason != "" {
+		fail(-1, "%s", reason)
+	}
+	if idx.QueryScope != ScopeCollection && idx.QueryScope != ScopeCollectionGroup {
+		fail(-1, "query scope %q is not %s or %s", idx.QueryScope, ScopeCollection, ScopeCollectionGroup)
+	}
+
+	switch {
+	case len(idx.Fields) == 0:
+		fail(-1, "index has no fields")
+	case len(idx.Fields) == 1:
+		fail(-1, "composite index has a single field; use a field override instead")
+	case len(idx.Fields) > MaxIndexFields:
+		fail(-1, "index has %d fields, more than the limit of %d", len(idx.Fields), MaxIndexFields)
+	}
+
+	seen := make(map[string]int)
+	arrays := 0
+	for i, f := range idx.Fields {
+		if reason := indexFieldProblem(f); reason != "" {
+			fail(i, "%s", reason)
+		}
+		if f.QueryScope != "" {
+			fail(i, "query scope is only allowed in field overrides")
+		}
+		if f.FieldPath == "" {
+			fail(i, "field path is empty")
+			continue
+		}
+
+		if j, ok := seen[f.FieldPath]; ok {
+			fail(i, "field %q is already indexed by fields[%d]", f.FieldPath, j)
+		} else {
+			seen[f.FieldPath] = i
+		}
+
+		if f.ArrayConfig != "" {
+			arrays++
+			if arrays == 2 {
+				fail(i, "index has more than one array-contains field")
+			}
+		}
+
+		if f.FieldPath == firestore.DocumentID {
+			if f.ArrayConfig != "" {
+				fail(i, "%s cannot be an array-contains field", firestore.DocumentID)
+			}
+			if i != len(idx.Fields)-1 {
+				fail(i, "%s must be the last field", firestore.DocumentID)
+			}
+		}
+	}
+
+	return errs
+}
+
+func (fo *FieldOverride) validate(pos int) IndexErrors {
+	var errs IndexErrors
+	fail := func(field int, format string, args ...interface{}) {
+		errs = append(errs, &IndexError{FieldOverride: fo, Position: pos, Field: field, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	if reason := collectionGroupProblem(fo.CollectionGroup); reason != "" {
+		fail(-1, "%s", reason)
+	}
+	switch fo.FieldPath {
+	case "":
+		fail(-1, "field path is empty")
+	case firestore.DocumentID:
+		fail(-1, "%s cannot be overridden", firestore.DocumentID)
+	}
+	if fo.Indexes == nil && !fo.TTLEnabled {
+		fail(-1, "override sets neither indexes nor a TTL policy")
+	}
+
+	for i, f := range fo.Indexes {
+		if reason := indexFieldProblem(f); reason != "" {
+			fail(i, "%s", reason)
+		}
+		if f.FieldPath != "" && f.FieldPath != fo.FieldPath {
+			fail(i, "field path %q does not match the override's field %q", f.FieldPath, fo.FieldPath)
+		}
+		if f.QueryScope != "" && f.QueryScope != ScopeCollection && f.QueryScope != ScopeCollectionGroup {
+			fail(i, "query scope %q is not %s or %s", f.QueryScope, ScopeCollection, ScopeCollectionGroup)
+		}
+
+		for j := 0; j < i; j++ {
+			if overrideIndex(f) == overrideIndex(fo.Indexes[j]) {
+				fail(i, "duplicate of indexes[%d]", j)
+				break
+			}
+		}
+	}
+
+	return errs
+}
+
+// collectionGroupProblem describes what is wrong with a collection group ID,
+// or returns "" if it is valid.
+func collectionGroupProblem(group string) string {
+	switch {
+	case group == "":
+		return "collection group is empty"
+	case strings.Contains(group, "/"):
+		return fmt.Sprintf("collection group %q is a path, not a collection ID", group)
+	case strings.HasPrefix(group, "__") && strings.HasSuffix(group, "__"):
+		return fmt.Sprintf("collection group %q is reserved", group)
+	}
+	return ""
+}
+
+// indexFieldProblem describes what is wrong with the mode of an index field,
+// or returns "" if it is valid. Exactly one of Order and ArrayConfig must be
+// set.
+func indexFieldProblem(f IndexField) string {
+	switch {
+	case f.Order != "" && f.ArrayConfig != "":
+		return "both an order and an array config are set"
+	case f.Order == "" && f.ArrayConfig == "":
+		return "neither an order nor an array config is set"
+	case f.Order != "" && f.Order != "ASCENDING" && f.Order != "DESCENDING":
+		return fmt.Sprintf("order %q is not ASCENDING or DESCENDING", f.Order)
+	case f.ArrayConfig != "" && f.ArrayConfig != "CONTAINS":
+		return fmt.Sprintf("array config %q is not CONTAINS", f.ArrayConfig)
+	}
+	return ""
+}
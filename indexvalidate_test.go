@@ -0,0 +1,165 @@
+package fsdb
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIndexValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		idx     *Index
+		reasons []string
+	}{
+		{"valid", NewIndex("users").Asc("team").Desc("age"), nil},
+		{"valid array and name", NewIndex("users").ArrayContains("tags").Asc("age").Desc("__name__"), nil},
+		{"no fields", NewIndex("users"), []string{"no fields"}},
+		{"single field", NewIndex("users").Asc("age"), []string{"single field"}},
+		{"no collection group", NewIndex("").Asc("a").Asc("b"), []string{"collection group is empty"}},
+		{"collection path", NewIndex("teams/a/users").Asc("a").Asc("b"), []string{"is a path"}},
+		{"bad scope", NewIndex("users").Scope("COLLECTIONS").Asc("a").Asc("b"), []string{`query scope "COLLECTIONS"`}},
+		{"repeated field", NewIndex("users").Asc("age").Desc("age"), []string{"already indexed by fields[0]"}},
+		{"two arrays", NewIndex("users").ArrayContains("a").ArrayContains("b"), []string{"more than one array-contains"}},
+		{"name not last", NewIndex("users").Asc("__name__").Asc("age"), []string{"must be the last field"}},
+		{"name array", NewIndex("users").Asc("age").ArrayContains("__name__"), []string{"cannot be an array-contains"}},
+		{"asc and array", &Index{CollectionGroup: "users", QueryScope: ScopeCollection, Fields: []IndexField{
+			{FieldPath: "tags", Order: "ASCENDING", ArrayConfig: "CONTAINS"}, {FieldPath: "age", Order: "ASCENDING"},
+		}}, []string{"both an order and an array config"}},
+		{"no mode", &Index{CollectionGroup: "users", QueryScope: ScopeCollection, Fields: []IndexField{
+			{FieldPath: "tags"}, {FieldPath: "age", Order: "ASC"},
+		}}, []string{"neither an order", `order "ASC"`}},
+		{"empty path", &Index{CollectionGroup: "users", QueryScope: ScopeCollection, Fields: []IndexField{
+			{Order: "ASCENDING"}, {FieldPath: "age", Order: "ASCENDING", QueryScope: ScopeCollection},
+		}}, []string{"field path is empty", "only allowed in field overrides"}},
+	}
+
+	for _, tc := range tests {
+		err := tc.idx.Validate()
+		if len(tc.reasons) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tc.name, err)
+			}
+			continue
+		}
+
+		var errs IndexErrors
+		if !errors.As(err, &errs) || !errors.Is(err, ErrInvalidIndex) {
+			t.Errorf("%s: got %v, want IndexErrors", tc.name, err)
+			continue
+		}
+		if len(errs) != len(tc.reasons) {
+			t.Errorf("%s: got %d errors, want %d: %v", tc.name, len(errs), len(tc.reasons), err)
+			continue
+		}
+		for i, reason := range tc.reasons {
+			if errs[i].Index != tc.idx || errs[i].Position != -1 || !strings.Contains(errs[i].Reason, reason) {
+				t.Errorf("%s: error %d is %#v, want %q", tc.name, i, errs[i], reason)
+			}
+		}
+	}
+}
+
+func TestIndexSetValidate(t *testing.T) {
+	s := NewIndexSet()
+	s.Add(NewIndex("users").Asc("team").Desc("age"))
+	s.AddFieldOverride(
+		&FieldOverride{CollectionGroup: "users", FieldPath: "bio", Indexes: []IndexField{}},
+		&FieldOverride{CollectionGroup: "users", FieldPath: "tags", Indexes: []IndexField{
+			{Order: "ASCENDING"}, {ArrayConfig: "CONTAINS", QueryScope: ScopeCollectionGroup},
+		}},
+	)
+	if err := s.Validate(); err != nil {
+		t.Fatalf("valid set: %v", err)
+	}
+
+	s.Indexes = append(s.Indexes, NewIndex("posts").Asc("at"), NewIndex("users").Asc("team").Desc("age"))
+	s.FieldOverrides = append(s.FieldOverrides,
+		&FieldOverride{CollectionGroup: "users", FieldPath: "bio", Indexes: []IndexField{{Order: "DESCENDING"}}},
+		NewFieldOverride("users", "expireAt").TTL(true),
+		NewFieldOverride("users", "deleteAt").Exempt().TTL(true),
+		NewFieldOverride("users", "name"),
+		&FieldOverride{CollectionGroup: "posts", FieldPath: "body", Indexes: []IndexField{
+			{FieldPath: "title", Order: "ASCENDING"}, {Order: "ASCENDING", QueryScope: "GROUP"}, {Order: "ASCENDING"},
+		}},
+	)
+
+	err := s.Validate()
+	var errs IndexErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("got %v, want IndexErrors", err)
+	}
+	want := []struct {
+		index  bool
+		pos    int
+		field  int
+		reason string
+	}{
+		{true, 1, -1, "single field"},
+		{true, 2, -1, "duplicate of indexes[0]"},
+		{false, 2, -1, "already configured by fieldOverrides[0]"},
+		{false, 4, -1, "already has a TTL policy on fieldOverrides[3]"},
+		{false, 5, -1, "neither indexes nor a TTL policy"},
+		{false, 6, 0, `field path "title"`},
+		{false, 6, 1, `query scope "GROUP"`},
+		{false, 6, 2, "duplicate of indexes[0]"},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("got %d errors, want %d: %v", len(errs), len(want), err)
+	}
+	for i, w := range want {
+		e := errs[i]
+		if (e.Index != nil) != w.index || e.Position != w.pos || e.Field != w.field || !strings.Contains(e.Reason, w.reason) {
+			t.Errorf("error %d is %q, want %q", i, e, w.reason)
+		}
+	}
+
+	var ie *IndexError
+	if !errors.As(err, &ie) || ie != errs[0] {
+		t.Fatalf("errors.As did not find the first IndexError")
+	}
+	if !strings.HasPrefix(ie.Error(), "indexes[1] posts (at ASC): ") {
+		t.Fatalf("message: %s", ie)
+	}
+}
+
+func TestIndexSetFileValidation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "firestore.indexes.json")
+
+	// Files that do not validate can still be read and rewritten.
+	invalid := NewIndexSet()
+	invalid.Add(NewIndex("users").Asc("age"))
+	if err := invalid.WriteFile(path); err != nil {
+		t.Fatalf("write invalid set: %v", err)
+	}
+	got, err := ReadFile(path)
+	if err != nil || len(got.Indexes) != 1 {
+		t.Fatalf("read invalid set: %v", err)
+	}
+	if _, err := ReadFileStrict(path); !errors.Is(err, ErrInvalidIndex) {
+		t.Fatalf("strict read invalid set: %v", err)
+	}
+
+	scope := `{"indexes": [{"collectionGroup": "users", "queryScope": "DATABASE",
+		"fields": [{"fieldPath": "a", "order": "ASCENDING"}, {"fieldPath": "b", "order": "ASCENDING"}]}]}`
+	if _, err := ReadJSON(strings.NewReader(scope)); err != nil {
+		t.Fatalf("read invalid scope: %v", err)
+	}
+	if _, err := ReadJSONStrict(strings.NewReader(scope)); !errors.Is(err, ErrInvalidIndex) {
+		t.Fatalf("strict read invalid scope: %v", err)
+	}
+
+	valid := NewIndexSet()
+	valid.Add(NewIndex("users").Asc("team").Desc("age"))
+	if err := valid.WriteFile(path); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got, err = ReadFileStrict(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if len(got.Indexes) != 1 || !indexEqual(got.Indexes[0], valid.Indexes[0]) {
+		t.Fatalf("round trip: %#v", got.Indexes)
+	}
+}
@@ -0,0 +1,135 @@
+package fsdb
+
+import (
+	"iter"
+)
+
+// All returns an iterator over the remaining documents. The DocumentIterator
+// is stopped when the loop ends, including on an early break. Iteration ends
+// after the first error.
+//
+// Example:
+//
+//	for doc, err := range db.DocumentIterator(ctx, "users").All() {
+//		if err != nil {
+//			return err
+//		}
+//		u := &User{}
+//		err = doc.DataTo(u)
+//		...
+//	}
+func (it *DocumentIterator) All() iter.Seq2[BackendDocument, error] {
+	return func(yield func(BackendDocument, error) bool) {
+		defer it.Stop()
+
+		for {
+			doc, err := it.it.Next()
+			if err == DBIteratorDone {
+				return
+			}
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			if !yield(doc, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Paths returns an iterator over the full resource names of the remaining
+// documents. Before each name is yielded the document is decoded into dval,
+// unless dval is nil. As with All, the DocumentIterator is stopped when the
+// loop ends.
+func (it *DocumentIterator) Paths(dval interface{}) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		for doc, err := range it.All() {
+			if err != nil {
+				yield("", err)
+				return
+			}
+
+			if dval != nil {
+				err = doc.DataTo(dval)
+				if err != nil {
+					yield("", err)
+					return
+				}
+			}
+
+			if !yield(doc.Path(), nil) {
+				return
+			}
+		}
+	}
+}
+
+// Snapshots returns an iterator over Snapshots of the remaining documents.
+// As with All, the DocumentIterator is stopped when the loop ends.
+func (it *DocumentIterator) Snapshots() iter.Seq2[*Snapshot, error] {
+	return func(yield func(*Snapshot, error) bool) {
+		for doc, err := range it.All() {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			if !yield(newSnapshot(doc), nil) {
+				return
+			}
+		}
+	}
+}
+
+// Decode returns an iterator that decodes each remaining document into a new T.
+// As with DocumentIterator.All, the DocumentIterator is stopped when the loop ends.
+//
+// Example:
+//
+//	for u, err := range fsdb.Decode[User](db.DocumentIterator(ctx, "users")) {
+//		...
+//	}
+func Decode[T any](it *DocumentIterator) iter.Seq2[*T, error] {
+	return func(yield func(*T, error) bool) {
+		for doc, err := range it.All() {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			dval := new(T)
+			err = doc.DataTo(dval)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			if !yield(dval, nil) {
+				return
+			}
+		}
+	}
+}
+
+// All returns an iterator over the full resource names of the remaining collections.
+// Iteration ends after the first error.
+func (it *CollectionIterator) All() iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		for {
+			name, err := it.it.Next()
+			if err == DBIteratorDone {
+				return
+			}
+			if err != nil {
+				yield("", err)
+				return
+			}
+
+			if !yield(name, nil) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package fsdb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestDocumentIteratorAll(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	for _, name := range []string{"alice", "bob", "carol"} {
+		err := db.Add(ctx, "users/"+name, &testUser{Name: name})
+		if err != nil {
+			t.Fatalf("add: %v", err)
+		}
+		err = db.Add(ctx, "users/"+name+"/posts/1", map[string]interface{}{})
+		if err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	u := &testUser{}
+	names := make([]string, 0)
+	for path, err := range db.DocumentIterator(ctx, "users").Paths(u) {
+		if err != nil {
+			t.Fatalf("paths: %v", err)
+		}
+		names = append(names, relativePath(path)+"="+u.Name)
+	}
+	if fmt.Sprint(names) != "[users/alice=alice users/bob=bob users/carol=carol]" {
+		t.Fatalf("paths: got %v", names)
+	}
+
+	it := db.DocumentIterator(ctx, "users")
+	for doc, err := range it.All() {
+		if err != nil {
+			t.Fatalf("all: %v", err)
+		}
+		if relativePath(doc.Path()) != "users/alice" {
+			t.Fatalf("all: got %s first", doc.Path())
+		}
+		break
+	}
+	err := db.NextDoc(ctx, it, u)
+	if err != DBIteratorDone {
+		t.Fatalf("iterator not stopped after break: %v", err)
+	}
+
+	users := make([]string, 0)
+	for u, err := range Decode[testUser](db.Query("users").OrderBy("Name", Desc).Documents(ctx)) {
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		users = append(users, u.Name)
+	}
+	if fmt.Sprint(users) != "[carol bob alice]" {
+		t.Fatalf("decode: got %v", users)
+	}
+
+	cols := make([]string, 0)
+	for name, err := range db.CollectionIterator(ctx, "users/bob").All() {
+		if err != nil {
+			t.Fatalf("collections: %v", err)
+		}
+		cols = append(cols, relativePath(name))
+	}
+	if fmt.Sprint(cols) != "[users/bob/posts]" {
+		t.Fatalf("collections: got %v", cols)
+	}
+}
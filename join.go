@@ -3,7 +3,6 @@ package fsdb
 import (
 	"bytes"
 	"crypto/rand"
-	"errors"
 	"fmt"
 )
 const (
@@ -131,16 +130,8 @@ func newJoinCode() (string, error) {
 func ListJoinCodes(t *Transaction) ([]*JoinCode, error) {
 	joincodes := make([]*JoinCode, 0)
 
-	iter := t.DocumentIterator("joincodes-bycode")
-
-	defer iter.Stop()
-	for {
-		jc := &JoinCode{}
-		_, err := t.NextDocPath(iter, jc)
+	for jc, err := range Decode[JoinCode](t.DocumentIterator("joincodes-bycode")) {
 		if err != nil {
-			if errors.Is(err, DBIteratorDone) {
-				break
-			}
 			return nil, err
 		}
 
@@ -2,17 +2,20 @@ package fsdb
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"reflect"
 
-	"cloud.google.com/go/firestore"
 	"github.com/tadhunt/logger"
 )
 
 type DBCollectionChanges struct {
 	log  logger.CompatLogWriter
-	snap *firestore.QuerySnapshot
+	snap *BackendQuerySnapshot
 }
 
+// DocumentChangeKind says how a document changed. DBCHANGE_ERROR is the zero
+// value, and is never reported for a change.
 type DocumentChangeKind int
 
 const (
@@ -20,32 +23,72 @@ const (
 	DBCHANGE_DOC_ADDED
 	DBCHANGE_DOC_REMOVED
 	DBCHANGE_DOC_CHANGED
+
+	// DBCHANGE_INITIAL marks the first snapshot delivered by DocListen,
+	// whether or not the document exists.
+	DBCHANGE_INITIAL
 )
 
-func (k DocumentChangeKind) ToString() string {
-	switch k {
-	case DBCHANGE_ERROR:
-		return "DBCHANGE_ERROR"
-	case DBCHANGE_DOC_ADDED:
-		return "DBCHANGE_DOC_ADDED"
-	case DBCHANGE_DOC_REMOVED:
-		return "DBCHANGE_DOC_REMOVED"
-	case DBCHANGE_DOC_CHANGED:
-		return "DBCHANGE_DOC_CHANGED"
+var documentChangeKindNames = map[DocumentChangeKind]string{
+	DBCHANGE_ERROR:       "DBCHANGE_ERROR",
+	DBCHANGE_DOC_ADDED:   "DBCHANGE_DOC_ADDED",
+	DBCHANGE_DOC_REMOVED: "DBCHANGE_DOC_REMOVED",
+	DBCHANGE_DOC_CHANGED: "DBCHANGE_DOC_CHANGED",
+	DBCHANGE_INITIAL:     "DBCHANGE_INITIAL",
+}
+
+func (k DocumentChangeKind) String() string {
+	if name, ok := documentChangeKindNames[k]; ok {
+		return name
 	}
 
 	return fmt.Sprintf("DBCHANGE_UNKNOWN_%d", k)
 }
 
+// ToString returns the name of the kind.
+//
+// Deprecated: use String.
+func (k DocumentChangeKind) ToString() string {
+	return k.String()
+}
+
+// MarshalText encodes the kind as its name, e.g. "DBCHANGE_DOC_ADDED", so
+// that it appears in JSON as a string.
+func (k DocumentChangeKind) MarshalText() ([]byte, error) {
+	if _, ok := documentChangeKindNames[k]; !ok {
+		return nil, fmt.Errorf("fsdb: invalid document change kind %d", k)
+	}
+
+	return []byte(k.String()), nil
+}
+
+// UnmarshalText decodes a kind encoded by MarshalText.
+func (k *DocumentChangeKind) UnmarshalText(text []byte) error {
+	for kind, name := range documentChangeKindNames {
+		if name == string(text) {
+			*k = kind
+			return nil
+		}
+	}
+
+	return fmt.Errorf("fsdb: unknown document change kind %q", text)
+}
+
 type DocumentChange struct {
 	Kind DocumentChangeKind
 	Path string
-	doc  *firestore.DocumentSnapshot
+	doc  BackendDocument
 }
 
+// DocListen calls handler with each snapshot of a document. The first is
+// reported as DBCHANGE_INITIAL, and later ones as DBCHANGE_DOC_ADDED when the
+// document is created, DBCHANGE_DOC_CHANGED when it is updated, and
+// DBCHANGE_DOC_REMOVED when it is deleted.
 func (db *DBConnection) DocListen(ctx context.Context, collection string, doc string, handler func(change *DocumentChange) error) error {
-	it := db.Client.Collection(collection).Doc(doc).Snapshots(ctx)
+	it := db.backend.ListenDocument(ctx, collection+"/"+doc)
+	defer it.Stop()
 
+	state := &docListenState{}
 	for {
 		snap, err := it.Next()
 
@@ -53,15 +96,9 @@ func (db *DBConnection) DocListen(ctx context.Context, collection string, doc st
 			return err
 		}
 
-		change := &DocumentChange{
-			Path: snap.Ref.Path,
-			doc:  snap,
-		}
-
-		if !snap.Exists() {
-			change.Kind = DBCHANGE_DOC_REMOVED
-		} else {
-			change.Kind = DBCHANGE_DOC_CHANGED
+		change := state.change(snap)
+		if change == nil {
+			continue
 		}
 
 		err = handler(change)
@@ -71,36 +108,87 @@ func (db *DBConnection) DocListen(ctx context.Context, collection string, doc st
 	}
 }
 
+// docListenState tracks whether a listened-to document existed at its last
+// snapshot.
+type docListenState struct {
+	started bool
+	exists  bool
+}
+
+// change returns the change reported by snap, or nil if there is none
+// because the document still does not exist.
+func (s *docListenState) change(snap BackendDocument) *DocumentChange {
+	kind := DBCHANGE_INITIAL
+	if s.started {
+		switch {
+		case s.exists && snap.Exists():
+			kind = DBCHANGE_DOC_CHANGED
+		case snap.Exists():
+			kind = DBCHANGE_DOC_ADDED
+		case s.exists:
+			kind = DBCHANGE_DOC_REMOVED
+		default:
+			return nil
+		}
+	}
+
+	s.started = true
+	s.exists = snap.Exists()
+
+	return &DocumentChange{
+		Kind: kind,
+		Path: snap.Path(),
+		doc:  snap,
+	}
+}
+
 type ListenFilter struct {
 	Path  string
 	Op    string
 	Value interface{}
 }
 
-func (db *DBConnection) CollectionListen(log logger.CompatLogWriter, ctx context.Context, collection string, handler func(changes *DBCollectionChanges) error, filter *ListenFilter) error {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+// CollectionListen listens to the documents in collection that match all of
+// filters, calling handler with each snapshot. Nil filters are ignored. See
+// QueryListen for queries that need ordering, limits or collection groups.
+func (db *DBConnection) CollectionListen(log logger.CompatLogWriter, ctx context.Context, collection string, handler func(changes *DBCollectionChanges) error, filters ...*ListenFilter) error {
+	query, err := listenQuery(collection, filters)
+	if err != nil {
+		return err
+	}
 
-	query := db.Client.Collection(collection).Query
-	if filter != nil {
-		switch filter.Op {
-		case "in":
-			fallthrough
-		case "not-in":
-			a, ok := filter.Value.([]string)
-			if !ok {
-				return fmt.Errorf("filter %#v: Filter.Value must be []string", *filter) // TODO(tadhunt): maybe not true, but good enough for my usage for now
-			}
-			if len(a) > 10 {
-				// According to https://firebase.google.com/docs/firestore/query-data/queries#in_not-in_and_array-contains-any
-				return fmt.Errorf("filter %#v: too many values, 10 max", *filter)
-			}
-		}
+	db.recordQuery(query)
+	return db.listenHandler(log, ctx, query, handler)
+}
+
+// QueryListen listens to a query, calling handler with each snapshot of its
+// results. Changes made to q after the call do not affect the listener.
+//
+// Example:
+//
+//	q := db.QueryGroup("posts").Where("tags", "array-contains-any", tags).OrderBy("created", fsdb.Desc).Limit(20)
+//	err := db.QueryListen(log, ctx, q, handler)
+func (db *DBConnection) QueryListen(log logger.CompatLogWriter, ctx context.Context, q *Query, handler func(changes *DBCollectionChanges) error) error {
+	if q.tx != nil {
+		return errors.New("listen: query is part of a transaction")
+	}
 
-		query = query.Where(filter.Path, filter.Op, filter.Value)
+	query := q.spec
+	err := checkListenFilters(query.Filters)
+	if err != nil {
+		return err
 	}
 
-	iterator := query.Snapshots(ctx)
+	db.recordQuery(&query)
+	return db.listenHandler(log, ctx, &query, handler)
+}
+
+func (db *DBConnection) listenHandler(log logger.CompatLogWriter, ctx context.Context, query *QuerySpec, handler func(changes *DBCollectionChanges) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	iterator := db.listen(ctx, query)
+	defer iterator.Stop()
 	for {
 		snap, err := iterator.Next()
 
@@ -120,6 +208,51 @@ func (db *DBConnection) CollectionListen(log logger.CompatLogWriter, ctx context
 	}
 }
 
+func listenQuery(collection string, filters []*ListenFilter) (*QuerySpec, error) {
+	query := &QuerySpec{Collection: collection}
+	for _, filter := range filters {
+		if filter != nil {
+			query.Filters = append(query.Filters, PropertyFilter{Path: filter.Path, Op: filter.Op, Value: filter.Value})
+		}
+	}
+
+	err := checkListenFilters(query.Filters)
+	if err != nil {
+		return nil, err
+	}
+
+	return query, nil
+}
+
+// checkListenFilters checks the values of list filters. Lists for "in" and
+// "array-contains-any" may be any length, since longer ones are split over
+// several listeners, but "not-in" is limited to MaxNotInValues.
+// See https://firebase.google.com/docs/firestore/query-data/queries#in_not-in_and_array-contains-any
+func checkListenFilters(filters []Filter) error {
+	for _, f := range filters {
+		switch f := f.(type) {
+		case PropertyFilter:
+			switch f.Op {
+			case "in", "not-in", "array-contains-any":
+				v := reflect.ValueOf(f.Value)
+				if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+					return fmt.Errorf("filter %#v: value must be a slice or array", f)
+				}
+				if f.Op == "not-in" && v.Len() > MaxNotInValues {
+					return fmt.Errorf("filter %#v: too many values, %d max", f, MaxNotInValues)
+				}
+			}
+		case CompositeFilter:
+			err := checkListenFilters(f.Filters)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 func (dc *DocumentChange) Data() map[string]interface{} {
 	return dc.doc.Data()
 }
@@ -128,35 +261,31 @@ func (dc *DocumentChange) DataTo(dval interface{}) error {
 	return dc.doc.DataTo(dval)
 }
 
+// Exists reports whether the document exists after the change.
+func (dc *DocumentChange) Exists() bool {
+	return dc.doc.Exists()
+}
+
 func (c *DBCollectionChanges) Iterator() *DocumentIterator {
-	return &DocumentIterator{c.snap.Documents}
+	return newDocumentIterator(&sliceIterator{docs: c.snap.Docs})
 }
 
 func (c *DBCollectionChanges) Changes() []*DocumentChange {
 	changes := make([]*DocumentChange, 0)
 
-	for _, fc := range c.snap.Changes {
+	for _, bc := range c.snap.Changes {
+		switch bc.Kind {
+		case DBCHANGE_DOC_ADDED, DBCHANGE_DOC_REMOVED, DBCHANGE_DOC_CHANGED:
+		default:
+			c.log.Errorf("fsdb: backend reported change to %s with invalid kind %s", bc.Doc.Path(), bc.Kind)
+		}
+
 		dc := &DocumentChange{
-			Kind: c.kindRemap(fc.Kind),
-			Path: fc.Doc.Ref.Path,
-			doc:  fc.Doc,
+			Kind: bc.Kind,
+			Path: bc.Doc.Path(),
+			doc:  bc.Doc,
 		}
 		changes = append(changes, dc)
 	}
 	return changes
 }
-
-func (c *DBCollectionChanges) kindRemap(kind firestore.DocumentChangeKind) DocumentChangeKind {
-	switch kind {
-	case firestore.DocumentAdded:
-		return DBCHANGE_DOC_ADDED
-	case firestore.DocumentRemoved:
-		return DBCHANGE_DOC_REMOVED
-	case firestore.DocumentModified:
-		return DBCHANGE_DOC_CHANGED
-	}
-
-	c.log.Errorf("mcdb missing remap for firestore.DocumentChangeKind %v", kind)
-
-	return DBCHANGE_ERROR
-}
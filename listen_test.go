@@ -0,0 +1,96 @@
+package fsdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+)
+
+func TestDocListen(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	errDone := errors.New("done")
+
+	writes := []func() error{
+		func() error { return db.Add(ctx, "users/alice", &testUser{Name: "alice"}) },
+		func() error { return db.Update(ctx, "users/alice", Set("Age", 1)) },
+		func() error { return db.Delete(ctx, "users/alice") },
+		func() error { return db.Add(ctx, "users/alice", &testUser{Name: "alice", Age: 2}) },
+	}
+
+	got := make([]string, 0)
+	err := db.DocListen(ctx, "users", "alice", func(change *DocumentChange) error {
+		got = append(got, fmt.Sprintf("%s %v", change.Kind, change.Exists()))
+		if len(got) > len(writes) {
+			return errDone
+		}
+		return writes[len(got)-1]()
+	})
+	if err != errDone {
+		t.Fatalf("listen: %v", err)
+	}
+
+	want := []string{
+		"DBCHANGE_INITIAL false",
+		"DBCHANGE_DOC_ADDED true",
+		"DBCHANGE_DOC_CHANGED true",
+		"DBCHANGE_DOC_REMOVED false",
+		"DBCHANGE_DOC_ADDED true",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	err = db.DocListen(ctx, "users", "alice", func(change *DocumentChange) error {
+		var u testUser
+		if change.Kind != DBCHANGE_INITIAL || !change.Exists() || change.DataTo(&u) != nil || u.Age != 2 {
+			return fmt.Errorf("first change %s of an existing document", change.Kind)
+		}
+		return errDone
+	})
+	if err != errDone {
+		t.Fatalf("listen: %v", err)
+	}
+}
+
+func TestDocumentChangeKind(t *testing.T) {
+	type change struct {
+		Kind DocumentChangeKind `json:"kind"`
+	}
+
+	for _, kind := range []DocumentChangeKind{DBCHANGE_ERROR, DBCHANGE_DOC_ADDED, DBCHANGE_DOC_REMOVED, DBCHANGE_DOC_CHANGED, DBCHANGE_INITIAL} {
+		data, err := json.Marshal(change{kind})
+		if err != nil {
+			t.Fatalf("marshal %s: %v", kind, err)
+		}
+		if string(data) != fmt.Sprintf(`{"kind":"%s"}`, kind) {
+			t.Fatalf("marshaled %s as %s", kind, data)
+		}
+
+		var c change
+		err = json.Unmarshal(data, &c)
+		if err != nil || c.Kind != kind {
+			t.Fatalf("unmarshal %s: got %s, %v", data, c.Kind, err)
+		}
+	}
+
+	if s := fmt.Sprint(DocumentChangeKind(9)); s != "DBCHANGE_UNKNOWN_9" {
+		t.Fatalf("unknown kind prints as %s", s)
+	}
+	if _, err := json.Marshal(change{DocumentChangeKind(9)}); err == nil {
+		t.Fatalf("marshaled an unknown kind")
+	}
+	var c change
+	if err := json.Unmarshal([]byte(`{"kind":"DBCHANGE_DOC_MOVED"}`), &c); err == nil {
+		t.Fatalf("unmarshaled an unknown kind")
+	}
+
+	if _, err := firestoreKindRemap(firestore.DocumentChangeKind(9)); err == nil {
+		t.Fatalf("remapped an unknown firestore kind")
+	}
+}
@@ -0,0 +1,207 @@
+package fsdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/tadhunt/logger"
+)
+
+// ListenHub shares listeners between callers that listen to the same query.
+// The first caller to listen to a query starts a listener, later callers
+// share it, and it is stopped when the last of them returns.
+//
+// A caller that joins a running listener first receives its current results,
+// all reported as added. A caller whose handler falls behind is not sent the
+// snapshots it missed; its next snapshot holds the changes since the last one
+// it received.
+//
+// Example:
+//
+//	hub := fsdb.NewListenHub(db)
+//	go hub.Listen(log, ctx, db.Query("rooms").Where("open", "==", true), handlerA)
+//	go hub.Listen(log, ctx, db.Query("rooms").Where("open", "==", true), handlerB) // shares handlerA's listener
+type ListenHub struct {
+	db *DBConnection
+
+	mu      sync.Mutex
+	streams map[string]*hubStream
+}
+
+// NewListenHub returns a hub that shares listeners on db.
+func NewListenHub(db *DBConnection) *ListenHub {
+	return &ListenHub{
+		db:      db,
+		streams: make(map[string]*hubStream),
+	}
+}
+
+// hubStream is a listener shared by a hub's subscribers. Its fields are
+// guarded by the hub's mutex.
+type hubStream struct {
+	key    string
+	cancel context.CancelFunc
+	subs   map[*hubSubscriber]struct{}
+
+	// snap is the latest snapshot and seq the number of snapshots received.
+	snap *BackendQuerySnapshot
+	seq  int
+	err  error
+}
+
+type hubSubscriber struct {
+	notify chan struct{}
+}
+
+// Listen is like QueryListen, but shares a listener with other callers of
+// Listen on the hub whose queries are identical. It returns when ctx is done,
+// handler returns an error, or the listener fails.
+func (h *ListenHub) Listen(log logger.CompatLogWriter, ctx context.Context, q *Query, handler func(changes *DBCollectionChanges) error) error {
+	if q.tx != nil {
+		return errors.New("listen: query is part of a transaction")
+	}
+
+	spec := q.spec
+	err := checkListenFilters(spec.Filters)
+	if err != nil {
+		return err
+	}
+
+	key, err := hubKey(&spec)
+	if err != nil {
+		return err
+	}
+
+	sub := &hubSubscriber{notify: make(chan struct{}, 1)}
+	s := h.subscribe(key, &spec, sub)
+	defer h.unsubscribe(s, sub)
+
+	var sent *BackendQuerySnapshot
+	sentSeq := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-sub.notify:
+		}
+
+		h.mu.Lock()
+		snap, seq, err := s.snap, s.seq, s.err
+		h.mu.Unlock()
+
+		if seq != sentSeq {
+			// Snapshots carry the changes since the one before them, so a
+			// subscriber that missed any gets the changes since its last.
+			next := snap
+			if seq != sentSeq+1 {
+				prev := sent
+				if prev == nil {
+					prev = &BackendQuerySnapshot{}
+				}
+				next = resumedSnapshot(prev, snap)
+			}
+			first := sent == nil
+			sent, sentSeq = snap, seq
+
+			if first || len(next.Changes) > 0 {
+				err := handler(&DBCollectionChanges{log: log, snap: next})
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// subscribe adds sub to the stream for spec, whose key is key, starting one
+// if there is none.
+func (h *ListenHub) subscribe(key string, spec *QuerySpec, sub *hubSubscriber) *hubStream {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.streams[key]
+	if s == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		s = &hubStream{
+			key:    key,
+			cancel: cancel,
+			subs:   make(map[*hubSubscriber]struct{}),
+		}
+		h.streams[key] = s
+
+		h.db.recordQuery(spec)
+		go h.run(s, h.db.listen(ctx, spec))
+	}
+
+	s.subs[sub] = struct{}{}
+	if s.seq > 0 || s.err != nil {
+		sub.notify <- struct{}{}
+	}
+
+	return s
+}
+
+// unsubscribe removes sub from s, and stops s if it was the last subscriber.
+func (h *ListenHub) unsubscribe(s *hubStream, sub *hubSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(s.subs, sub)
+	if len(s.subs) > 0 {
+		return
+	}
+
+	if h.streams[s.key] == s {
+		delete(h.streams, s.key)
+	}
+	s.cancel()
+}
+
+// run reads snapshots from a stream's listener and notifies its subscribers.
+// A failed stream is removed from the hub, so later callers start a new one.
+func (h *ListenHub) run(s *hubStream, it BackendQueryIterator) {
+	defer it.Stop()
+
+	for {
+		snap, err := it.Next()
+
+		h.mu.Lock()
+		if err != nil {
+			s.err = err
+			if h.streams[s.key] == s {
+				delete(h.streams, s.key)
+			}
+		} else {
+			s.snap = snap
+			s.seq++
+		}
+		for sub := range s.subs {
+			select {
+			case sub.notify <- struct{}{}:
+			default:
+			}
+		}
+		h.mu.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// hubKey returns a key that is the same for identical queries, comparing
+// values as page tokens do, so that equivalent values such as int and int64,
+// or two references to the same document, give the same key.
+func hubKey(spec *QuerySpec) (string, error) {
+	shape, err := queryShape(spec)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x %d %t", shape, spec.Limit, spec.LimitToLast), nil
+}
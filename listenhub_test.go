@@ -0,0 +1,270 @@
+package fsdb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// hubListener runs ListenHub.Listen in a goroutine, recording the changes it
+// delivers.
+type hubListener struct {
+	cancel  context.CancelFunc
+	changes chan string
+	done    chan error
+}
+
+func startHubListener(hub *ListenHub, q *Query) *hubListener {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &hubListener{cancel: cancel, changes: make(chan string, 10), done: make(chan error, 1)}
+	go func() {
+		l.done <- hub.Listen(hub.db.log, ctx, q, func(changes *DBCollectionChanges) error {
+			l.changes <- describeChanges(changes)
+			return nil
+		})
+	}()
+	return l
+}
+
+func (l *hubListener) next(t *testing.T) string {
+	t.Helper()
+
+	// Changes are sent before the listener returns, so take them first.
+	select {
+	case got := <-l.changes:
+		return got
+	default:
+	}
+
+	select {
+	case got := <-l.changes:
+		return got
+	case err := <-l.done:
+		t.Fatalf("listener returned %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for changes")
+	}
+	return ""
+}
+
+func (l *hubListener) wait(t *testing.T) error {
+	t.Helper()
+
+	select {
+	case err := <-l.done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for listener to return")
+	}
+	return nil
+}
+
+func (h *ListenHub) numStreams() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.streams)
+}
+
+func TestListenHub(t *testing.T) {
+	ctx := context.Background()
+	db, b := newFlakyDB(t, nil)
+	hub := NewListenHub(db)
+
+	for _, name := range []string{"a", "b"} {
+		if err := db.Add(ctx, "users/"+name, &testUser{Name: name, Tags: []string{"x"}}); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	query := func() *Query {
+		return db.Query("users").Where("tags", "array-contains", "x")
+	}
+
+	l1 := startHubListener(hub, query())
+	if got := l1.next(t); got != "ADDED a -1 0, ADDED b -1 1" {
+		t.Fatalf("first listener: %s", got)
+	}
+	if err := db.Update(ctx, "users/a", Set("Age", 1)); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if got := l1.next(t); got != "CHANGED a 0 0" {
+		t.Fatalf("first listener: %s", got)
+	}
+
+	// A late listener gets the current results, and shares the stream.
+	l2 := startHubListener(hub, query())
+	if got := l2.next(t); got != "ADDED a -1 0, ADDED b -1 1" {
+		t.Fatalf("late listener: %s", got)
+	}
+	if err := db.Add(ctx, "users/c", &testUser{Name: "c", Tags: []string{"x"}}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	for i, l := range []*hubListener{l1, l2} {
+		if got := l.next(t); got != "ADDED c -1 2" {
+			t.Fatalf("listener %d: %s", i+1, got)
+		}
+	}
+
+	// A different query gets its own stream.
+	l3 := startHubListener(hub, db.Query("users").Where("Name", "==", "a"))
+	if got := l3.next(t); got != "ADDED a -1 0" {
+		t.Fatalf("other query: %s", got)
+	}
+	if b.listens != 2 || hub.numStreams() != 2 {
+		t.Fatalf("%d listens, %d streams", b.listens, hub.numStreams())
+	}
+	l3.cancel()
+	l3.wait(t)
+
+	// The stream outlives the listener that started it, and stops when the
+	// last listener leaves.
+	l1.cancel()
+	if err := l1.wait(t); err != context.Canceled {
+		t.Fatalf("first listener returned %v", err)
+	}
+	if err := db.Delete(ctx, "users/b"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if got := l2.next(t); got != "REMOVED b 1 -1" {
+		t.Fatalf("late listener: %s", got)
+	}
+	l2.cancel()
+	l2.wait(t)
+	if hub.numStreams() != 0 {
+		t.Fatalf("%d streams after the last listener left", hub.numStreams())
+	}
+
+	l4 := startHubListener(hub, query())
+	if got := l4.next(t); got != "ADDED a -1 0, ADDED c -1 1" {
+		t.Fatalf("new listener: %s", got)
+	}
+	if b.listens != 3 {
+		t.Fatalf("%d listens, want 3", b.listens)
+	}
+	l4.cancel()
+	l4.wait(t)
+}
+
+func TestListenHubError(t *testing.T) {
+	ctx := context.Background()
+	db, b := newFlakyDB(t, status.Error(codes.Unavailable, "unavailable"), 2)
+	hub := NewListenHub(db)
+
+	if err := db.Add(ctx, "users/a", &testUser{Name: "a"}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	l1 := startHubListener(hub, db.Query("users"))
+	l1.next(t)
+	l2 := startHubListener(hub, db.Query("users"))
+	l2.next(t)
+
+	if err := db.Add(ctx, "users/b", &testUser{Name: "b"}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	for i, l := range []*hubListener{l1, l2} {
+		if got := l.next(t); got != "ADDED b -1 1" {
+			t.Fatalf("listener %d: %s", i+1, got)
+		}
+	}
+
+	for i, l := range []*hubListener{l1, l2} {
+		if err := l.wait(t); status.Code(err) != codes.Unavailable {
+			t.Fatalf("listener %d returned %v", i+1, err)
+		}
+	}
+	if hub.numStreams() != 0 || b.listens != 1 {
+		t.Fatalf("%d streams, %d listens after failure", hub.numStreams(), b.listens)
+	}
+}
+
+func TestListenHubKey(t *testing.T) {
+	db := newTestDB(t)
+
+	key := func(q *Query) string {
+		k, err := hubKey(&q.spec)
+		if err != nil {
+			t.Fatalf("key: %v", err)
+		}
+		return k
+	}
+	ref := func() *firestore.DocumentRef {
+		return &firestore.DocumentRef{Path: "projects/p/databases/(default)/documents/users/a"}
+	}
+
+	same := [][2]*Query{
+		{db.Query("users").Where("Age", "==", 1), db.Query("users").Where("Age", "==", int64(1))},
+		{db.Query("users").Where("tags", "in", []string{"a", "b"}), db.Query("users").Where("tags", "in", []interface{}{"a", "b"})},
+		{db.Query("users").Where("ref", "==", ref()), db.Query("users").Where("ref", "==", ref())},
+	}
+	for _, qs := range same {
+		if key(qs[0]) != key(qs[1]) {
+			t.Fatalf("%v and %v have different keys", qs[0].spec.Filters, qs[1].spec.Filters)
+		}
+	}
+
+	byAge := func() *Query {
+		return db.Query("users").OrderBy("Age", Asc)
+	}
+	different := []*Query{
+		byAge(),
+		db.Query("users").OrderBy("Age", Desc),
+		db.Query("posts").OrderBy("Age", Asc),
+		byAge().Limit(1),
+		byAge().Limit(2),
+		byAge().LimitToLast(1),
+		byAge().Where("ref", "==", ref()),
+	}
+	keys := make(map[string]int)
+	for i, q := range different {
+		k := key(q)
+		if j, ok := keys[k]; ok {
+			t.Fatalf("queries %d and %d have the same key", j, i)
+		}
+		keys[k] = i
+	}
+}
+
+func TestListenHubSplit(t *testing.T) {
+	ctx := context.Background()
+	db, b := newFlakyDB(t, nil)
+	hub := NewListenHub(db)
+
+	ages := make([]int, 2*MaxDisjunctionValues)
+	for i := range ages {
+		ages[i] = i
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.Add(ctx, fmt.Sprintf("users/u%d", i), &testUser{Name: "u", Age: i * MaxDisjunctionValues}); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	q := db.Query("users").Where("Age", "in", ages)
+	l1 := startHubListener(hub, q)
+	if got := l1.next(t); got != "ADDED u0 -1 0, ADDED u1 -1 1" {
+		t.Fatalf("first listener: %s", got)
+	}
+	l2 := startHubListener(hub, q)
+	if got := l2.next(t); got != "ADDED u0 -1 0, ADDED u1 -1 1" {
+		t.Fatalf("second listener: %s", got)
+	}
+	if b.listens != 2 || hub.numStreams() != 1 {
+		t.Fatalf("%d listens, %d streams", b.listens, hub.numStreams())
+	}
+
+	for _, l := range []*hubListener{l1, l2} {
+		l.cancel()
+		if err := l.wait(t); err != context.Canceled {
+			t.Fatalf("listener returned %v", err)
+		}
+	}
+	if hub.numStreams() != 0 {
+		t.Fatalf("%d streams after the last listener left", hub.numStreams())
+	}
+}
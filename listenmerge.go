@@ -0,0 +1,283 @@
+package fsdb
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"cloud.google.com/go/firestore"
+)
+
+const (
+	// MaxDisjunctionValues is the most disjunctions Firestore allows in a
+	// query: the values of an "in" or "array-contains-any" filter, multiplied
+	// together when a query has several. Listeners split larger queries over
+	// several listeners.
+	MaxDisjunctionValues = 30
+
+	// MaxNotInValues is the most values Firestore allows in a "not-in"
+	// filter.
+	MaxNotInValues = 10
+)
+
+// listen listens to a query. A query whose "in" or "array-contains-any"
+// filters make more than MaxDisjunctionValues disjunctions is run as several
+// queries, whose results are merged.
+func (db *DBConnection) listen(ctx context.Context, spec *QuerySpec) BackendQueryIterator {
+	specs, err := splitQuery(spec)
+	if err != nil {
+		return &errorQueryIterator{err}
+	}
+	if specs == nil {
+		return db.backend.ListenQuery(ctx, spec)
+	}
+
+	return newMergedQueryIterator(ctx, db.backend, spec, specs)
+}
+
+// splitQuery returns the queries whose results together make up spec's, or
+// nil if spec can be run as it is. Firestore counts a query's disjunctions
+// as the product of the lengths of its "in" and "array-contains-any" lists,
+// so the lists are cut into chunks whose lengths multiply to no more than
+// MaxDisjunctionValues, shortest list first.
+func splitQuery(spec *QuerySpec) ([]*QuerySpec, error) {
+	type disjunction struct {
+		i      int
+		filter PropertyFilter
+		values reflect.Value
+	}
+
+	disjunctions := make([]disjunction, 0)
+	composite := false
+	product := 1
+	for i, f := range spec.Filters {
+		switch f := f.(type) {
+		case CompositeFilter:
+			composite = true
+		case PropertyFilter:
+			if f.Op != "in" && f.Op != "array-contains-any" {
+				continue
+			}
+			v := reflect.ValueOf(f.Value)
+			if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+				continue
+			}
+			disjunctions = append(disjunctions, disjunction{i, f, v})
+			product = min(product*v.Len(), MaxDisjunctionValues+1)
+		}
+	}
+
+	if product <= MaxDisjunctionValues {
+		return nil, nil
+	}
+	if composite {
+		return nil, fmt.Errorf("fsdb: cannot listen to a query with composite filters and more than %d disjunctions", MaxDisjunctionValues)
+	}
+	if spec.Offset > 0 {
+		return nil, fmt.Errorf("fsdb: cannot listen with an offset to a query with more than %d disjunctions", MaxDisjunctionValues)
+	}
+
+	sort.SliceStable(disjunctions, func(i, j int) bool {
+		return disjunctions[i].values.Len() < disjunctions[j].values.Len()
+	})
+
+	specs := []*QuerySpec{spec}
+	budget := MaxDisjunctionValues
+	for _, d := range disjunctions {
+		n := d.values.Len()
+		size := min(n, budget)
+		budget /= size
+		if size == n {
+			continue
+		}
+
+		split := make([]*QuerySpec, 0, len(specs)*((n+size-1)/size))
+		for start := 0; start < n; start += size {
+			end := min(start+size, n)
+			chunk := make([]interface{}, 0, end-start)
+			for j := start; j < end; j++ {
+				chunk = append(chunk, d.values.Index(j).Interface())
+			}
+
+			for _, s := range specs {
+				c := *s
+				c.Filters = append([]Filter(nil), s.Filters...)
+				c.Filters[d.i] = PropertyFilter{Path: d.filter.Path, Op: d.filter.Op, Value: chunk}
+				split = append(split, &c)
+			}
+		}
+		specs = split
+	}
+
+	return specs, nil
+}
+
+// mergedQueryIterator listens to several queries and delivers the union of
+// their results, in the order and up to the limit of the original query.
+type mergedQueryIterator struct {
+	spec   *QuerySpec
+	orders []Order
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	results chan mergeResult
+	latest  [][]BackendDocument
+	ready   int
+	prev    *BackendQuerySnapshot
+	err     error
+}
+
+type mergeResult struct {
+	i    int
+	snap *BackendQuerySnapshot
+	err  error
+}
+
+func newMergedQueryIterator(ctx context.Context, backend Backend, spec *QuerySpec, specs []*QuerySpec) *mergedQueryIterator {
+	ctx, cancel := context.WithCancel(ctx)
+
+	m := &mergedQueryIterator{
+		spec:    spec,
+		orders:  pageOrders(spec),
+		ctx:     ctx,
+		cancel:  cancel,
+		results: make(chan mergeResult),
+		latest:  make([][]BackendDocument, len(specs)),
+	}
+
+	for i, s := range specs {
+		it := backend.ListenQuery(ctx, s)
+		go func() {
+			defer it.Stop()
+			for {
+				snap, err := it.Next()
+				select {
+				case m.results <- mergeResult{i, snap, err}:
+				case <-ctx.Done():
+					return
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	return m
+}
+
+// Next returns the merged results once every query has delivered its first
+// snapshot, and again each time they change. It returns the context's error
+// once the context is done or Stop is called.
+func (m *mergedQueryIterator) Next() (*BackendQuerySnapshot, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	for {
+		var r mergeResult
+		select {
+		case r = <-m.results:
+		case <-m.ctx.Done():
+			m.err = m.ctx.Err()
+			return nil, m.err
+		}
+
+		if r.err != nil {
+			m.err = r.err
+			m.cancel()
+			return nil, r.err
+		}
+
+		if m.latest[r.i] == nil {
+			m.ready++
+		}
+		m.latest[r.i] = r.snap.Docs
+		if m.latest[r.i] == nil {
+			m.latest[r.i] = []BackendDocument{}
+		}
+		if m.ready < len(m.latest) {
+			continue
+		}
+
+		prev := m.prev
+		if prev == nil {
+			prev = &BackendQuerySnapshot{}
+		}
+		snap := resumedSnapshot(prev, &BackendQuerySnapshot{Docs: m.merge(), ReadTime: r.snap.ReadTime})
+		if m.prev != nil && len(snap.Changes) == 0 {
+			continue
+		}
+		m.prev = snap
+
+		return snap, nil
+	}
+}
+
+func (m *mergedQueryIterator) Stop() {
+	m.cancel()
+}
+
+// merge returns the union of the latest results of each query, sorted and
+// limited as the original query would be.
+func (m *mergedQueryIterator) merge() []BackendDocument {
+	type keyed struct {
+		doc  BackendDocument
+		keys []interface{}
+	}
+
+	seen := make(map[string]bool)
+	docs := make([]keyed, 0)
+	for _, results := range m.latest {
+		for _, d := range results {
+			if seen[d.Path()] {
+				continue
+			}
+			seen[d.Path()] = true
+
+			k := keyed{doc: d, keys: make([]interface{}, len(m.orders))}
+			data := d.Data()
+			for i, o := range m.orders {
+				if o.Path == firestore.DocumentID {
+					continue
+				}
+				v, _ := getField(data, o.Path)
+				k.keys[i], _ = encodeFilterValue(v)
+			}
+			docs = append(docs, k)
+		}
+	}
+
+	sort.Slice(docs, func(i, j int) bool {
+		for n, o := range m.orders {
+			var c int
+			if o.Path == firestore.DocumentID {
+				c = comparePaths(docs[i].doc.Path(), docs[j].doc.Path())
+			} else {
+				c = compareValues(docs[i].keys[n], docs[j].keys[n])
+			}
+			if o.Dir == firestore.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+
+	if n := m.spec.Limit; n > 0 && len(docs) > n {
+		if m.spec.LimitToLast {
+			docs = docs[len(docs)-n:]
+		} else {
+			docs = docs[:n]
+		}
+	}
+
+	merged := make([]BackendDocument, len(docs))
+	for i, k := range docs {
+		merged[i] = k.doc
+	}
+	return merged
+}
@@ -0,0 +1,235 @@
+package fsdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// describeChanges summarizes a snapshot's changes, e.g. "ADDED a -1 0".
+func describeChanges(changes *DBCollectionChanges) string {
+	described := make([]string, len(changes.snap.Changes))
+	for i, c := range changes.snap.Changes {
+		path := c.Doc.Path()
+		kind := strings.TrimPrefix(c.Kind.ToString(), "DBCHANGE_DOC_")
+		described[i] = fmt.Sprintf("%s %s %d %d", kind, path[strings.LastIndex(path, "/")+1:], c.OldIndex, c.NewIndex)
+	}
+	return strings.Join(described, ", ")
+}
+
+func TestCollectionListenFilters(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	errDone := errors.New("done")
+
+	for i, name := range []string{"alice", "bob", "carol", "dave"} {
+		err := db.Add(ctx, "users/"+name, &testUser{Name: name, Age: 20 + i, Tags: []string{name[:1]}})
+		if err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	var got string
+	err := db.CollectionListen(db.log, ctx, "users", func(changes *DBCollectionChanges) error {
+		got = describeChanges(changes)
+		return errDone
+	}, &ListenFilter{Path: "Age", Op: "in", Value: []int{20, 21, 23}}, nil, &ListenFilter{Path: "tags", Op: "array-contains-any", Value: [2]string{"a", "d"}})
+	if err != errDone {
+		t.Fatalf("listen: %v", err)
+	}
+	if got != "ADDED alice -1 0, ADDED dave -1 1" {
+		t.Fatalf("got %s", got)
+	}
+
+	bad := []*ListenFilter{
+		{Path: "Age", Op: "in", Value: 20},
+		{Path: "Age", Op: "not-in", Value: make([]int, MaxNotInValues+1)},
+	}
+	for _, f := range bad {
+		err := db.CollectionListen(db.log, ctx, "users", func(changes *DBCollectionChanges) error {
+			return errDone
+		}, f)
+		if err == nil || err == errDone {
+			t.Fatalf("filter %v: got %v", *f, err)
+		}
+	}
+}
+
+func TestQueryListen(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	errDone := errors.New("done")
+
+	for i, path := range []string{"users/a/posts/1", "users/b/posts/2", "users/b/posts/3", "posts/4"} {
+		err := db.Add(ctx, path, &testUser{Name: path, Age: i})
+		if err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	q := db.QueryGroup("posts").Where("Age", ">", 0).Where("Age", "<", 3).OrderBy("Age", Desc).Limit(1)
+	snaps := 0
+	var got []string
+	err := db.QueryListen(db.log, ctx, q, func(changes *DBCollectionChanges) error {
+		got = append(got, describeChanges(changes))
+		snaps++
+		if snaps == 1 {
+			return db.Update(ctx, "users/b/posts/3", Set("Age", 5))
+		}
+		return errDone
+	})
+	if err != errDone {
+		t.Fatalf("listen: %v", err)
+	}
+	if strings.Join(got, "; ") != "ADDED 3 -1 0; REMOVED 3 0 -1, ADDED 2 -1 0" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestQueryListenSplit(t *testing.T) {
+	ctx := context.Background()
+	db, b := newFlakyDB(t, nil)
+	errDone := errors.New("done")
+
+	ages := make([]int, 40)
+	for i := range ages {
+		ages[i] = i
+		err := db.Add(ctx, fmt.Sprintf("users/u%02d", i), &testUser{Name: "u", Age: i})
+		if err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	q := db.Query("users").Where("Age", "in", ages).OrderBy("Age", Desc).Limit(3)
+	var got []string
+	err := db.QueryListen(db.log, ctx, q, func(changes *DBCollectionChanges) error {
+		got = append(got, describeChanges(changes))
+		switch len(got) {
+		case 1:
+			return db.Update(ctx, "users/u39", Set("Age", 100))
+		case 2:
+			return db.Update(ctx, "users/u05", Set("Age", 38))
+		}
+		return errDone
+	})
+	if err != errDone {
+		t.Fatalf("listen: %v", err)
+	}
+
+	want := []string{
+		"ADDED u39 -1 0, ADDED u38 -1 1, ADDED u37 -1 2",
+		"REMOVED u39 0 -1, ADDED u36 -1 2",
+		"REMOVED u36 2 -1, ADDED u05 -1 1",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if b.listens != 2 {
+		t.Fatalf("%d listeners, want 2", b.listens)
+	}
+}
+
+func TestSplitQuery(t *testing.T) {
+	values := func(n int) []string {
+		v := make([]string, n)
+		for i := range v {
+			v[i] = fmt.Sprint(i)
+		}
+		return v
+	}
+
+	tests := []struct {
+		a, c    int
+		queries int
+	}{
+		{MaxDisjunctionValues + 1, 2*MaxDisjunctionValues + 1, 2 * (2*MaxDisjunctionValues + 1)},
+		{MaxDisjunctionValues + 1, 5, 6},
+		{10, 10, 4},
+		{MaxDisjunctionValues, 1, 0},
+	}
+
+	for _, tc := range tests {
+		spec := &QuerySpec{Collection: "users", Filters: []Filter{
+			PropertyFilter{Path: "a", Op: "in", Value: values(tc.a)},
+			PropertyFilter{Path: "b", Op: "==", Value: 1},
+			PropertyFilter{Path: "c", Op: "array-contains-any", Value: values(tc.c)},
+		}}
+		specs, err := splitQuery(spec)
+		if err != nil {
+			t.Fatalf("%dx%d: split: %v", tc.a, tc.c, err)
+		}
+		if len(specs) != tc.queries {
+			t.Fatalf("%dx%d: split into %d queries, want %d", tc.a, tc.c, len(specs), tc.queries)
+		}
+
+		total := 0
+		for _, s := range specs {
+			a := reflect.ValueOf(s.Filters[0].(PropertyFilter).Value).Len()
+			c := reflect.ValueOf(s.Filters[2].(PropertyFilter).Value).Len()
+			if a*c > MaxDisjunctionValues {
+				t.Fatalf("%dx%d: query with %dx%d disjunctions", tc.a, tc.c, a, c)
+			}
+			total += a * c
+		}
+		if specs != nil && total != tc.a*tc.c {
+			t.Fatalf("%dx%d: split covers %d combinations", tc.a, tc.c, total)
+		}
+		if len(spec.Filters[0].(PropertyFilter).Value.([]string)) != tc.a {
+			t.Fatalf("%dx%d: split modified the query", tc.a, tc.c)
+		}
+	}
+
+	spec := &QuerySpec{Collection: "users", Filters: []Filter{PropertyFilter{Path: "a", Op: "in", Value: values(MaxDisjunctionValues + 1)}}}
+	spec.Offset = 1
+	if _, err := splitQuery(spec); err == nil {
+		t.Fatalf("split a query with an offset")
+	}
+
+	spec.Offset = 0
+	spec.Filters = append(spec.Filters, Or(Where("b", "==", 1), Where("b", "==", 2)))
+	if _, err := splitQuery(spec); err == nil {
+		t.Fatalf("split a query with a composite filter")
+	}
+}
+
+func TestQueryListenSplitCancel(t *testing.T) {
+	db := newTestDB(t)
+
+	ages := make([]int, 2*MaxDisjunctionValues)
+	for i := range ages {
+		ages[i] = i
+	}
+
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- db.CollectionListen(db.log, ctx, "users", func(changes *DBCollectionChanges) error {
+				cancel()
+				return nil
+			}, &ListenFilter{Path: "Age", Op: "in", Value: ages})
+		}()
+
+		select {
+		case err := <-done:
+			if err != context.Canceled {
+				t.Fatalf("run %d: got %v, want %v", i, err, context.Canceled)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("run %d: listener did not return after cancel", i)
+		}
+	}
+
+	it := db.listen(context.Background(), &QuerySpec{Collection: "users", Filters: []Filter{PropertyFilter{Path: "Age", Op: "in", Value: ages}}})
+	if _, err := it.Next(); err != nil {
+		t.Fatalf("next: %v", err)
+	}
+	go it.Stop()
+	if _, err := it.Next(); err != context.Canceled {
+		t.Fatalf("next after stop: got %v", err)
+	}
+}
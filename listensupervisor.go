@@ -0,0 +1,338 @@
+package fsdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tadhunt/logger"
+	"github.com/tadhunt/retry"
+)
+
+// DefaultListenMaxRetries is the number of consecutive failed attempts a
+// supervised listener makes before giving up, if ListenOptions.MaxRetries is
+// not set.
+const DefaultListenMaxRetries = 10
+
+// ListenState is the state of a supervised listener, as reported to
+// ListenOptions.OnStateChange.
+type ListenState int
+
+const (
+	// ListenConnected is reported when the listener receives its first
+	// snapshot, and again after each successful reconnect.
+	ListenConnected ListenState = iota
+
+	// ListenReconnecting is reported when the listener fails with a
+	// retryable error and starts trying to reconnect.
+	ListenReconnecting
+
+	// ListenStopped is reported once, when the listener returns.
+	ListenStopped
+)
+
+func (s ListenState) String() string {
+	switch s {
+	case ListenConnected:
+		return "connected"
+	case ListenReconnecting:
+		return "reconnecting"
+	case ListenStopped:
+		return "stopped"
+	}
+	return fmt.Sprintf("ListenState(%d)", int(s))
+}
+
+// ListenOptions configures a supervised listener. The zero value is usable.
+type ListenOptions struct {
+	// MaxRetries is the number of consecutive failed attempts to listen
+	// before giving up, or 0 for DefaultListenMaxRetries. The count starts
+	// again each time the listener connects.
+	MaxRetries int
+
+	// InitialDelay and MaxDelay bound the backoff between attempts. Zero
+	// values use the defaults of github.com/tadhunt/retry.
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+
+	// Retryable reports whether the listener should reconnect after err.
+	// The default is ErrorIsRetryable.
+	Retryable func(err error) bool
+
+	// OnStateChange, if set, is called on each change of state. err is
+	// the error that caused the listener to reconnect or stop, or nil.
+	OnStateChange func(state ListenState, err error)
+}
+
+// DocListenSupervised is like DocListen, but reconnects with backoff when
+// the listener fails with a retryable error. After a reconnect, the first
+// snapshot is not delivered if the document has not changed since the last
+// one that was, and changes are reported relative to it rather than as
+// DBCHANGE_INITIAL. It returns when ctx is done, handler returns an error, or
+// the listener fails with an error that is not retried.
+//
+// Example:
+//
+//	err := db.DocListenSupervised(ctx, "users", "alice", handler, &fsdb.ListenOptions{
+//		OnStateChange: func(state fsdb.ListenState, err error) { log.Printf("%s: %v", state, err) },
+//	})
+func (db *DBConnection) DocListenSupervised(ctx context.Context, collection string, doc string, handler func(change *DocumentChange) error, opts *ListenOptions) error {
+	var last BackendDocument
+	state := &docListenState{}
+
+	s := newListenSupervisor(db.log, opts)
+	return s.run(ctx, func(ctx context.Context, connected func()) error {
+		it := db.backend.ListenDocument(ctx, collection+"/"+doc)
+		defer it.Stop()
+
+		first := true
+		for {
+			snap, err := it.Next()
+			if err != nil {
+				return err
+			}
+
+			if first {
+				first = false
+				connected()
+				if last != nil && sameDocumentVersion(last, snap) {
+					continue
+				}
+			}
+			last = snap
+
+			change := state.change(snap)
+			if change == nil {
+				continue
+			}
+
+			err = handler(change)
+			if err != nil {
+				return listenHandlerError{err}
+			}
+		}
+	})
+}
+
+// CollectionListenSupervised is like CollectionListen, but reconnects with
+// backoff when the listener fails with a retryable error. After a reconnect,
+// the first snapshot is delivered with its changes computed against the last
+// snapshot that was delivered, rather than reporting every document as
+// added, and not at all if nothing changed. It returns when ctx is done,
+// handler returns an error, or the listener fails with an error that is not
+// retried. If log is nil, the connection's log is used.
+func (db *DBConnection) CollectionListenSupervised(log logger.CompatLogWriter, ctx context.Context, collection string, handler func(changes *DBCollectionChanges) error, filters []*ListenFilter, opts *ListenOptions) error {
+	query, err := listenQuery(collection, filters)
+	if err != nil {
+		return err
+	}
+
+	return db.querySupervised(log, ctx, query, handler, opts)
+}
+
+// QueryListenSupervised is like QueryListen, but reconnects with backoff
+// when the listener fails with a retryable error, as CollectionListenSupervised
+// does. Changes made to q after the call do not affect the listener.
+//
+// Example:
+//
+//	q := db.Query("rooms").Where("open", "==", true).OrderBy("created", fsdb.Desc)
+//	err := db.QueryListenSupervised(log, ctx, q, handler, nil)
+func (db *DBConnection) QueryListenSupervised(log logger.CompatLogWriter, ctx context.Context, q *Query, handler func(changes *DBCollectionChanges) error, opts *ListenOptions) error {
+	if q.tx != nil {
+		return errors.New("listen: query is part of a transaction")
+	}
+
+	query := q.spec
+	err := checkListenFilters(query.Filters)
+	if err != nil {
+		return err
+	}
+
+	return db.querySupervised(log, ctx, &query, handler, opts)
+}
+
+// querySupervised runs a supervised listener on a query.
+func (db *DBConnection) querySupervised(log logger.CompatLogWriter, ctx context.Context, query *QuerySpec, handler func(changes *DBCollectionChanges) error, opts *ListenOptions) error {
+	if log == nil {
+		log = db.log
+	}
+	db.recordQuery(query)
+
+	var last *BackendQuerySnapshot
+
+	s := newListenSupervisor(log, opts)
+	return s.run(ctx, func(ctx context.Context, connected func()) error {
+		it := db.listen(ctx, query)
+		defer it.Stop()
+
+		first := true
+		for {
+			snap, err := it.Next()
+			if err != nil {
+				return err
+			}
+
+			if first {
+				first = false
+				connected()
+				if last != nil {
+					snap = resumedSnapshot(last, snap)
+					if len(snap.Changes) == 0 {
+						last = snap
+						continue
+					}
+				}
+			}
+			last = snap
+
+			err = handler(&DBCollectionChanges{log: log, snap: snap})
+			if err != nil {
+				return listenHandlerError{err}
+			}
+		}
+	})
+}
+
+// listenHandlerError marks an error returned by a listener's handler, which
+// is never retried.
+type listenHandlerError struct {
+	err error
+}
+
+func (e listenHandlerError) Error() string {
+	return e.err.Error()
+}
+
+// errListenReconnect ends a round of retries after a listener that had
+// connected fails, so that the next round starts with a full set of retries.
+var errListenReconnect = errors.New("reconnect")
+
+type listenSupervisor struct {
+	log      logger.CompatLogWriter
+	opts     ListenOptions
+	state    ListenState
+	reported bool
+}
+
+func newListenSupervisor(log logger.CompatLogWriter, opts *ListenOptions) *listenSupervisor {
+	s := &listenSupervisor{log: log}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.MaxRetries <= 0 {
+		s.opts.MaxRetries = DefaultListenMaxRetries
+	}
+	if s.opts.Retryable == nil {
+		s.opts.Retryable = ErrorIsRetryable
+	}
+	return s
+}
+
+// setState reports a change of state. Repeated reports of the same state are
+// dropped.
+func (s *listenSupervisor) setState(state ListenState, err error) {
+	if s.reported && s.state == state {
+		return
+	}
+	s.state = state
+	s.reported = true
+
+	if s.opts.OnStateChange != nil {
+		s.opts.OnStateChange(state, err)
+	}
+}
+
+// run calls session, and calls it again with backoff each time it fails with
+// a retryable error. session calls connected when it receives its first
+// snapshot.
+func (s *listenSupervisor) run(ctx context.Context, session func(ctx context.Context, connected func()) error) (err error) {
+	defer func() {
+		s.setState(ListenStopped, err)
+	}()
+
+	for {
+		retrier := retry.NewRetrier(s.opts.MaxRetries, s.opts.InitialDelay, s.opts.MaxDelay)
+
+		err = retrier.RunContext(ctx, func(ctx context.Context) error {
+			wasConnected := false
+			err := session(ctx, func() {
+				wasConnected = true
+				s.setState(ListenConnected, nil)
+			})
+
+			var herr listenHandlerError
+			if errors.As(err, &herr) {
+				return retry.Stop(herr.err)
+			}
+			if ctx.Err() != nil || !s.opts.Retryable(err) {
+				return retry.Stop(err)
+			}
+
+			s.log.Debugf("listener failed, reconnecting: %v", err)
+			s.setState(ListenReconnecting, err)
+
+			if wasConnected {
+				return retry.Stop(errListenReconnect)
+			}
+			return err
+		})
+
+		if err != errListenReconnect {
+			return err
+		}
+	}
+}
+
+// sameDocumentVersion reports whether two snapshots of a document show the
+// same version of it.
+func sameDocumentVersion(a, b BackendDocument) bool {
+	return a.Exists() == b.Exists() && a.UpdateTime().Equal(b.UpdateTime())
+}
+
+// resumedSnapshot replaces the changes of the first snapshot after a
+// reconnect, which report every document as added, with the changes since
+// prev. Removals come first, with indexes into prev after earlier removals,
+// then additions and modifications. NewIndex is the position in snap, and
+// a modification's OldIndex its position in prev after the removals.
+func resumedSnapshot(prev *BackendQuerySnapshot, snap *BackendQuerySnapshot) *BackendQuerySnapshot {
+	cur := make(map[string]int, len(snap.Docs))
+	for i, d := range snap.Docs {
+		cur[d.Path()] = i
+	}
+
+	changes := make([]BackendDocumentChange, 0)
+	old := make(map[string]BackendDocument, len(prev.Docs))
+	removed := 0
+	for i, d := range prev.Docs {
+		if _, ok := cur[d.Path()]; !ok {
+			changes = append(changes, BackendDocumentChange{Kind: DBCHANGE_DOC_REMOVED, Doc: d, OldIndex: i - removed, NewIndex: -1})
+			removed++
+			continue
+		}
+		old[d.Path()] = d
+	}
+
+	for i, d := range snap.Docs {
+		if _, ok := old[d.Path()]; !ok {
+			changes = append(changes, BackendDocumentChange{Kind: DBCHANGE_DOC_ADDED, Doc: d, OldIndex: -1, NewIndex: i})
+		}
+	}
+
+	kept := 0
+	for _, d := range prev.Docs {
+		if _, ok := old[d.Path()]; !ok {
+			continue
+		}
+		i := cur[d.Path()]
+		if !sameDocumentVersion(d, snap.Docs[i]) {
+			changes = append(changes, BackendDocumentChange{Kind: DBCHANGE_DOC_CHANGED, Doc: snap.Docs[i], OldIndex: kept, NewIndex: i})
+		}
+		kept++
+	}
+
+	resumed := *snap
+	resumed.Changes = changes
+	return &resumed
+}
@@ -0,0 +1,320 @@
+package fsdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tadhunt/logger"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// flakyBackend makes listener n fail with err after it has delivered
+// failAfter[n] snapshots. Listeners past the end of failAfter do not fail.
+// onSnapshot, if set, is called after listener n delivers its count'th
+// snapshot.
+type flakyBackend struct {
+	Backend
+	err        error
+	failAfter  []int
+	onSnapshot func(n int, count int)
+
+	mu      sync.Mutex
+	listens int
+}
+
+func (b *flakyBackend) next() (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := b.listens
+	b.listens++
+	if n < len(b.failAfter) {
+		return n, b.failAfter[n]
+	}
+	return n, -1
+}
+
+func (b *flakyBackend) snapshot(n int, count int) {
+	if b.onSnapshot != nil {
+		b.onSnapshot(n, count)
+	}
+}
+
+func (b *flakyBackend) ListenDocument(ctx context.Context, path string) BackendDocumentIterator {
+	n, failAfter := b.next()
+	return &flakyDocumentIterator{b: b, n: n, failAfter: failAfter, it: b.Backend.ListenDocument(ctx, path)}
+}
+
+func (b *flakyBackend) ListenQuery(ctx context.Context, q *QuerySpec) BackendQueryIterator {
+	n, failAfter := b.next()
+	return &flakyQueryIterator{b: b, n: n, failAfter: failAfter, it: b.Backend.ListenQuery(ctx, q)}
+}
+
+type flakyDocumentIterator struct {
+	b         *flakyBackend
+	n         int
+	failAfter int
+	count     int
+	it        BackendDocumentIterator
+}
+
+func (it *flakyDocumentIterator) Next() (BackendDocument, error) {
+	if it.count == it.failAfter {
+		return nil, it.b.err
+	}
+	doc, err := it.it.Next()
+	if err == nil {
+		it.count++
+		it.b.snapshot(it.n, it.count)
+	}
+	return doc, err
+}
+
+func (it *flakyDocumentIterator) Stop() {
+	it.it.Stop()
+}
+
+type flakyQueryIterator struct {
+	b         *flakyBackend
+	n         int
+	failAfter int
+	count     int
+	it        BackendQueryIterator
+}
+
+func (it *flakyQueryIterator) Next() (*BackendQuerySnapshot, error) {
+	if it.count == it.failAfter {
+		return nil, it.b.err
+	}
+	snap, err := it.it.Next()
+	if err == nil {
+		it.count++
+		it.b.snapshot(it.n, it.count)
+	}
+	return snap, err
+}
+
+func (it *flakyQueryIterator) Stop() {
+	it.it.Stop()
+}
+
+// stateRecorder records the states reported to ListenOptions.OnStateChange.
+type stateRecorder struct {
+	states []string
+}
+
+func (r *stateRecorder) options() *ListenOptions {
+	return &ListenOptions{
+		InitialDelay: time.Millisecond,
+		MaxDelay:     2 * time.Millisecond,
+		OnStateChange: func(state ListenState, err error) {
+			r.states = append(r.states, state.String())
+		},
+	}
+}
+
+func (r *stateRecorder) String() string {
+	return strings.Join(r.states, " ")
+}
+
+func newFlakyDB(t *testing.T, err error, failAfter ...int) (*DBConnection, *flakyBackend) {
+	b := &flakyBackend{Backend: NewMemoryBackend(), err: err, failAfter: failAfter}
+	return NewDBConnectionFromBackend(logger.NewTestCompatLogWriter(t), memoryProject, b), b
+}
+
+func TestDocListenSupervised(t *testing.T) {
+	ctx := context.Background()
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	errDone := errors.New("done")
+
+	db, b := newFlakyDB(t, unavailable, 1, 0, 1)
+	if err := db.Add(ctx, "users/alice", &testUser{Name: "alice", Age: 1}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	update := func(age int) {
+		if err := db.Update(ctx, "users/alice", Set("Age", age)); err != nil {
+			t.Errorf("update: %v", err)
+		}
+	}
+	b.onSnapshot = func(n int, count int) {
+		switch {
+		case n == 0 && count == 1:
+			update(2) // seen first by listener 2
+		case n == 3 && count == 1:
+			update(3) // after listener 3's snapshot of age 2 was dropped
+		}
+	}
+
+	ages := make([]int, 0)
+	rec := &stateRecorder{}
+	err := db.DocListenSupervised(ctx, "users", "alice", func(change *DocumentChange) error {
+		var u testUser
+		if err := change.DataTo(&u); err != nil {
+			return err
+		}
+		ages = append(ages, u.Age)
+		if u.Age == 3 {
+			return errDone
+		}
+		return nil
+	}, rec.options())
+
+	if err != errDone {
+		t.Fatalf("got %v, want the handler's error", err)
+	}
+	if fmt.Sprint(ages) != "[1 2 3]" {
+		t.Fatalf("delivered ages %v, want [1 2 3]", ages)
+	}
+	if rec.String() != "connected reconnecting connected reconnecting connected stopped" {
+		t.Fatalf("states: %s", rec)
+	}
+}
+
+func TestDocListenSupervisedGivesUp(t *testing.T) {
+	ctx := context.Background()
+
+	db, _ := newFlakyDB(t, status.Error(codes.Unavailable, "unavailable"), 0, 0, 0, 0)
+	rec := &stateRecorder{}
+	opts := rec.options()
+	opts.MaxRetries = 3
+
+	err := db.DocListenSupervised(ctx, "users", "alice", func(change *DocumentChange) error {
+		return nil
+	}, opts)
+	if status.Code(err) != codes.Unavailable || rec.String() != "reconnecting stopped" {
+		t.Fatalf("got %v, states %s", err, rec)
+	}
+
+	db, _ = newFlakyDB(t, status.Error(codes.PermissionDenied, "denied"), 1)
+	rec = &stateRecorder{}
+	err = db.DocListenSupervised(ctx, "users", "alice", func(change *DocumentChange) error {
+		return nil
+	}, rec.options())
+	if status.Code(err) != codes.PermissionDenied || rec.String() != "connected stopped" {
+		t.Fatalf("got %v, states %s", err, rec)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	db, _ = newFlakyDB(t, nil)
+	err = db.DocListenSupervised(ctx, "users", "alice", func(change *DocumentChange) error {
+		cancel()
+		return nil
+	}, nil)
+	if !ErrorIsCanceled(err) {
+		t.Fatalf("got %v after cancel", err)
+	}
+}
+
+func TestCollectionListenSupervised(t *testing.T) {
+	ctx := context.Background()
+	errDone := errors.New("done")
+
+	db, b := newFlakyDB(t, status.Error(codes.DeadlineExceeded, "deadline"), 1, 1)
+	for _, name := range []string{"a", "b"} {
+		if err := db.Add(ctx, "users/"+name, &testUser{Name: name}); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	b.onSnapshot = func(n int, count int) {
+		if count != 1 {
+			return
+		}
+
+		var err error
+		switch n {
+		case 0:
+			err = db.Delete(ctx, "users/a")
+			if err == nil {
+				err = db.Update(ctx, "users/b", Set("Age", 2))
+			}
+			if err == nil {
+				err = db.Add(ctx, "users/c", &testUser{Name: "c"})
+			}
+		case 2:
+			err = db.Add(ctx, "users/d", &testUser{Name: "d"})
+		}
+		if err != nil {
+			t.Errorf("write: %v", err)
+		}
+	}
+
+	batches := make([]string, 0)
+	rec := &stateRecorder{}
+	err := db.CollectionListenSupervised(db.log, ctx, "users", func(changes *DBCollectionChanges) error {
+		batch := make([]string, 0)
+		for _, c := range changes.Changes() {
+			batch = append(batch, fmt.Sprintf("%s %s %d %d", c.Kind.ToString(), c.Path[strings.LastIndex(c.Path, "/")+1:],
+				changes.snap.Changes[len(batch)].OldIndex, changes.snap.Changes[len(batch)].NewIndex))
+		}
+		batches = append(batches, strings.Join(batch, ", "))
+		if len(changes.snap.Docs) == 3 {
+			return errDone
+		}
+		return nil
+	}, nil, rec.options())
+
+	if err != errDone {
+		t.Fatalf("got %v, want the handler's error", err)
+	}
+	want := []string{
+		"DBCHANGE_DOC_ADDED a -1 0, DBCHANGE_DOC_ADDED b -1 1",
+		"DBCHANGE_DOC_REMOVED a 0 -1, DBCHANGE_DOC_ADDED c -1 1, DBCHANGE_DOC_CHANGED b 0 0",
+		"DBCHANGE_DOC_ADDED d -1 2",
+	}
+	if strings.Join(batches, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got batches:\n%s\nwant:\n%s", strings.Join(batches, "\n"), strings.Join(want, "\n"))
+	}
+	if rec.String() != "connected reconnecting connected reconnecting connected stopped" {
+		t.Fatalf("states: %s", rec)
+	}
+}
+
+func TestQueryListenSupervised(t *testing.T) {
+	ctx := context.Background()
+	errDone := errors.New("done")
+
+	db, b := newFlakyDB(t, status.Error(codes.Unavailable, "unavailable"), 1)
+	for i, name := range []string{"a", "b", "c"} {
+		if err := db.Add(ctx, "users/"+name, &testUser{Name: name, Age: i + 1}); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	b.onSnapshot = func(n int, count int) {
+		if n == 0 && count == 1 {
+			if err := db.Update(ctx, "users/a", Set("Age", 5)); err != nil {
+				t.Errorf("update: %v", err)
+			}
+		}
+	}
+
+	// A nil log falls back to the connection's.
+	q := db.Query("users").Where("Age", ">", 1).OrderBy("Age", Desc).Limit(2)
+	var got []string
+	err := db.QueryListenSupervised(nil, ctx, q, func(changes *DBCollectionChanges) error {
+		got = append(got, describeChanges(changes))
+		if len(got) == 2 {
+			return errDone
+		}
+		return nil
+	}, &ListenOptions{InitialDelay: time.Millisecond})
+
+	if err != errDone {
+		t.Fatalf("got %v, want the handler's error", err)
+	}
+	want := []string{
+		"ADDED c -1 0, ADDED b -1 1",
+		"REMOVED b 1 -1, ADDED a -1 0",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
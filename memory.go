@@ -0,0 +1,1240 @@
+package fsdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/tadhunt/logger"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// memoryProject is the project ID reported in the resource names of documents in a memory backend.
+const memoryProject = "fsdb-memory"
+
+// memoryTransactionAttempts matches firestore.DefaultTransactionMaxAttempts.
+const memoryTransactionAttempts = 5
+
+var errReadAfterWrite = errors.New("fsdb: read after write in transaction")
+
+// memDoc is a stored document. memDocs are never modified once stored; a
+// write replaces the document with a new memDoc.
+type memDoc struct {
+	path       string
+	fields     map[string]interface{}
+	createTime time.Time
+	updateTime time.Time
+	version    int64
+}
+
+// memoryBackend is a Backend that keeps documents in process memory, with
+// the semantics of Cloud Firestore. It is intended for tests.
+type memoryBackend struct {
+	mu        sync.Mutex
+	root      string
+	docs      map[string]*memDoc
+	version   int64
+	lastTime  time.Time
+	listeners map[*memListener]struct{}
+}
+
+// NewMemoryBackend returns an empty in-process Backend.
+func NewMemoryBackend() Backend {
+	return &memoryBackend{
+		root:      "projects/" + memoryProject + "/databases/(default)/documents",
+		docs:      make(map[string]*memDoc),
+		listeners: make(map[*memListener]struct{}),
+	}
+}
+
+// NewMemoryDBConnection returns a DBConnection backed by an empty in-process store.
+func NewMemoryDBConnection(log logger.CompatLogWriter) *DBConnection {
+	return NewDBConnectionFromBackend(log, memoryProject, NewMemoryBackend())
+}
+
+func (b *memoryBackend) Get(ctx context.Context, path string) (BackendDocument, error) {
+	if err := checkDocPath(path); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	d := b.docs[path]
+	if d == nil {
+		return nil, status.Errorf(codes.NotFound, "%q not found", b.name(path))
+	}
+
+	return b.document(path, d), nil
+}
+
+func (b *memoryBackend) Create(ctx context.Context, path string, dval interface{}) error {
+	w, err := newMemWrite(memWriteCreate, path, dval)
+	if err != nil {
+		return err
+	}
+
+	return b.commit(nil, []*memWrite{w})
+}
+
+func (b *memoryBackend) Set(ctx context.Context, path string, dval interface{}) error {
+	w, err := newMemWrite(memWriteSet, path, dval)
+	if err != nil {
+		return err
+	}
+
+	return b.commit(nil, []*memWrite{w})
+}
+
+func (b *memoryBackend) SetMerge(ctx context.Context, path string, dval interface{}, fields []string) error {
+	w, err := newMemMerge(path, dval, fields)
+	if err != nil {
+		return err
+	}
+
+	return b.commit(nil, []*memWrite{w})
+}
+
+func (b *memoryBackend) Update(ctx context.Context, path string, updates []FieldUpdate, preconds ...Precondition) error {
+	w, err := newMemUpdate(path, updates)
+	if err != nil {
+		return err
+	}
+
+	err = w.precondition(preconds)
+	if err != nil {
+		return err
+	}
+
+	return b.commit(nil, []*memWrite{w})
+}
+
+func (b *memoryBackend) Delete(ctx context.Context, path string, preconds ...Precondition) error {
+	w, err := newMemWrite(memWriteDelete, path, nil)
+	if err != nil {
+		return err
+	}
+
+	err = w.precondition(preconds)
+	if err != nil {
+		return err
+	}
+
+	return b.commit(nil, []*memWrite{w})
+}
+
+func (b *memoryBackend) Documents(ctx context.Context, q *QuerySpec) BackendDocumentIterator {
+	docs, _, err := b.query(q)
+	if err != nil {
+		return &errorDocumentIterator{err}
+	}
+
+	return &sliceIterator{docs: docs}
+}
+
+func (b *memoryBackend) Collections(ctx context.Context, path string) BackendCollectionIterator {
+	if err := checkDocPath(path); err != nil {
+		return &errorCollectionIterator{err}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return &memCollectionIterator{names: b.children(path + "/")}
+}
+
+// children returns the sorted names of the paths directly below prefix that
+// have at least one document at or below them. b.mu must be held.
+func (b *memoryBackend) children(prefix string) []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for p := range b.docs {
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		id, _, _ := strings.Cut(p[len(prefix):], "/")
+		if !seen[id] {
+			seen[id] = true
+			names = append(names, b.name(prefix+id))
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (b *memoryBackend) DocumentRefs(ctx context.Context, path string) BackendCollectionIterator {
+	if len(splitPath(path))%2 != 1 {
+		return &errorCollectionIterator{status.Errorf(codes.InvalidArgument, "nil collection: bad path '%s'?", path)}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return &memCollectionIterator{names: b.children(path + "/")}
+}
+
+func (b *memoryBackend) Aggregate(ctx context.Context, q *QuerySpec, aggs []Aggregation) (AggregationResult, error) {
+	if err := checkAggregations(aggs); err != nil {
+		return nil, err
+	}
+
+	_, results, err := b.query(q)
+	if err != nil {
+		return nil, err
+	}
+
+	return aggregate(results, aggs), nil
+}
+
+// Explain reports no indexes, since the memory backend scans every document
+// for every query.
+func (b *memoryBackend) Explain(ctx context.Context, q *QuerySpec, analyze bool) (*Explanation, error) {
+	mq, err := newMemQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Explanation{}
+	if !analyze {
+		return e, nil
+	}
+
+	start := time.Now()
+	b.mu.Lock()
+	scanned := len(b.docs)
+	results := mq.run(b.docs)
+	b.mu.Unlock()
+
+	e.Stats = &ExecutionStats{
+		ResultsReturned:   int64(len(results)),
+		ReadOperations:    int64(max(len(results), 1)),
+		DocumentsScanned:  int64(scanned),
+		ExecutionDuration: time.Since(start),
+	}
+	e.Stats.DebugStats = map[string]interface{}{
+		"documents_scanned": strconv.FormatInt(e.Stats.DocumentsScanned, 10),
+	}
+
+	return e, nil
+}
+
+func (b *memoryBackend) RunTransaction(ctx context.Context, f func(ctx context.Context, tx BackendTransaction) error) error {
+	var err error
+
+	for attempt := 0; attempt < memoryTransactionAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return status.FromContextError(ctx.Err()).Err()
+			case <-time.After(time.Duration(attempt) * time.Millisecond):
+			}
+		}
+
+		tx := &memoryTransaction{
+			b:     b,
+			reads: make(map[string]int64),
+		}
+
+		err = f(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		err = b.commit(tx, tx.writes)
+		if status.Code(err) != codes.Aborted {
+			return err
+		}
+	}
+
+	return err
+}
+
+func (b *memoryBackend) ListenDocument(ctx context.Context, path string) BackendDocumentIterator {
+	if err := checkDocPath(path); err != nil {
+		return &errorDocumentIterator{err}
+	}
+
+	return &memDocumentListener{l: b.listen(ctx), path: path}
+}
+
+func (b *memoryBackend) ListenQuery(ctx context.Context, q *QuerySpec) BackendQueryIterator {
+	mq, err := newMemQuery(q)
+	if err != nil {
+		return &errorQueryIterator{err}
+	}
+
+	return &memQueryListener{l: b.listen(ctx), q: mq}
+}
+
+// name returns the full resource name of a document or collection.
+func (b *memoryBackend) name(path string) string {
+	return b.root + "/" + path
+}
+
+func (b *memoryBackend) document(path string, d *memDoc) *memDocument {
+	return &memDocument{
+		name:     b.name(path),
+		doc:      d,
+		readTime: normalizeTime(time.Now()),
+	}
+}
+
+// query evaluates a query, returning the results and the underlying stored documents.
+func (b *memoryBackend) query(q *QuerySpec) ([]BackendDocument, []*memDoc, error) {
+	mq, err := newMemQuery(q)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b.mu.Lock()
+	results := mq.run(b.docs)
+	b.mu.Unlock()
+
+	docs := make([]BackendDocument, len(results))
+	for i, d := range results {
+		docs[i] = b.document(d.path, d)
+	}
+
+	return docs, results, nil
+}
+
+// commitTime returns a commit timestamp later than any previous one. b.mu must be held.
+func (b *memoryBackend) commitTime() time.Time {
+	t := normalizeTime(time.Now())
+	if !t.After(b.lastTime) {
+		t = b.lastTime.Add(time.Microsecond)
+	}
+	b.lastTime = t
+	return t
+}
+
+// commit atomically applies a set of writes. If tx is non-nil, its reads are
+// validated first and an Aborted error is returned if any have changed.
+func (b *memoryBackend) commit(tx *memoryTransaction, writes []*memWrite) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if tx != nil {
+		err := tx.validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Check preconditions before applying anything, so a failed commit has no effect.
+	exists := make(map[string]bool)
+	for _, w := range writes {
+		if _, ok := exists[w.path]; !ok {
+			exists[w.path] = b.docs[w.path] != nil
+		}
+		if w.pre != nil {
+			if !exists[w.path] {
+				if w.pre.exists {
+					return status.Errorf(codes.NotFound, "No document to update: %s", b.name(w.path))
+				}
+				return status.Errorf(codes.FailedPrecondition, "the stored version of %s does not match the required base version", b.name(w.path))
+			}
+			if !w.pre.exists && !b.docs[w.path].updateTime.Equal(w.pre.updateTime) {
+				return status.Errorf(codes.FailedPrecondition, "the stored version of %s does not match the required base version", b.name(w.path))
+			}
+		}
+		switch w.op {
+		case memWriteCreate:
+			if exists[w.path] {
+				return status.Errorf(codes.AlreadyExists, "Document already exists: %s", b.name(w.path))
+			}
+			exists[w.path] = true
+		case memWriteSet, memWriteMerge:
+			exists[w.path] = true
+		case memWriteUpdate:
+			if !exists[w.path] {
+				return status.Errorf(codes.NotFound, "No document to update: %s", b.name(w.path))
+			}
+		case memWriteDelete:
+			exists[w.path] = false
+		}
+	}
+
+	if len(writes) == 0 {
+		return nil
+	}
+
+	now := b.commitTime()
+	b.version++
+
+	for _, w := range writes {
+		old := b.docs[w.path]
+
+		if w.op == memWriteDelete {
+			delete(b.docs, w.path)
+			continue
+		}
+
+		fields := w.fields
+		if w.op == memWriteUpdate || w.op == memWriteMerge {
+			fields = map[string]interface{}{}
+			if old != nil {
+				fields = old.fields
+			}
+		}
+
+		d := &memDoc{
+			path:       w.path,
+			fields:     copyFields(fields),
+			createTime: now,
+			updateTime: now,
+			version:    b.version,
+		}
+		if old != nil {
+			d.createTime = old.createTime
+		}
+		for _, m := range w.mask {
+			if v, ok := lookupField(w.fields, m); ok {
+				setField(d.fields, m, copyValue(v))
+			}
+		}
+		for _, u := range w.updates {
+			u.apply(d.fields)
+		}
+		for _, stamp := range w.stamps {
+			setField(d.fields, stamp, now)
+		}
+
+		b.docs[w.path] = d
+	}
+
+	b.notify()
+
+	return nil
+}
+
+// notify wakes every listener. b.mu must be held.
+func (b *memoryBackend) notify() {
+	for l := range b.listeners {
+		select {
+		case l.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func checkDocPath(path string) error {
+	if !isDocPath(path) {
+		return status.Errorf(codes.InvalidArgument, "nil dref: bad docname '%s'?", path)
+	}
+	return nil
+}
+
+type memWriteOp int
+
+const (
+	memWriteCreate memWriteOp = iota
+	memWriteSet
+	memWriteMerge
+	memWriteUpdate
+	memWriteDelete
+)
+
+type memWrite struct {
+	op      memWriteOp
+	path    string
+	fields  map[string]interface{}
+	mask    [][]string
+	updates []memFieldUpdate
+	stamps  [][]string
+	pre     *Precondition
+}
+
+// precondition sets the write's precondition, if there is one.
+func (w *memWrite) precondition(preconds []Precondition) error {
+	switch len(preconds) {
+	case 0:
+		return nil
+	case 1:
+		w.pre = &preconds[0]
+		return nil
+	}
+	return status.Errorf(codes.InvalidArgument, "fsdb: at most one precondition allowed")
+}
+
+// memFieldUpdate is an encoded FieldUpdate.
+type memFieldUpdate struct {
+	path      []string
+	value     interface{}
+	transform fieldTransform
+	delete    bool
+}
+
+// apply makes the update to a document's fields.
+func (u *memFieldUpdate) apply(fields map[string]interface{}) {
+	if u.delete {
+		deleteField(fields, u.path)
+		return
+	}
+
+	cur, _ := lookupField(fields, u.path)
+
+	switch u.transform {
+	case transformIncrement:
+		setField(fields, u.path, increment(cur, u.value))
+	case transformArrayUnion:
+		a, _ := cur.([]interface{})
+		a = copyValue(a).([]interface{})
+		for _, e := range u.value.([]interface{}) {
+			if !containsValue(a, e) {
+				a = append(a, copyValue(e))
+			}
+		}
+		setField(fields, u.path, a)
+	case transformArrayRemove:
+		a, _ := cur.([]interface{})
+		kept := make([]interface{}, 0, len(a))
+		for _, e := range a {
+			if !containsValue(u.value.([]interface{}), e) {
+				kept = append(kept, e)
+			}
+		}
+		setField(fields, u.path, kept)
+	default:
+		setField(fields, u.path, copyValue(u.value))
+	}
+}
+
+// increment adds n to a stored value. A value that is not a number is
+// replaced by n; an integer becomes a double if n is one.
+func increment(v interface{}, n interface{}) interface{} {
+	switch x := v.(type) {
+	case int64:
+		switch y := n.(type) {
+		case int64:
+			sum := x + y
+			// Firestore saturates rather than overflowing.
+			if y > 0 && sum < x {
+				return int64(math.MaxInt64)
+			}
+			if y < 0 && sum > x {
+				return int64(math.MinInt64)
+			}
+			return sum
+		case float64:
+			return float64(x) + y
+		}
+	case float64:
+		switch y := n.(type) {
+		case int64:
+			return x + float64(y)
+		case float64:
+			return x + y
+		}
+	}
+	return n
+}
+
+func newMemWrite(op memWriteOp, path string, dval interface{}) (*memWrite, error) {
+	if err := checkDocPath(path); err != nil {
+		return nil, err
+	}
+
+	w := &memWrite{
+		op:   op,
+		path: path,
+	}
+
+	if op != memWriteDelete {
+		var err error
+		w.fields, w.stamps, err = encodeDocument(dval)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
+
+	return w, nil
+}
+
+func newMemUpdate(path string, updates []FieldUpdate) (*memWrite, error) {
+	if err := checkDocPath(path); err != nil {
+		return nil, err
+	}
+	if len(updates) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "fsdb: no field updates for %s", path)
+	}
+
+	w := &memWrite{
+		op:   memWriteUpdate,
+		path: path,
+	}
+
+	seen := make(map[string]bool)
+	for _, u := range updates {
+		fpath := strings.Split(u.Path, ".")
+		for _, name := range fpath {
+			if name == "" {
+				return nil, status.Errorf(codes.InvalidArgument, "fsdb: bad field path %q", u.Path)
+			}
+		}
+		for prefix := range seen {
+			if prefix == u.Path || strings.HasPrefix(prefix, u.Path+".") || strings.HasPrefix(u.Path, prefix+".") {
+				return nil, status.Errorf(codes.InvalidArgument, "fsdb: field path %q conflicts with %q", u.Path, prefix)
+			}
+		}
+		seen[u.Path] = true
+
+		switch u.transform {
+		case transformIncrement:
+			v, err := encodeFilterValue(u.Value)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+			}
+			switch v.(type) {
+			case int64, float64:
+			default:
+				return nil, status.Errorf(codes.InvalidArgument, "fsdb: Increment of %q by %T, not a number", u.Path, u.Value)
+			}
+			w.updates = append(w.updates, memFieldUpdate{path: fpath, value: v, transform: u.transform})
+			continue
+		case transformArrayUnion, transformArrayRemove:
+			v, err := encodeFilterValue(u.Value)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+			}
+			w.updates = append(w.updates, memFieldUpdate{path: fpath, value: v, transform: u.transform})
+			continue
+		}
+
+		if u.Value == firestore.Delete {
+			w.updates = append(w.updates, memFieldUpdate{path: fpath, delete: true})
+			continue
+		}
+
+		stamps := make([][]string, 0)
+		v, omit, err := encodeValue(reflect.ValueOf(u.Value), fpath, &stamps)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		w.stamps = append(w.stamps, stamps...)
+		if !omit {
+			w.updates = append(w.updates, memFieldUpdate{path: fpath, value: v})
+		}
+	}
+
+	return w, nil
+}
+
+func newMemMerge(path string, dval interface{}, fields []string) (*memWrite, error) {
+	w, err := newMemWrite(memWriteMerge, path, dval)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fields) == 0 {
+		v := reflect.ValueOf(dval)
+		for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+			v = v.Elem()
+		}
+		if v.Kind() != reflect.Map {
+			return nil, status.Errorf(codes.InvalidArgument, "fsdb: MergeAll can only be specified with map data")
+		}
+		w.mask = leafPaths(w.fields, nil)
+		return w, nil
+	}
+
+	stamps := w.stamps
+	w.stamps = nil
+	for _, f := range fields {
+		fpath := strings.Split(f, ".")
+		_, ok := lookupField(w.fields, fpath)
+		stamped := false
+		for _, stamp := range stamps {
+			if hasPathPrefix(stamp, fpath) {
+				w.stamps = append(w.stamps, stamp)
+				stamped = true
+			}
+		}
+		if !ok && !stamped {
+			return nil, status.Errorf(codes.InvalidArgument, "fsdb: field %q is not in the data", f)
+		}
+		if ok {
+			w.mask = append(w.mask, fpath)
+		}
+	}
+
+	return w, nil
+}
+
+// leafPaths returns the paths of every value in fields that is not a
+// non-empty map.
+func leafPaths(fields map[string]interface{}, prefix []string) [][]string {
+	paths := make([][]string, 0)
+	for _, k := range sortedKeys(fields) {
+		path := appendPath(prefix, k)
+		if m, ok := fields[k].(map[string]interface{}); ok && len(m) > 0 {
+			paths = append(paths, leafPaths(m, path)...)
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func hasPathPrefix(path, prefix []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i, name := range prefix {
+		if path[i] != name {
+			return false
+		}
+	}
+	return true
+}
+
+// memoryTransaction buffers writes until commit, and records what it read so
+// the commit can detect conflicting writes by other transactions.
+type memoryTransaction struct {
+	b       *memoryBackend
+	reads   map[string]int64
+	queries []*memQueryRead
+	writes  []*memWrite
+}
+
+// memQueryRead records the results of a query read in a transaction.
+type memQueryRead struct {
+	spec     *QuerySpec
+	paths    []string
+	versions []int64
+}
+
+func (t *memoryTransaction) Get(path string) (BackendDocument, error) {
+	if len(t.writes) > 0 {
+		return nil, errReadAfterWrite
+	}
+	if err := checkDocPath(path); err != nil {
+		return nil, err
+	}
+
+	t.b.mu.Lock()
+	d := t.b.docs[path]
+	t.b.mu.Unlock()
+
+	if d == nil {
+		t.reads[path] = 0
+		return nil, status.Errorf(codes.NotFound, "%q not found", t.b.name(path))
+	}
+
+	t.reads[path] = d.version
+
+	return t.b.document(path, d), nil
+}
+
+func (t *memoryTransaction) Documents(q *QuerySpec) BackendDocumentIterator {
+	if len(t.writes) > 0 {
+		return &errorDocumentIterator{errReadAfterWrite}
+	}
+
+	docs, results, err := t.b.query(q)
+	if err != nil {
+		return &errorDocumentIterator{err}
+	}
+
+	t.recordQuery(q, results)
+
+	return &sliceIterator{docs: docs}
+}
+
+func (t *memoryTransaction) Aggregate(q *QuerySpec, aggs []Aggregation) (AggregationResult, error) {
+	if len(t.writes) > 0 {
+		return nil, errReadAfterWrite
+	}
+	if err := checkAggregations(aggs); err != nil {
+		return nil, err
+	}
+
+	_, results, err := t.b.query(q)
+	if err != nil {
+		return nil, err
+	}
+
+	t.recordQuery(q, results)
+
+	return aggregate(results, aggs), nil
+}
+
+// recordQuery records the results of a query so the commit can check they have not changed.
+func (t *memoryTransaction) recordQuery(q *QuerySpec, results []*memDoc) {
+	read := &memQueryRead{spec: q}
+	for _, d := range results {
+		read.paths = append(read.paths, d.path)
+		read.versions = append(read.versions, d.version)
+	}
+	t.queries = append(t.queries, read)
+}
+
+func (t *memoryTransaction) Create(path string, dval interface{}) error {
+	return t.write(memWriteCreate, path, dval)
+}
+
+func (t *memoryTransaction) Set(path string, dval interface{}) error {
+	return t.write(memWriteSet, path, dval)
+}
+
+func (t *memoryTransaction) SetMerge(path string, dval interface{}, fields []string) error {
+	w, err := newMemMerge(path, dval, fields)
+	if err != nil {
+		return err
+	}
+
+	t.writes = append(t.writes, w)
+
+	return nil
+}
+
+func (t *memoryTransaction) Update(path string, updates []FieldUpdate) error {
+	w, err := newMemUpdate(path, updates)
+	if err != nil {
+		return err
+	}
+
+	t.writes = append(t.writes, w)
+
+	return nil
+}
+
+func (t *memoryTransaction) Delete(path string) error {
+	return t.write(memWriteDelete, path, nil)
+}
+
+func (t *memoryTransaction) write(op memWriteOp, path string, dval interface{}) error {
+	w, err := newMemWrite(op, path, dval)
+	if err != nil {
+		return err
+	}
+
+	t.writes = append(t.writes, w)
+
+	return nil
+}
+
+// validate checks that nothing the transaction read has changed. t.b.mu must be held.
+func (t *memoryTransaction) validate() error {
+	aborted := status.Errorf(codes.Aborted, "transaction aborted due to contention")
+
+	for path, version := range t.reads {
+		d := t.b.docs[path]
+		if (d == nil && version != 0) || (d != nil && d.version != version) {
+			return aborted
+		}
+	}
+
+	for _, read := range t.queries {
+		mq, err := newMemQuery(read.spec)
+		if err != nil {
+			return err
+		}
+		results := mq.run(t.b.docs)
+		if len(results) != len(read.paths) {
+			return aborted
+		}
+		for i, d := range results {
+			if d.path != read.paths[i] || d.version != read.versions[i] {
+				return aborted
+			}
+		}
+	}
+
+	return nil
+}
+
+// memDocument is a BackendDocument read from the memory backend.
+type memDocument struct {
+	name     string
+	doc      *memDoc
+	readTime time.Time
+}
+
+func (d *memDocument) Path() string {
+	return d.name
+}
+
+func (d *memDocument) Exists() bool {
+	return d.doc != nil
+}
+
+func (d *memDocument) Data() map[string]interface{} {
+	if d.doc == nil {
+		return nil
+	}
+	return copyFields(d.doc.fields)
+}
+
+func (d *memDocument) DataTo(dval interface{}) error {
+	if d.doc == nil {
+		return status.Errorf(codes.NotFound, "document %s does not exist", d.name)
+	}
+	return decodeDocument(d.doc.fields, dval)
+}
+
+func (d *memDocument) CreateTime() time.Time {
+	if d.doc == nil {
+		return time.Time{}
+	}
+	return d.doc.createTime
+}
+
+func (d *memDocument) UpdateTime() time.Time {
+	if d.doc == nil {
+		return time.Time{}
+	}
+	return d.doc.updateTime
+}
+
+func (d *memDocument) ReadTime() time.Time {
+	return d.readTime
+}
+
+// project returns a copy of the document holding only the given fields.
+func (d *memDoc) project(fields []string) *memDoc {
+	p := *d
+	p.fields = make(map[string]interface{})
+	for _, f := range fields {
+		v, ok := getField(d.fields, f)
+		if ok {
+			setField(p.fields, strings.Split(f, "."), copyValue(v))
+		}
+	}
+	return &p
+}
+
+type memCollectionIterator struct {
+	names []string
+}
+
+func (it *memCollectionIterator) Next() (string, error) {
+	if len(it.names) == 0 {
+		return "", DBIteratorDone
+	}
+
+	name := it.names[0]
+	it.names = it.names[1:]
+
+	return name, nil
+}
+
+// memListener is registered with the backend to be woken after every commit.
+type memListener struct {
+	b    *memoryBackend
+	ctx  context.Context
+	wake chan struct{}
+	once sync.Once
+	done chan struct{}
+}
+
+func (b *memoryBackend) listen(ctx context.Context) *memListener {
+	l := &memListener{
+		b:    b,
+		ctx:  ctx,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	b.listeners[l] = struct{}{}
+	b.mu.Unlock()
+
+	return l
+}
+
+// wait blocks until the next commit, the context is done, or the listener is stopped.
+func (l *memListener) wait() error {
+	select {
+	case <-l.wake:
+		return nil
+	case <-l.done:
+		return DBIteratorDone
+	case <-l.ctx.Done():
+		return status.FromContextError(l.ctx.Err()).Err()
+	}
+}
+
+func (l *memListener) stop() {
+	l.once.Do(func() {
+		l.b.mu.Lock()
+		delete(l.b.listeners, l)
+		l.b.mu.Unlock()
+		close(l.done)
+	})
+}
+
+// memDocumentListener delivers a snapshot of a document each time it changes.
+type memDocumentListener struct {
+	l       *memListener
+	path    string
+	started bool
+	version int64
+}
+
+func (it *memDocumentListener) Next() (BackendDocument, error) {
+	for {
+		if it.started {
+			err := it.l.wait()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		it.l.b.mu.Lock()
+		d := it.l.b.docs[it.path]
+		it.l.b.mu.Unlock()
+
+		var version int64
+		if d != nil {
+			version = d.version
+		}
+
+		if it.started && version == it.version {
+			continue
+		}
+
+		it.started = true
+		it.version = version
+
+		return it.l.b.document(it.path, d), nil
+	}
+}
+
+func (it *memDocumentListener) Stop() {
+	it.l.stop()
+}
+
+// memQueryListener delivers a snapshot of a query's results each time they change.
+type memQueryListener struct {
+	l       *memListener
+	q       *memQuery
+	started bool
+	prev    []*memDoc
+}
+
+func (it *memQueryListener) Next() (*BackendQuerySnapshot, error) {
+	for {
+		if it.started {
+			err := it.l.wait()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		it.l.b.mu.Lock()
+		results := it.q.run(it.l.b.docs)
+		it.l.b.mu.Unlock()
+
+		changes := it.diff(results)
+		if it.started && len(changes) == 0 {
+			continue
+		}
+
+		it.started = true
+		it.prev = results
+
+		snap := &BackendQuerySnapshot{
+			Docs:     make([]BackendDocument, len(results)),
+			Changes:  changes,
+			ReadTime: normalizeTime(time.Now()),
+		}
+		for i, d := range results {
+			snap.Docs[i] = it.l.b.document(d.path, d)
+		}
+
+		return snap, nil
+	}
+}
+
+func (it *memQueryListener) Stop() {
+	it.l.stop()
+}
+
+// diff computes the changes from the previous results to the current ones.
+// As with Firestore, removals are reported first, then additions, then
+// modifications, and each change's indexes reflect the changes before it.
+func (it *memQueryListener) diff(results []*memDoc) []BackendDocumentChange {
+	changes := make([]BackendDocumentChange, 0)
+
+	cur := make(map[string]*memDoc, len(results))
+	for _, d := range results {
+		cur[d.path] = d
+	}
+	prev := make(map[string]*memDoc, len(it.prev))
+	for _, d := range it.prev {
+		prev[d.path] = d
+	}
+
+	working := append([]*memDoc(nil), it.prev...)
+
+	indexOf := func(path string) int {
+		for i, d := range working {
+			if d.path == path {
+				return i
+			}
+		}
+		return -1
+	}
+	insert := func(d *memDoc) int {
+		i := sort.Search(len(working), func(i int) bool {
+			return it.q.compare(working[i], d) > 0
+		})
+		working = append(working, nil)
+		copy(working[i+1:], working[i:])
+		working[i] = d
+		return i
+	}
+	remove := func(i int) {
+		working = append(working[:i], working[i+1:]...)
+	}
+
+	for _, d := range it.prev {
+		if cur[d.path] == nil {
+			i := indexOf(d.path)
+			remove(i)
+			changes = append(changes, BackendDocumentChange{
+				Kind:     DBCHANGE_DOC_REMOVED,
+				Doc:      it.l.b.document(d.path, d),
+				OldIndex: i,
+				NewIndex: -1,
+			})
+		}
+	}
+
+	for _, d := range results {
+		if prev[d.path] == nil {
+			i := insert(d)
+			changes = append(changes, BackendDocumentChange{
+				Kind:     DBCHANGE_DOC_ADDED,
+				Doc:      it.l.b.document(d.path, d),
+				OldIndex: -1,
+				NewIndex: i,
+			})
+		}
+	}
+
+	for _, d := range results {
+		old := prev[d.path]
+		if old == nil || old.version == d.version {
+			continue
+		}
+		i := indexOf(d.path)
+		remove(i)
+		j := insert(d)
+		changes = append(changes, BackendDocumentChange{
+			Kind:     DBCHANGE_DOC_CHANGED,
+			Doc:      it.l.b.document(d.path, d),
+			OldIndex: i,
+			NewIndex: j,
+		})
+	}
+
+	return changes
+}
+
+func (b *memoryBackend) BulkWriter(ctx context.Context) BackendBulkWriter {
+	return &memBulkWriter{
+		b:       b,
+		ctx:     ctx,
+		written: make(map[string]bool),
+	}
+}
+
+// memBulkWriter queues writes and applies each one individually when flushed.
+type memBulkWriter struct {
+	b       *memoryBackend
+	ctx     context.Context
+	mu      sync.Mutex
+	closed  bool
+	written map[string]bool
+	pending []*memWriteJob
+}
+
+type memWriteJob struct {
+	w    *memWrite
+	done chan struct{} // closed once the write has been applied
+	err  error
+}
+
+func (bw *memBulkWriter) Create(path string, dval interface{}) (BackendWriteJob, error) {
+	return bw.queue(newMemWrite(memWriteCreate, path, dval))
+}
+
+func (bw *memBulkWriter) Set(path string, dval interface{}) (BackendWriteJob, error) {
+	return bw.queue(newMemWrite(memWriteSet, path, dval))
+}
+
+func (bw *memBulkWriter) Update(path string, updates []FieldUpdate) (BackendWriteJob, error) {
+	return bw.queue(newMemUpdate(path, updates))
+}
+
+func (bw *memBulkWriter) Delete(path string) (BackendWriteJob, error) {
+	return bw.queue(newMemWrite(memWriteDelete, path, nil))
+}
+
+func (bw *memBulkWriter) queue(w *memWrite, err error) (BackendWriteJob, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+
+	if bw.closed {
+		return nil, errors.New("fsdb: BulkWriter has been closed")
+	}
+	if bw.written[w.path] {
+		return nil, fmt.Errorf("fsdb: BulkWriter received duplicate write for path: %s", w.path)
+	}
+	bw.written[w.path] = true
+
+	job := &memWriteJob{w: w, done: make(chan struct{})}
+	bw.pending = append(bw.pending, job)
+
+	return job, nil
+}
+
+func (bw *memBulkWriter) Flush() {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+
+	bw.flush()
+}
+
+// flush applies the pending writes. bw.mu must be held.
+func (bw *memBulkWriter) flush() {
+	for _, job := range bw.pending {
+		job.err = bw.ctx.Err()
+		if job.err == nil {
+			job.err = bw.b.commit(nil, []*memWrite{job.w})
+		}
+		close(job.done)
+	}
+	bw.pending = nil
+}
+
+func (bw *memBulkWriter) End() {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+
+	bw.flush()
+	bw.closed = true
+}
+
+// Result waits for the writer to be flushed. As with Firestore, a write is
+// not sent until Flush or End is called, so Result blocks until then.
+func (j *memWriteJob) Result() error {
+	<-j.done
+	return j.err
+}
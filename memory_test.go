@@ -0,0 +1,442 @@
+package fsdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tadhunt/logger"
+)
+
+type testUser struct {
+	Name    string
+	Age     int
+	Tags    []string  `firestore:"tags,omitempty"`
+	Created time.Time `firestore:"created,serverTimestamp"`
+}
+
+func newTestDB(t *testing.T) *DBConnection {
+	return NewMemoryDBConnection(logger.NewTestCompatLogWriter(t))
+}
+
+func TestMemoryAddGet(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	err := db.Add(ctx, "users/alice", &testUser{Name: "alice", Age: 30, Tags: []string{"a", "b"}})
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	err = db.Add(ctx, "users/alice", &testUser{Name: "alice"})
+	if !ErrorIsAlreadyExists(err) {
+		t.Fatalf("second add: expected AlreadyExists, got %v", err)
+	}
+
+	u := &testUser{}
+	err = db.Get(ctx, "users/alice", u)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if u.Name != "alice" || u.Age != 30 || len(u.Tags) != 2 || u.Tags[1] != "b" {
+		t.Fatalf("get: unexpected %#v", u)
+	}
+	if u.Created.IsZero() {
+		t.Fatalf("get: serverTimestamp field not set")
+	}
+
+	err = db.Get(ctx, "users/bob", u)
+	if !ErrorIsNotFound(err) {
+		t.Fatalf("get missing: expected NotFound, got %v", err)
+	}
+
+	err = db.Add(ctx, "users", u)
+	if err == nil {
+		t.Fatalf("add with collection path: expected error")
+	}
+
+	err = db.AddOrReplace(ctx, "users/alice", map[string]interface{}{"Name": "alice2"})
+	if err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+
+	m := map[string]interface{}{}
+	err = db.Get(ctx, "users/alice", &m)
+	if err != nil {
+		t.Fatalf("get map: %v", err)
+	}
+	if len(m) != 1 || m["Name"] != "alice2" {
+		t.Fatalf("replace did not replace the whole document: %#v", m)
+	}
+
+	err = db.Delete(ctx, "users/alice")
+	if err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	err = db.Delete(ctx, "users/alice")
+	if err != nil {
+		t.Fatalf("delete missing: %v", err)
+	}
+	err = db.Get(ctx, "users/alice", &m)
+	if !ErrorIsNotFound(err) {
+		t.Fatalf("get deleted: expected NotFound, got %v", err)
+	}
+}
+
+func TestMemorySubcollections(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	for _, path := range []string{"users/alice/posts/1", "users/alice/posts/2", "users/alice/likes/1", "users/bob/posts/1"} {
+		err := db.Add(ctx, path, map[string]interface{}{"path": path})
+		if err != nil {
+			t.Fatalf("add %s: %v", path, err)
+		}
+	}
+
+	iter := db.CollectionIterator(ctx, "users/alice")
+	names := make([]string, 0)
+	for {
+		ref, err := iter.Next()
+		if errors.Is(err, DBIteratorDone) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("collections: %v", err)
+		}
+		if ref.Parent == nil || relativePath(ref.Parent.Path) != "users/alice" || ref.Parent.ID != "alice" || !strings.HasSuffix(ref.Path, "/"+ref.ID) {
+			t.Fatalf("collections: bad reference %+v", ref)
+		}
+		names = append(names, relativePath(ref.Path))
+	}
+	if fmt.Sprint(names) != "[users/alice/likes users/alice/posts]" {
+		t.Fatalf("collections: got %v", names)
+	}
+	refs, err := db.CollectionIterator(ctx, "users/alice").GetAll()
+	if err != nil || len(refs) != 2 {
+		t.Fatalf("collections: got %d, %v", len(refs), err)
+	}
+
+	// Documents only have Firestore snapshots with the Firestore backend.
+	if _, err := db.Query("users/alice/posts").Documents(ctx).GetAll(); err == nil {
+		t.Fatalf("snapshots: expected an error from the memory backend")
+	}
+
+	count, err := db.DocumentCount(ctx, "users/alice/posts")
+	if err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if count != 2 {
+		t.Fatalf("count: got %d, want 2", count)
+	}
+
+	count, err = db.DocumentCount(ctx, "users")
+	if err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if count != 0 {
+		t.Fatalf("count of parent collection without documents: got %d, want 0", count)
+	}
+
+	iter2 := db.QueryGroup("posts").Documents(ctx)
+	defer iter2.Stop()
+	n := 0
+	for {
+		m := map[string]interface{}{}
+		err := db.NextDoc(ctx, iter2, &m)
+		if errors.Is(err, DBIteratorDone) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("group query: %v", err)
+		}
+		n++
+	}
+	if n != 3 {
+		t.Fatalf("group query: got %d documents, want 3", n)
+	}
+
+	err = db.DeleteCollection(ctx, "users/alice/posts")
+	if err != nil {
+		t.Fatalf("delete collection: %v", err)
+	}
+	count, err = db.DocumentCount(ctx, "users/alice/posts")
+	if err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if count != 0 {
+		t.Fatalf("count after delete: got %d, want 0", count)
+	}
+}
+
+func queryNames(t *testing.T, db *DBConnection, q *Query) []string {
+	ctx := context.Background()
+
+	iter := q.Documents(ctx)
+	defer iter.Stop()
+
+	names := make([]string, 0)
+	for {
+		u := &testUser{}
+		err := db.NextDoc(ctx, iter, u)
+		if errors.Is(err, DBIteratorDone) {
+			return names
+		}
+		if err != nil {
+			t.Fatalf("query: %v", err)
+		}
+		names = append(names, u.Name)
+	}
+}
+
+func TestMemoryQuery(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	users := []*testUser{
+		{Name: "alice", Age: 30, Tags: []string{"admin"}},
+		{Name: "bob", Age: 25},
+		{Name: "carol", Age: 35, Tags: []string{"admin", "ops"}},
+		{Name: "dave", Age: 25, Tags: []string{"ops"}},
+	}
+	for _, u := range users {
+		err := db.Add(ctx, "users/"+u.Name, u)
+		if err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query *Query
+		want  string
+	}{
+		{"all", db.Query("users"), "[alice bob carol dave]"},
+		{"equal", db.Query("users").Where("Age", "==", 25), "[bob dave]"},
+		{"equal float", db.Query("users").Where("Age", "==", 25.0), "[bob dave]"},
+		{"not equal", db.Query("users").Where("Age", "!=", 25), "[alice carol]"},
+		{"greater", db.Query("users").Where("Age", ">", 25), "[alice carol]"},
+		{"type mismatch", db.Query("users").Where("Age", ">", "25"), "[]"},
+		{"in", db.Query("users").Where("Name", "in", []string{"bob", "carol", "zed"}), "[bob carol]"},
+		{"not in", db.Query("users").Where("Name", "not-in", []string{"bob", "carol"}), "[alice dave]"},
+		{"array contains", db.Query("users").Where("tags", "array-contains", "ops"), "[carol dave]"},
+		{"array contains any", db.Query("users").Where("tags", "array-contains-any", []string{"admin", "ops"}), "[alice carol dave]"},
+		{"order", db.Query("users").OrderBy("Age", Desc).OrderBy("Name", Asc), "[carol alice bob dave]"},
+		{"order filters missing", db.Query("users").OrderBy("tags", Asc), "[alice carol dave]"},
+		{"limit", db.Query("users").OrderBy("Age", Asc).Limit(2), "[bob dave]"},
+		{"limit to last", db.Query("users").OrderBy("Age", Asc).LimitToLast(2), "[alice carol]"},
+		{"offset", db.Query("users").OrderBy("Name", Asc).Offset(3), "[dave]"},
+		{"start at", db.Query("users").OrderBy("Age", Asc).StartAt(30), "[alice carol]"},
+		{"start after", db.Query("users").OrderBy("Age", Asc).StartAfter(25), "[alice carol]"},
+		{"start after name", db.Query("users").OrderBy("Age", Asc).OrderBy("Name", Asc).StartAfter(25, "bob"), "[dave alice carol]"},
+		{"end at", db.Query("users").OrderBy("Age", Asc).EndAt(30), "[bob dave alice]"},
+		{"end before", db.Query("users").OrderBy("Age", Asc).EndBefore(30), "[bob dave]"},
+		{"inequality order", db.Query("users").Where("Age", "<", 35), "[bob dave alice]"},
+		{"or", db.Query("users").WhereFilter(Or(Where("Name", "==", "alice"), Where("Age", "==", 25))), "[alice bob dave]"},
+		{"and", db.Query("users").WhereFilter(And(Where("Age", "==", 25), Where("tags", "array-contains", "ops"))), "[dave]"},
+		{"or of and", db.Query("users").WhereFilter(Or(Where("Name", "==", "bob"), And(Where("Age", ">=", 30), Where("tags", "array-contains", "ops")))), "[bob carol]"},
+		{"or and where", db.Query("users").Where("Age", "<", 35).WhereFilter(Or(Where("Name", "==", "carol"), Where("Name", "==", "dave"))), "[dave]"},
+	}
+
+	for _, test := range tests {
+		got := fmt.Sprint(queryNames(t, db, test.query))
+		if got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+
+	iter := db.Query("users").Where("Age", "~", 1).Documents(ctx)
+	err := db.NextDoc(ctx, iter, &testUser{})
+	if err == nil || errors.Is(err, DBIteratorDone) {
+		t.Errorf("invalid operator: expected error, got %v", err)
+	}
+}
+
+func TestDbWhereTypedValues(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	for _, u := range []*testUser{{Name: "alice", Age: 30}, {Name: "bob", Age: 25}} {
+		err := db.Add(ctx, "teams/a/users/"+u.Name, u)
+		if err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	time.Sleep(time.Millisecond)
+	cutoff := time.Now()
+
+	iter := db.CollectionGroupQuery(ctx, "users", []*DbWhere{
+		{Attr: "Age", Comparison: ">", Val: 26},
+		{Attr: "created", Comparison: "<", Val: cutoff},
+	})
+	names := make([]string, 0)
+	for u, err := range Decode[testUser](iter) {
+		if err != nil {
+			t.Fatalf("group query: %v", err)
+		}
+		names = append(names, u.Name)
+	}
+	if fmt.Sprint(names) != "[alice]" {
+		t.Fatalf("group query: got %v", names)
+	}
+
+	err := db.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		iter := tx.CompoundQueryIterator("teams/a/users", []*DbWhere{{Attr: "Age", Comparison: "==", Val: 25}})
+		u := &testUser{}
+		_, err := tx.NextDocPath(iter, u)
+		if err != nil {
+			return err
+		}
+		if u.Name != "bob" {
+			t.Errorf("compound query: got %q", u.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("transaction: %v", err)
+	}
+}
+
+func TestMemoryTransaction(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	type counter struct {
+		N int
+	}
+
+	err := db.Add(ctx, "counters/c", &counter{})
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	// Concurrent increments must not be lost. Some transactions may run out
+	// of attempts under contention; only the successful ones are counted.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := db.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+				c := &counter{}
+				err := tx.Get("counters/c", c)
+				if err != nil {
+					return err
+				}
+				c.N++
+				return tx.AddOrReplace("counters/c", c)
+			})
+			if err == nil {
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	c := &counter{}
+	err = db.Get(ctx, "counters/c", c)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if c.N != succeeded || succeeded == 0 {
+		t.Fatalf("counter is %d after %d successful increments", c.N, succeeded)
+	}
+
+	// A failing transaction function leaves no trace.
+	errTest := errors.New("test")
+	err = db.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		err := tx.Add("counters/d", &counter{N: 1})
+		if err != nil {
+			return err
+		}
+		return errTest
+	})
+	if !errors.Is(err, errTest) {
+		t.Fatalf("expected test error, got %v", err)
+	}
+	err = db.Get(ctx, "counters/d", c)
+	if !ErrorIsNotFound(err) {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+
+	// Reads after writes are rejected, as in Firestore.
+	err = db.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		err := tx.AddOrReplace("counters/e", &counter{N: 1})
+		if err != nil {
+			return err
+		}
+		return tx.Get("counters/c", c)
+	})
+	if err == nil {
+		t.Fatalf("expected read after write error")
+	}
+
+	// Join codes exercise iteration within a transaction.
+	var jc *JoinCode
+	err = db.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		var err error
+		jc, err = JoinCodeCreate("mgr", tx, "uid", map[string]string{"k": "v"})
+		if err != nil {
+			return err
+		}
+		return jc.Save(tx)
+	})
+	if err != nil {
+		t.Fatalf("join code: %v", err)
+	}
+
+	err = db.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		codes, err := ListJoinCodes(tx)
+		if err != nil {
+			return err
+		}
+		if len(codes) != 1 || codes[0].Code != jc.Code || codes[0].Data["k"] != "v" {
+			return fmt.Errorf("unexpected join codes %#v", codes)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("list join codes: %v", err)
+	}
+}
+
+func TestMemoryAtomic(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	u := &testUser{}
+	err := db.AtomicGetOrCreate(ctx, "users/alice", u, func(ctx context.Context, dval interface{}) error {
+		dval.(*testUser).Name = "alice"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("get or create: %v", err)
+	}
+
+	err = db.AtomicUpdate(ctx, "users/alice", u, func(ctx context.Context, dval interface{}) error {
+		dval.(*testUser).Age++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	u2 := &testUser{}
+	err = db.AtomicGetOrCreate(ctx, "users/alice", u2, func(ctx context.Context, dval interface{}) error {
+		return errors.New("should not be called")
+	})
+	if err != nil {
+		t.Fatalf("get or create existing: %v", err)
+	}
+	if u2.Name != "alice" || u2.Age != 1 {
+		t.Fatalf("unexpected %#v", u2)
+	}
+}
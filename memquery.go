@@ -0,0 +1,545 @@
+package fsdb
+
+import (
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// memQuery is a QuerySpec prepared for evaluation against the memory store.
+type memQuery struct {
+	spec    *QuerySpec
+	filters []memFilter
+	orders  []Order
+	start   []interface{}
+	end     []interface{}
+}
+
+// memFilter is a prepared Filter. Composite filters have op "and" or "or"
+// and their operands in filters.
+type memFilter struct {
+	path    string
+	op      string
+	value   interface{}
+	filters []memFilter
+}
+
+// fields appends the property filters in f to a flattened list.
+func (f *memFilter) fields(list []*memFilter) []*memFilter {
+	if f.filters == nil {
+		return append(list, f)
+	}
+	for i := range f.filters {
+		list = f.filters[i].fields(list)
+	}
+	return list
+}
+
+// inequalityOps are the operators that make a query order by their field.
+var inequalityOps = map[string]bool{
+	"<":      true,
+	"<=":     true,
+	">":      true,
+	">=":     true,
+	"!=":     true,
+	"not-in": true,
+}
+
+var validOps = map[string]bool{
+	"==":                 true,
+	"!=":                 true,
+	"<":                  true,
+	"<=":                 true,
+	">":                  true,
+	">=":                 true,
+	"array-contains":     true,
+	"array-contains-any": true,
+	"in":                 true,
+	"not-in":             true,
+}
+
+func newMemQuery(spec *QuerySpec) (*memQuery, error) {
+	if spec.Group {
+		if spec.Collection == "" || strings.Contains(spec.Collection, "/") {
+			return nil, status.Errorf(codes.InvalidArgument, "fsdb: bad collection group ID '%s'", spec.Collection)
+		}
+	} else if len(splitPath(spec.Collection))%2 != 1 {
+		return nil, status.Errorf(codes.InvalidArgument, "nil collection: bad path '%s'?", spec.Collection)
+	}
+
+	q := &memQuery{spec: spec}
+
+	for _, f := range spec.Filters {
+		mf, err := q.newFilter(f)
+		if err != nil {
+			return nil, err
+		}
+		q.filters = append(q.filters, mf)
+	}
+
+	q.orders = append(q.orders, spec.Orders...)
+
+	// Firestore implicitly orders by any inequality fields that were not
+	// explicitly ordered, then by document name.
+	dir := firestore.Asc
+	if len(spec.Orders) > 0 {
+		dir = spec.Orders[len(spec.Orders)-1].Dir
+	}
+	implicit := make([]string, 0)
+	flat := make([]*memFilter, 0)
+	for i := range q.filters {
+		flat = q.filters[i].fields(flat)
+	}
+	for _, f := range flat {
+		if inequalityOps[f.op] && !q.ordersBy(f.path) && !contains(implicit, f.path) {
+			implicit = append(implicit, f.path)
+		}
+	}
+	sort.Strings(implicit)
+	for _, path := range implicit {
+		q.orders = append(q.orders, Order{Path: path, Dir: dir})
+	}
+	if !q.ordersBy(firestore.DocumentID) {
+		q.orders = append(q.orders, Order{Path: firestore.DocumentID, Dir: dir})
+	}
+
+	var err error
+	if spec.Start != nil {
+		q.start, err = q.cursorValues(spec.Start)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if spec.End != nil {
+		q.end, err = q.cursorValues(spec.End)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+func (q *memQuery) newFilter(filter Filter) (memFilter, error) {
+	var f PropertyFilter
+	switch x := filter.(type) {
+	case PropertyFilter:
+		f = x
+	case CompositeFilter:
+		if x.Op != "and" && x.Op != "or" {
+			return memFilter{}, status.Errorf(codes.InvalidArgument, "fsdb: invalid composite filter operator %q", x.Op)
+		}
+		if len(x.Filters) == 0 {
+			return memFilter{}, status.Errorf(codes.InvalidArgument, "fsdb: empty composite filter")
+		}
+		mf := memFilter{op: x.Op, filters: make([]memFilter, 0, len(x.Filters))}
+		for _, sub := range x.Filters {
+			sf, err := q.newFilter(sub)
+			if err != nil {
+				return memFilter{}, err
+			}
+			mf.filters = append(mf.filters, sf)
+		}
+		return mf, nil
+	default:
+		return memFilter{}, status.Errorf(codes.InvalidArgument, "fsdb: unsupported filter type %T", filter)
+	}
+
+	if !validOps[f.Op] {
+		return memFilter{}, status.Errorf(codes.InvalidArgument, "fsdb: invalid operator %q", f.Op)
+	}
+
+	var value interface{}
+	var err error
+	if f.Path == firestore.DocumentID {
+		value, err = q.nameValue(f.Value, f.Op == "in" || f.Op == "not-in")
+	} else {
+		value, err = encodeFilterValue(f.Value)
+	}
+	if err != nil {
+		return memFilter{}, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	switch f.Op {
+	case "in", "not-in", "array-contains-any":
+		if _, ok := value.([]interface{}); !ok {
+			return memFilter{}, status.Errorf(codes.InvalidArgument, "fsdb: value for %q must be an array", f.Op)
+		}
+	}
+
+	return memFilter{path: f.Path, op: f.Op, value: value}, nil
+}
+
+// nameValue converts a value compared against the document name into a memReference.
+func (q *memQuery) nameValue(value interface{}, list bool) (interface{}, error) {
+	if list {
+		v, err := encodeFilterValue(value)
+		if err != nil {
+			return nil, err
+		}
+		a, ok := v.([]interface{})
+		if !ok {
+			return v, nil
+		}
+		refs := make([]interface{}, len(a))
+		for i, e := range a {
+			refs[i], err = q.nameValue(e, false)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return refs, nil
+	}
+
+	switch x := value.(type) {
+	case string:
+		if q.spec.Group || strings.Contains(x, "/") {
+			return memReference(relativePath(x)), nil
+		}
+		return memReference(q.spec.Collection + "/" + x), nil
+	case memReference:
+		return x, nil
+	case *firestore.DocumentRef:
+		return memReference(relativePath(x.Path)), nil
+	}
+
+	return encodeFilterValue(value)
+}
+
+func (q *memQuery) cursorValues(c *Cursor) ([]interface{}, error) {
+	if len(c.Values) > len(q.orders) {
+		return nil, status.Errorf(codes.InvalidArgument, "fsdb: too many cursor values")
+	}
+
+	values := make([]interface{}, len(c.Values))
+	for i, v := range c.Values {
+		var err error
+		if q.orders[i].Path == firestore.DocumentID {
+			values[i], err = q.nameValue(v, false)
+		} else {
+			values[i], err = encodeFilterValue(v)
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
+
+	return values, nil
+}
+
+func (q *memQuery) ordersBy(path string) bool {
+	for _, o := range q.orders {
+		if o.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// inScope reports whether a document path is in the collection (or collection group) being queried.
+func (q *memQuery) inScope(path string) bool {
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return false
+	}
+	parent := path[:i]
+
+	if !q.spec.Group {
+		return parent == q.spec.Collection
+	}
+
+	return parent == q.spec.Collection || strings.HasSuffix(parent, "/"+q.spec.Collection)
+}
+
+// fieldValue returns a document's value for a filter or order path.
+func fieldValue(d *memDoc, path string) (interface{}, bool) {
+	if path == firestore.DocumentID {
+		return memReference(d.path), true
+	}
+	return getField(d.fields, path)
+}
+
+func (q *memQuery) matches(d *memDoc) bool {
+	if !q.inScope(d.path) {
+		return false
+	}
+
+	for _, f := range q.filters {
+		if !f.matches(d) {
+			return false
+		}
+	}
+
+	// An OrderBy also filters out documents that lack the field.
+	for _, o := range q.orders {
+		if _, ok := fieldValue(d, o.Path); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *memFilter) matches(d *memDoc) bool {
+	switch {
+	case f.filters != nil && f.op == "or":
+		for i := range f.filters {
+			if f.filters[i].matches(d) {
+				return true
+			}
+		}
+		return false
+	case f.filters != nil:
+		for i := range f.filters {
+			if !f.filters[i].matches(d) {
+				return false
+			}
+		}
+		return true
+	}
+
+	v, ok := fieldValue(d, f.path)
+	if !ok {
+		return false
+	}
+
+	switch f.op {
+	case "==":
+		return typeOrder(v) == typeOrder(f.value) && compareValues(v, f.value) == 0
+	case "!=":
+		return typeOrder(v) != typeOrder(f.value) || compareValues(v, f.value) != 0
+	case "<", "<=", ">", ">=":
+		if typeOrder(v) != typeOrder(f.value) {
+			return false
+		}
+		c := compareValues(v, f.value)
+		switch f.op {
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		}
+		return c >= 0
+	case "array-contains":
+		a, ok := v.([]interface{})
+		return ok && containsValue(a, f.value)
+	case "array-contains-any":
+		a, ok := v.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, e := range f.value.([]interface{}) {
+			if containsValue(a, e) {
+				return true
+			}
+		}
+		return false
+	case "in":
+		return containsValue(f.value.([]interface{}), v)
+	case "not-in":
+		return v != nil && !containsValue(f.value.([]interface{}), v)
+	}
+
+	return false
+}
+
+func containsValue(a []interface{}, v interface{}) bool {
+	for _, e := range a {
+		if typeOrder(e) == typeOrder(v) && compareValues(e, v) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(a []string, s string) bool {
+	for _, e := range a {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// compare orders two matching documents by the query's orders.
+func (q *memQuery) compare(a, b *memDoc) int {
+	for _, o := range q.orders {
+		av, _ := fieldValue(a, o.Path)
+		bv, _ := fieldValue(b, o.Path)
+		c := compareValues(av, bv)
+		if o.Dir == firestore.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// compareCursor compares a document's position with a cursor; only as many
+// orders as the cursor has values are considered.
+func (q *memQuery) compareCursor(d *memDoc, values []interface{}) int {
+	for i, v := range values {
+		o := q.orders[i]
+		dv, _ := fieldValue(d, o.Path)
+		c := compareValues(dv, v)
+		if o.Dir == firestore.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// run evaluates the query over a set of documents.
+func (q *memQuery) run(docs map[string]*memDoc) []*memDoc {
+	results := make([]*memDoc, 0)
+	for _, d := range docs {
+		if q.matches(d) {
+			results = append(results, d)
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return q.compare(results[i], results[j]) < 0
+	})
+
+	if q.spec.Start != nil {
+		filtered := results[:0]
+		for _, d := range results {
+			c := q.compareCursor(d, q.start)
+			if c > 0 || (c == 0 && q.spec.Start.Inclusive) {
+				filtered = append(filtered, d)
+			}
+		}
+		results = filtered
+	}
+
+	if q.spec.End != nil {
+		filtered := results[:0]
+		for _, d := range results {
+			c := q.compareCursor(d, q.end)
+			if c < 0 || (c == 0 && q.spec.End.Inclusive) {
+				filtered = append(filtered, d)
+			}
+		}
+		results = filtered
+	}
+
+	if q.spec.LimitToLast {
+		if q.spec.Offset > 0 {
+			results = results[:max(len(results)-q.spec.Offset, 0)]
+		}
+		if q.spec.Limit > 0 && len(results) > q.spec.Limit {
+			results = results[len(results)-q.spec.Limit:]
+		}
+	} else {
+		if q.spec.Offset > 0 {
+			results = results[min(q.spec.Offset, len(results)):]
+		}
+		if q.spec.Limit > 0 && len(results) > q.spec.Limit {
+			results = results[:q.spec.Limit]
+		}
+	}
+
+	if q.spec.Projected {
+		projected := make([]*memDoc, len(results))
+		for i, d := range results {
+			projected[i] = d.project(q.spec.Fields)
+		}
+		results = projected
+	}
+
+	return results
+}
+
+// maxAggregations is the most aggregations Firestore accepts in one query.
+const maxAggregations = 5
+
+func checkAggregations(aggs []Aggregation) error {
+	if len(aggs) == 0 || len(aggs) > maxAggregations {
+		return status.Errorf(codes.InvalidArgument, "fsdb: between 1 and %d aggregations are required, got %d", maxAggregations, len(aggs))
+	}
+
+	seen := make(map[string]bool)
+	for _, a := range aggs {
+		if a.Alias == "" || seen[a.Alias] {
+			return status.Errorf(codes.InvalidArgument, "fsdb: aggregation aliases must be unique and non-empty, got %q", a.Alias)
+		}
+		seen[a.Alias] = true
+
+		if a.op != aggregateCount && a.Field == "" {
+			return status.Errorf(codes.InvalidArgument, "fsdb: aggregation %q needs a field", a.Alias)
+		}
+	}
+
+	return nil
+}
+
+// aggregate computes aggregations over query results. As in Firestore, sum
+// and average only consider numeric values, a sum of integers is an integer
+// unless it overflows, and the average of no values is null.
+func aggregate(docs []*memDoc, aggs []Aggregation) AggregationResult {
+	result := make(AggregationResult, len(aggs))
+
+	for _, a := range aggs {
+		if a.op == aggregateCount {
+			result[a.Alias] = int64(len(docs))
+			continue
+		}
+
+		n := 0
+		isum := int64(0)
+		fsum := float64(0)
+		integral := true
+		for _, d := range docs {
+			v, _ := getField(d.fields, a.Field)
+			switch x := v.(type) {
+			case int64:
+				if integral {
+					sum := isum + x
+					if (x > 0 && sum < isum) || (x < 0 && sum > isum) {
+						integral = false
+						fsum = float64(isum) + float64(x)
+						break
+					}
+					isum = sum
+				} else {
+					fsum += float64(x)
+				}
+			case float64:
+				if integral {
+					integral = false
+					fsum = float64(isum)
+				}
+				fsum += x
+			default:
+				continue
+			}
+			n++
+		}
+
+		switch {
+		case a.op == aggregateAvg && n == 0:
+			result[a.Alias] = nil
+		case a.op == aggregateAvg && integral:
+			result[a.Alias] = float64(isum) / float64(n)
+		case a.op == aggregateAvg:
+			result[a.Alias] = fsum / float64(n)
+		case integral:
+			result[a.Alias] = isum
+		default:
+			result[a.Alias] = fsum
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,835 @@
+package fsdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// The memory backend stores document fields as the same Go values that
+// firestore.DocumentSnapshot.Data returns: nil, bool, int64, float64, string,
+// []byte, time.Time, []interface{} and map[string]interface{}. Document
+// references are stored as memReference.
+//
+// The conversions below follow the rules of the firestore package, including
+// its struct tags ("-", a field name, omitempty, serverTimestamp).
+
+// memReference is a reference to a document, stored as its path relative to the database root.
+type memReference string
+
+var (
+	typeOfTime        = reflect.TypeOf(time.Time{})
+	typeOfBytes       = reflect.TypeOf([]byte{})
+	typeOfDocumentRef = reflect.TypeOf((*firestore.DocumentRef)(nil))
+	typeOfSentinel    = reflect.TypeOf(firestore.ServerTimestamp)
+)
+
+// memField is an encodable struct field.
+type memField struct {
+	name            string
+	index           []int
+	omitEmpty       bool
+	serverTimestamp bool
+}
+
+var memFieldCache sync.Map // reflect.Type -> []memField
+
+// memFields returns the encodable fields of a struct type, flattening
+// untagged embedded structs the way encoding/json does.
+func memFields(t reflect.Type) ([]memField, error) {
+	if cached, ok := memFieldCache.Load(t); ok {
+		return cached.([]memField), nil
+	}
+
+	fields := make([]memField, 0)
+	depth := make(map[string]int)
+	err := collectMemFields(t, nil, 0, &fields, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	memFieldCache.Store(t, fields)
+
+	return fields, nil
+}
+
+func collectMemFields(t reflect.Type, index []int, level int, fields *[]memField, depth map[string]int) error {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+
+		tag := sf.Tag.Get("firestore")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+
+		fidx := append(append([]int(nil), index...), i)
+
+		if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct && ft != typeOfTime {
+			err := collectMemFields(ft, fidx, level+1, fields, depth)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !sf.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = sf.Name
+		}
+
+		f := memField{
+			name:  name,
+			index: fidx,
+		}
+
+		for _, opt := range strings.Split(opts, ",") {
+			switch opt {
+			case "":
+			case "omitempty":
+				f.omitEmpty = true
+			case "serverTimestamp":
+				if sf.Type != typeOfTime && sf.Type != reflect.PointerTo(typeOfTime) {
+					return fmt.Errorf("fsdb: field %s of struct %s with serverTimestamp tag must be of type time.Time or *time.Time", sf.Name, t)
+				}
+				f.serverTimestamp = true
+			default:
+				return fmt.Errorf("fsdb: unknown tag option: %q", opt)
+			}
+		}
+
+		// As with encoding/json, the shallowest field wins.
+		if d, ok := depth[name]; ok {
+			if d <= level {
+				continue
+			}
+			for j := range *fields {
+				if (*fields)[j].name == name {
+					(*fields)[j] = f
+				}
+			}
+			depth[name] = level
+			continue
+		}
+
+		depth[name] = level
+		*fields = append(*fields, f)
+	}
+
+	return nil
+}
+
+// encodeDocument converts a struct or map into document fields. It also
+// returns the paths of fields to be set to the commit time.
+func encodeDocument(dval interface{}) (map[string]interface{}, [][]string, error) {
+	v := reflect.ValueOf(dval)
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return nil, nil, errors.New("fsdb: nil document data")
+		}
+		v = v.Elem()
+	}
+
+	if !v.IsValid() || (v.Kind() != reflect.Struct && v.Kind() != reflect.Map) {
+		return nil, nil, fmt.Errorf("fsdb: document data must be a struct or map, not %T", dval)
+	}
+
+	stamps := make([][]string, 0)
+	enc, omit, err := encodeValue(v, nil, &stamps)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fields, ok := enc.(map[string]interface{})
+	if omit || !ok {
+		fields = map[string]interface{}{}
+	}
+
+	return fields, stamps, nil
+}
+
+// encodeValue converts v into its stored form. If stamps is non-nil, server
+// timestamp fields are recorded there and omitted from the result.
+func encodeValue(v reflect.Value, path []string, stamps *[][]string) (interface{}, bool, error) {
+	if !v.IsValid() {
+		return nil, false, nil
+	}
+	if !v.CanInterface() {
+		return nil, false, fmt.Errorf("fsdb: cannot convert unexported value of type %s", v.Type())
+	}
+
+	switch x := v.Interface().(type) {
+	case []byte:
+		if x == nil {
+			return nil, false, nil
+		}
+		return append([]byte(nil), x...), false, nil
+	case time.Time:
+		return normalizeTime(x), false, nil
+	case memReference:
+		return x, false, nil
+	case *firestore.DocumentRef:
+		if x == nil {
+			return nil, false, nil
+		}
+		return memReference(relativePath(x.Path)), false, nil
+	}
+
+	if v.Type() == typeOfSentinel {
+		switch v.Interface() {
+		case firestore.ServerTimestamp:
+			if stamps == nil {
+				return nil, false, errors.New("fsdb: ServerTimestamp must be a map value")
+			}
+			*stamps = append(*stamps, path)
+			return nil, true, nil
+		case firestore.Delete:
+			return nil, false, errors.New("fsdb: cannot use Delete in value")
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool(), false, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), false, nil
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return int64(v.Uint()), false, nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), false, nil
+	case reflect.String:
+		return v.String(), false, nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil, false, nil
+		}
+		fallthrough
+	case reflect.Array:
+		a := make([]interface{}, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			e, _, err := encodeValue(v.Index(i), nil, nil)
+			if err != nil {
+				return nil, false, err
+			}
+			a[i] = e
+		}
+		return a, false, nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, false, errors.New("fsdb: map key type must be string")
+		}
+		if v.IsNil() {
+			return nil, false, nil
+		}
+		m := make(map[string]interface{}, v.Len())
+		sawStamp := false
+		iter := v.MapRange()
+		for iter.Next() {
+			k := iter.Key().String()
+			e, omit, err := encodeValue(iter.Value(), appendPath(path, k), stamps)
+			if err != nil {
+				return nil, false, err
+			}
+			if omit {
+				sawStamp = true
+				continue
+			}
+			m[k] = e
+		}
+		if len(m) == 0 && sawStamp {
+			return nil, true, nil
+		}
+		return m, false, nil
+	case reflect.Struct:
+		fields, err := memFields(v.Type())
+		if err != nil {
+			return nil, false, err
+		}
+		m := make(map[string]interface{}, len(fields))
+		sawStamp := false
+		for _, f := range fields {
+			fv, ok := fieldByIndex(v, f.index)
+			if !ok {
+				continue
+			}
+			if f.serverTimestamp {
+				sawStamp = true
+				if stamps != nil && isZeroTime(fv) {
+					*stamps = append(*stamps, appendPath(path, f.name))
+				}
+				continue
+			}
+			if f.omitEmpty && isEmptyValue(fv) {
+				continue
+			}
+			e, omit, err := encodeValue(fv, appendPath(path, f.name), stamps)
+			if err != nil {
+				return nil, false, err
+			}
+			if omit {
+				sawStamp = true
+				continue
+			}
+			m[f.name] = e
+		}
+		if len(m) == 0 && sawStamp {
+			return nil, true, nil
+		}
+		return m, false, nil
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil, false, nil
+		}
+		return encodeValue(v.Elem(), path, stamps)
+	case reflect.Interface:
+		if v.NumMethod() == 0 {
+			return encodeValue(v.Elem(), path, stamps)
+		}
+	}
+
+	return nil, false, fmt.Errorf("fsdb: cannot convert type %s to value", v.Type())
+}
+
+// encodeFilterValue converts a value used in a query into its stored form.
+func encodeFilterValue(value interface{}) (interface{}, error) {
+	v, _, err := encodeValue(reflect.ValueOf(value), nil, nil)
+	return v, err
+}
+
+func appendPath(path []string, name string) []string {
+	return append(append([]string(nil), path...), name)
+}
+
+// fieldByIndex is reflect.Value.FieldByIndex, but reports false instead of
+// panicking when it passes through a nil embedded pointer.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func isZeroTime(v reflect.Value) bool {
+	if v.Kind() == reflect.Ptr {
+		return v.IsNil() || v.Elem().Interface().(time.Time).IsZero()
+	}
+	return v.Interface().(time.Time).IsZero()
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	if v.Type() == typeOfTime {
+		return v.Interface().(time.Time).IsZero()
+	}
+	return false
+}
+
+// normalizeTime truncates t to the microsecond precision Firestore stores.
+func normalizeTime(t time.Time) time.Time {
+	return t.Truncate(time.Microsecond).UTC()
+}
+
+// decodeDocument decodes document fields into dval, which must be a non-nil pointer.
+func decodeDocument(fields map[string]interface{}, dval interface{}) error {
+	v := reflect.ValueOf(dval)
+	if !v.IsValid() || v.Kind() != reflect.Ptr || v.IsNil() {
+		return errors.New("fsdb: nil or not a pointer")
+	}
+
+	return decodeValue(v.Elem(), fields)
+}
+
+func decodeValue(dst reflect.Value, src interface{}) error {
+	typeErr := func() error {
+		return fmt.Errorf("fsdb: cannot set type %s to %s", dst.Type(), valueTypeName(src))
+	}
+
+	if src == nil {
+		switch dst.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice:
+			dst.Set(reflect.Zero(dst.Type()))
+		}
+		return nil
+	}
+
+	switch dst.Type() {
+	case typeOfBytes:
+		b, ok := src.([]byte)
+		if !ok {
+			return typeErr()
+		}
+		dst.SetBytes(append([]byte(nil), b...))
+		return nil
+	case typeOfTime:
+		t, ok := src.(time.Time)
+		if !ok {
+			return typeErr()
+		}
+		dst.Set(reflect.ValueOf(t))
+		return nil
+	case typeOfDocumentRef:
+		return errors.New("fsdb: the memory backend cannot decode document references")
+	}
+
+	switch dst.Kind() {
+	case reflect.Bool:
+		b, ok := src.(bool)
+		if !ok {
+			return typeErr()
+		}
+		dst.SetBool(b)
+
+	case reflect.String:
+		switch s := src.(type) {
+		case string:
+			dst.SetString(s)
+		case memReference:
+			dst.SetString(string(s))
+		default:
+			return typeErr()
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		switch x := src.(type) {
+		case int64:
+			i = x
+		case float64:
+			i = int64(x)
+			if float64(i) != x {
+				return fmt.Errorf("fsdb: float %f does not fit into %s", x, dst.Type())
+			}
+		default:
+			return typeErr()
+		}
+		if dst.OverflowInt(i) {
+			return fmt.Errorf("fsdb: value %v overflows type %s", i, dst.Type())
+		}
+		dst.SetInt(i)
+
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		var u uint64
+		switch x := src.(type) {
+		case int64:
+			u = uint64(x)
+		case float64:
+			u = uint64(x)
+			if float64(u) != x {
+				return fmt.Errorf("fsdb: float %f does not fit into %s", x, dst.Type())
+			}
+		default:
+			return typeErr()
+		}
+		if dst.OverflowUint(u) {
+			return fmt.Errorf("fsdb: value %v overflows type %s", u, dst.Type())
+		}
+		dst.SetUint(u)
+
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		switch x := src.(type) {
+		case float64:
+			f = x
+		case int64:
+			f = float64(x)
+		default:
+			return typeErr()
+		}
+		if dst.OverflowFloat(f) {
+			return fmt.Errorf("fsdb: value %v overflows type %s", f, dst.Type())
+		}
+		dst.SetFloat(f)
+
+	case reflect.Slice:
+		a, ok := src.([]interface{})
+		if !ok {
+			return typeErr()
+		}
+		dst.Set(reflect.MakeSlice(dst.Type(), len(a), len(a)))
+		for i, e := range a {
+			if err := decodeValue(dst.Index(i), e); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Array:
+		a, ok := src.([]interface{})
+		if !ok {
+			return typeErr()
+		}
+		for i := 0; i < dst.Len(); i++ {
+			if i >= len(a) {
+				dst.Index(i).Set(reflect.Zero(dst.Type().Elem()))
+				continue
+			}
+			if err := decodeValue(dst.Index(i), a[i]); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		m, ok := src.(map[string]interface{})
+		if !ok {
+			return typeErr()
+		}
+		if dst.Type().Key().Kind() != reflect.String {
+			return errors.New("fsdb: map key type is not string")
+		}
+		if dst.IsNil() {
+			dst.Set(reflect.MakeMap(dst.Type()))
+		}
+		for k, e := range m {
+			ev := reflect.New(dst.Type().Elem()).Elem()
+			if err := decodeValue(ev, e); err != nil {
+				return err
+			}
+			dst.SetMapIndex(reflect.ValueOf(k).Convert(dst.Type().Key()), ev)
+		}
+
+	case reflect.Ptr:
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return decodeValue(dst.Elem(), src)
+
+	case reflect.Struct:
+		m, ok := src.(map[string]interface{})
+		if !ok {
+			return typeErr()
+		}
+		return decodeStruct(dst, m)
+
+	case reflect.Interface:
+		if dst.NumMethod() != 0 {
+			return fmt.Errorf("fsdb: cannot set type %s", dst.Type())
+		}
+		if !dst.IsNil() && dst.Elem().Kind() == reflect.Ptr {
+			return decodeValue(dst.Elem(), src)
+		}
+		dst.Set(reflect.ValueOf(copyValue(src)))
+
+	default:
+		return fmt.Errorf("fsdb: cannot set type %s", dst.Type())
+	}
+
+	return nil
+}
+
+func decodeStruct(dst reflect.Value, m map[string]interface{}) error {
+	fields, err := memFields(dst.Type())
+	if err != nil {
+		return err
+	}
+
+	for k, e := range m {
+		f := matchField(fields, k)
+		if f == nil {
+			continue
+		}
+
+		fv := dst
+		for i, x := range f.index {
+			if i > 0 && fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					fv.Set(reflect.New(fv.Type().Elem()))
+				}
+				fv = fv.Elem()
+			}
+			fv = fv.Field(x)
+		}
+
+		if err := decodeValue(fv, e); err != nil {
+			return fmt.Errorf("%s.%s: %w", dst.Type(), f.name, err)
+		}
+	}
+
+	return nil
+}
+
+// matchField finds the field for a stored name, preferring an exact match
+// and falling back to a case-insensitive one.
+func matchField(fields []memField, name string) *memField {
+	var fold *memField
+	for i := range fields {
+		if fields[i].name == name {
+			return &fields[i]
+		}
+		if fold == nil && strings.EqualFold(fields[i].name, name) {
+			fold = &fields[i]
+		}
+	}
+	return fold
+}
+
+// copyValue returns a deep copy of a stored value, so callers cannot modify the store.
+func copyValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case []interface{}:
+		a := make([]interface{}, len(x))
+		for i, e := range x {
+			a[i] = copyValue(e)
+		}
+		return a
+	case map[string]interface{}:
+		return copyFields(x)
+	case []byte:
+		return append([]byte(nil), x...)
+	}
+	return v
+}
+
+func copyFields(fields map[string]interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(fields))
+	for k, e := range fields {
+		m[k] = copyValue(e)
+	}
+	return m
+}
+
+func valueTypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case int64:
+		return "int"
+	case float64:
+		return "double"
+	case string:
+		return "string"
+	case []byte:
+		return "bytes"
+	case time.Time:
+		return "timestamp"
+	case memReference:
+		return "reference"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "map"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// getField returns the value at a dotted field path.
+func getField(fields map[string]interface{}, path string) (interface{}, bool) {
+	return lookupField(fields, strings.Split(path, "."))
+}
+
+// lookupField returns the value at a field path.
+func lookupField(fields map[string]interface{}, path []string) (interface{}, bool) {
+	var cur interface{} = fields
+	for _, name := range path {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		cur, ok = m[name]
+		if !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// setField sets the value at a field path, creating intermediate maps as needed.
+func setField(fields map[string]interface{}, path []string, value interface{}) {
+	m := fields
+	for _, name := range path[:len(path)-1] {
+		next, ok := m[name].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			m[name] = next
+		}
+		m = next
+	}
+	m[path[len(path)-1]] = value
+}
+
+// deleteField removes the value at a field path, if present.
+func deleteField(fields map[string]interface{}, path []string) {
+	m := fields
+	for _, name := range path[:len(path)-1] {
+		next, ok := m[name].(map[string]interface{})
+		if !ok {
+			return
+		}
+		m = next
+	}
+	delete(m, path[len(path)-1])
+}
+
+// typeOrder ranks stored values the way Firestore orders values of different types.
+func typeOrder(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case int64, float64:
+		return 2
+	case time.Time:
+		return 3
+	case string:
+		return 4
+	case []byte:
+		return 5
+	case memReference:
+		return 6
+	case []interface{}:
+		return 8
+	case map[string]interface{}:
+		return 9
+	}
+	return 10
+}
+
+// compareValues orders two stored values using Firestore's ordering rules.
+func compareValues(a, b interface{}) int {
+	ta, tb := typeOrder(a), typeOrder(b)
+	if ta != tb {
+		return cmpInt(ta, tb)
+	}
+
+	switch x := a.(type) {
+	case nil:
+		return 0
+	case bool:
+		y := b.(bool)
+		if x == y {
+			return 0
+		}
+		if !x {
+			return -1
+		}
+		return 1
+	case int64:
+		if y, ok := b.(int64); ok {
+			return cmpInt64(x, y)
+		}
+		return compareNumbers(float64(x), b.(float64))
+	case float64:
+		if y, ok := b.(int64); ok {
+			return compareNumbers(x, float64(y))
+		}
+		return compareNumbers(x, b.(float64))
+	case time.Time:
+		return x.Compare(b.(time.Time))
+	case string:
+		return strings.Compare(x, b.(string))
+	case []byte:
+		return bytes.Compare(x, b.([]byte))
+	case memReference:
+		return comparePaths(string(x), string(b.(memReference)))
+	case []interface{}:
+		y := b.([]interface{})
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := compareValues(x[i], y[i]); c != 0 {
+				return c
+			}
+		}
+		return cmpInt(len(x), len(y))
+	case map[string]interface{}:
+		y := b.(map[string]interface{})
+		xk, yk := sortedKeys(x), sortedKeys(y)
+		for i := 0; i < len(xk) && i < len(yk); i++ {
+			if c := strings.Compare(xk[i], yk[i]); c != 0 {
+				return c
+			}
+			if c := compareValues(x[xk[i]], y[yk[i]]); c != 0 {
+				return c
+			}
+		}
+		return cmpInt(len(xk), len(yk))
+	}
+
+	return 0
+}
+
+// compareNumbers orders numbers, with NaN before all other numbers.
+func compareNumbers(x, y float64) int {
+	switch {
+	case math.IsNaN(x) && math.IsNaN(y):
+		return 0
+	case math.IsNaN(x):
+		return -1
+	case math.IsNaN(y):
+		return 1
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// comparePaths orders document paths segment by segment.
+func comparePaths(a, b string) int {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if c := strings.Compare(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+	return cmpInt(len(as), len(bs))
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func cmpInt(a, b int) int {
+	return cmpInt64(int64(a), int64(b))
+}
+
+func cmpInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,451 @@
+package fsdb
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// pageTokenMACSize is the number of bytes of HMAC-SHA256 kept in a page token.
+const pageTokenMACSize = 16
+
+// pageToken is the signed content of a token returned by Query.Page.
+type pageToken struct {
+	Shape  []byte        `json:"q"` // hash of the query the token was issued for
+	Cursor []interface{} `json:"c"` // encoded values of the last document's order fields
+}
+
+// SetPageTokenKey sets the secret used to sign the tokens returned by
+// Query.Page. Tokens are only accepted by connections with the same key, so
+// servers sharing tokens must share a key, and changing the key invalidates
+// outstanding tokens. A key must be set before Query.Page is used.
+func (db *DBConnection) SetPageTokenKey(key []byte) {
+	db.pageKeyMu.Lock()
+	defer db.pageKeyMu.Unlock()
+
+	db.pageKey = append([]byte(nil), key...)
+}
+
+func (db *DBConnection) pageTokenKey() ([]byte, error) {
+	db.pageKeyMu.Lock()
+	defer db.pageKeyMu.Unlock()
+
+	if len(db.pageKey) == 0 {
+		return nil, ErrNoPageTokenKey
+	}
+
+	return db.pageKey, nil
+}
+
+// Page returns up to pageSize documents of the query's results, starting
+// after the position encoded in token, or at the beginning if token is
+// empty. The returned token fetches the next page, and is empty once the
+// results are exhausted.
+//
+// Tokens are opaque, URL safe and signed with the connection's page token
+// key, which must be set with SetPageTokenKey; without one Page returns
+// ErrNoPageTokenKey. A token that has been modified, or that was
+// issued for a different query, is rejected with ErrInvalidPageToken. The
+// query's own Limit is ignored, and its Offset only applies to the first
+// page. Results are ordered by the query's OrderBy fields, then by any
+// inequality fields, then by document ID, so every ordered field must be
+// included if Select is used.
+//
+// Example:
+//
+//	docs, next, err := db.Query("users").
+//		OrderBy("age", fsdb.Asc).
+//		Page(ctx, 20, r.URL.Query().Get("page"))
+func (q *Query) Page(ctx context.Context, pageSize int, token string) ([]*Snapshot, string, error) {
+	if pageSize <= 0 {
+		return nil, "", fmt.Errorf("page size %d must be positive", pageSize)
+	}
+	if q.spec.LimitToLast {
+		return nil, "", fmt.Errorf("page: LimitToLast queries cannot be paged")
+	}
+
+	spec := q.spec
+	spec.Orders = pageOrders(&q.spec)
+
+	shape, err := queryShape(&spec)
+	if err != nil {
+		return nil, "", err
+	}
+	key, err := q.db.pageTokenKey()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if token != "" {
+		values, err := parsePageToken(key, shape, token)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(values) != len(spec.Orders) {
+			return nil, "", fmt.Errorf("%w: wrong number of cursor values", ErrInvalidPageToken)
+		}
+		spec.Start = &Cursor{Values: values}
+		spec.Offset = 0
+	}
+	spec.Limit = pageSize + 1
+	q.db.recordQuery(&spec)
+
+	var iter BackendDocumentIterator
+	if q.tx != nil {
+		iter = q.tx.Documents(&spec)
+	} else {
+		iter = q.backend.Documents(ctx, &spec)
+	}
+	docs, err := getAll(iter)
+	iter.Stop()
+	if err != nil {
+		return nil, "", err
+	}
+
+	more := len(docs) > pageSize
+	if more {
+		docs = docs[:pageSize]
+	}
+
+	snaps := make([]*Snapshot, len(docs))
+	for i, doc := range docs {
+		snaps[i] = newSnapshot(doc)
+	}
+
+	if !more {
+		return snaps, "", nil
+	}
+
+	next, err := newPageToken(key, shape, spec.Orders, docs[len(docs)-1])
+	if err != nil {
+		return nil, "", err
+	}
+
+	return snaps, next, nil
+}
+
+// pageOrders returns the orders Firestore applies to a query: its OrderBy
+// clauses, then any unordered inequality fields, then the document ID.
+// Making them explicit lets every result be located with a cursor.
+func pageOrders(spec *QuerySpec) []Order {
+	orders := append([]Order(nil), spec.Orders...)
+	orderedBy := func(path string) bool {
+		for _, o := range orders {
+			if o.Path == path {
+				return true
+			}
+		}
+		return false
+	}
+
+	dir := firestore.Asc
+	if len(orders) > 0 {
+		dir = orders[len(orders)-1].Dir
+	}
+
+	implicit := make([]string, 0)
+	for _, f := range propertyFilters(spec.Filters, nil) {
+		if inequalityOps[f.Op] && !orderedBy(f.Path) && !contains(implicit, f.Path) {
+			implicit = append(implicit, f.Path)
+		}
+	}
+	sort.Strings(implicit)
+	for _, path := range implicit {
+		orders = append(orders, Order{Path: path, Dir: dir})
+	}
+
+	if !orderedBy(firestore.DocumentID) {
+		orders = append(orders, Order{Path: firestore.DocumentID, Dir: dir})
+	}
+
+	return orders
+}
+
+// propertyFilters appends the property filters in filters, including those
+// nested in composite filters, to list.
+func propertyFilters(filters []Filter, list []PropertyFilter) []PropertyFilter {
+	for _, f := range filters {
+		switch x := f.(type) {
+		case PropertyFilter:
+			list = append(list, x)
+		case CompositeFilter:
+			list = propertyFilters(x.Filters, list)
+		}
+	}
+	return list
+}
+
+// queryShape hashes everything about a query that determines which
+// documents it returns and in what order, except its Limit.
+func queryShape(spec *QuerySpec) ([]byte, error) {
+	filters, err := shapeFilters(spec.Filters)
+	if err != nil {
+		return nil, err
+	}
+
+	orders := make([]interface{}, len(spec.Orders))
+	for i, o := range spec.Orders {
+		orders[i] = []interface{}{o.Path, int(o.Dir)}
+	}
+
+	cursors := make([]interface{}, 0, 2)
+	for _, c := range []*Cursor{spec.Start, spec.End} {
+		if c == nil {
+			cursors = append(cursors, nil)
+			continue
+		}
+		values, err := shapeValues(c.Values)
+		if err != nil {
+			return nil, err
+		}
+		cursors = append(cursors, []interface{}{values, c.Inclusive})
+	}
+
+	b, err := json.Marshal([]interface{}{
+		spec.Collection, spec.Group, filters, orders, cursors,
+		spec.Offset, spec.Projected, spec.Fields,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(b)
+	return sum[:], nil
+}
+
+func shapeFilters(filters []Filter) ([]interface{}, error) {
+	list := make([]interface{}, len(filters))
+	for i, f := range filters {
+		switch x := f.(type) {
+		case PropertyFilter:
+			values, err := shapeValues([]interface{}{x.Value})
+			if err != nil {
+				return nil, err
+			}
+			list[i] = []interface{}{x.Path, x.Op, values[0]}
+		case CompositeFilter:
+			sub, err := shapeFilters(x.Filters)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = []interface{}{x.Op, sub}
+		default:
+			return nil, fmt.Errorf("unsupported filter type %T", f)
+		}
+	}
+	return list, nil
+}
+
+// shapeValues normalizes query values, so that equivalent values such as
+// int and int64 hash the same.
+func shapeValues(values []interface{}) ([]interface{}, error) {
+	list := make([]interface{}, len(values))
+	for i, v := range values {
+		ev, err := encodeFilterValue(v)
+		if err != nil {
+			return nil, err
+		}
+		list[i], err = encodeTokenValue(ev)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// newPageToken returns a signed token for the position just after doc.
+func newPageToken(key []byte, shape []byte, orders []Order, doc BackendDocument) (string, error) {
+	data := doc.Data()
+
+	cursor := make([]interface{}, len(orders))
+	for i, o := range orders {
+		var v interface{}
+		if o.Path == firestore.DocumentID {
+			v = &firestore.DocumentRef{Path: doc.Path()}
+		} else {
+			var ok bool
+			v, ok = getField(data, o.Path)
+			if !ok {
+				return "", fmt.Errorf("page: order field %s missing from %s; is it selected?", o.Path, doc.Path())
+			}
+		}
+
+		var err error
+		cursor[i], err = encodeTokenValue(v)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	payload, err := json.Marshal(&pageToken{Shape: shape, Cursor: cursor})
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	payload = mac.Sum(payload)[:len(payload)+pageTokenMACSize]
+
+	return base64.RawURLEncoding.EncodeToString(payload), nil
+}
+
+// parsePageToken checks a token's signature and that it was issued for a
+// query with the given shape, and returns its cursor values.
+func parsePageToken(key []byte, shape []byte, token string) ([]interface{}, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) < pageTokenMACSize {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidPageToken)
+	}
+
+	payload, sig := b[:len(b)-pageTokenMACSize], b[len(b)-pageTokenMACSize:]
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)[:pageTokenMACSize]) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidPageToken)
+	}
+
+	pt := &pageToken{}
+	err = json.Unmarshal(payload, pt)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPageToken, err)
+	}
+	if !bytes.Equal(pt.Shape, shape) {
+		return nil, fmt.Errorf("%w: issued for a different query", ErrInvalidPageToken)
+	}
+
+	values := make([]interface{}, len(pt.Cursor))
+	for i, e := range pt.Cursor {
+		values[i], err = decodeTokenValue(e)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPageToken, err)
+		}
+	}
+
+	return values, nil
+}
+
+// encodeTokenValue converts a document value into a JSON value tagged with
+// its type, so that it can be decoded without loss.
+func encodeTokenValue(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case nil:
+		return []interface{}{"n"}, nil
+	case bool:
+		return []interface{}{"b", x}, nil
+	case int64:
+		return []interface{}{"i", strconv.FormatInt(x, 10)}, nil
+	case float64:
+		return []interface{}{"d", strconv.FormatFloat(x, 'g', -1, 64)}, nil
+	case string:
+		return []interface{}{"s", x}, nil
+	case []byte:
+		return []interface{}{"y", base64.RawURLEncoding.EncodeToString(x)}, nil
+	case time.Time:
+		return []interface{}{"t", x.UTC().Format(time.RFC3339Nano)}, nil
+	case memReference:
+		return []interface{}{"r", string(x)}, nil
+	case *firestore.DocumentRef:
+		return []interface{}{"r", x.Path}, nil
+	case []interface{}:
+		a := make([]interface{}, len(x))
+		for i, e := range x {
+			var err error
+			a[i], err = encodeTokenValue(e)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return []interface{}{"a", a}, nil
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(x))
+		for k, e := range x {
+			var err error
+			m[k], err = encodeTokenValue(e)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return []interface{}{"m", m}, nil
+	}
+
+	return nil, fmt.Errorf("page: unsupported cursor value type %T", v)
+}
+
+// decodeTokenValue reverses encodeTokenValue. Document references are
+// returned as *firestore.DocumentRef, which every backend accepts as a
+// cursor value.
+func decodeTokenValue(e interface{}) (interface{}, error) {
+	tv, ok := e.([]interface{})
+	if !ok || len(tv) == 0 {
+		return nil, fmt.Errorf("bad cursor value %v", e)
+	}
+	tag, _ := tv[0].(string)
+	if tag == "n" {
+		return nil, nil
+	}
+	if len(tv) != 2 {
+		return nil, fmt.Errorf("bad cursor value %v", e)
+	}
+
+	switch x := tv[1].(type) {
+	case bool:
+		if tag == "b" {
+			return x, nil
+		}
+	case string:
+		switch tag {
+		case "i":
+			return strconv.ParseInt(x, 10, 64)
+		case "d":
+			return strconv.ParseFloat(x, 64)
+		case "s":
+			return x, nil
+		case "y":
+			return base64.RawURLEncoding.DecodeString(x)
+		case "t":
+			return time.Parse(time.RFC3339Nano, x)
+		case "r":
+			id := x
+			if i := strings.LastIndex(x, "/"); i >= 0 {
+				id = x[i+1:]
+			}
+			return &firestore.DocumentRef{Path: x, ID: id}, nil
+		}
+	case []interface{}:
+		if tag == "a" {
+			a := make([]interface{}, len(x))
+			for i, v := range x {
+				var err error
+				a[i], err = decodeTokenValue(v)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return a, nil
+		}
+	case map[string]interface{}:
+		if tag == "m" {
+			m := make(map[string]interface{}, len(x))
+			for k, v := range x {
+				var err error
+				m[k], err = decodeTokenValue(v)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return m, nil
+		}
+	}
+
+	return nil, fmt.Errorf("bad cursor value %v", e)
+}
@@ -0,0 +1,132 @@
+package fsdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/tadhunt/logger"
+)
+
+// pageAll reads every page of a query, returning the names in order and the
+// tokens that were issued.
+func pageAll(t *testing.T, newQuery func() *Query, pageSize int) ([]string, []string) {
+	ctx := context.Background()
+
+	names := make([]string, 0)
+	tokens := make([]string, 0)
+	token := ""
+	for {
+		docs, next, err := newQuery().Page(ctx, pageSize, token)
+		if err != nil {
+			t.Fatalf("page %d: %v", len(tokens), err)
+		}
+		if len(docs) > pageSize || (next != "" && len(docs) != pageSize) {
+			t.Fatalf("page %d: got %d docs with next token %q", len(tokens), len(docs), next)
+		}
+		for _, doc := range docs {
+			u := &testUser{}
+			err := doc.DataTo(u)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			names = append(names, u.Name)
+		}
+		if next == "" {
+			return names, tokens
+		}
+		tokens = append(tokens, next)
+		token = next
+	}
+}
+
+func TestQueryPage(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	ages := map[string]int{"alice": 30, "bob": 25, "carol": 35, "dave": 25, "erin": 30, "frank": 30, "grace": 40}
+	for name, age := range ages {
+		err := db.Add(ctx, "teams/"+name[:1]+"/users/"+name, &testUser{Name: name, Age: age})
+		if err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	_, _, err := db.QueryGroup("users").Page(ctx, 2, "")
+	if !errors.Is(err, ErrNoPageTokenKey) {
+		t.Fatalf("no key: expected ErrNoPageTokenKey, got %v", err)
+	}
+	db.SetPageTokenKey([]byte("key"))
+
+	queries := []struct {
+		name  string
+		query func() *Query
+	}{
+		{"by age", func() *Query { return db.QueryGroup("users").OrderBy("Age", Desc) }},
+		{"inequality", func() *Query { return db.QueryGroup("users").Where("Age", "<", 40) }},
+		{"or", func() *Query {
+			return db.QueryGroup("users").WhereFilter(Or(Where("Age", "==", 30), Where("Name", "==", "bob")))
+		}},
+		{"collection", func() *Query { return db.Query("teams/a/users") }},
+	}
+	for _, tc := range queries {
+		want := fmt.Sprint(queryNames(t, db, tc.query()))
+		for _, size := range []int{1, 2, 3, 10} {
+			names, tokens := pageAll(t, tc.query, size)
+			if fmt.Sprint(names) != want {
+				t.Fatalf("%s, page size %d: got %v, want %s", tc.name, size, names, want)
+			}
+			for _, token := range tokens {
+				if strings.Trim(token, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+					t.Fatalf("%s: token %q is not URL safe", tc.name, token)
+				}
+			}
+		}
+	}
+
+	_, token, err := db.QueryGroup("users").OrderBy("Age", Asc).Page(ctx, 2, "")
+	if err != nil || token == "" {
+		t.Fatalf("first page: got token %q, %v", token, err)
+	}
+
+	_, _, err = db.QueryGroup("users").OrderBy("Age", Desc).Page(ctx, 2, token)
+	if !errors.Is(err, ErrInvalidPageToken) {
+		t.Fatalf("different order: expected ErrInvalidPageToken, got %v", err)
+	}
+	_, _, err = db.QueryGroup("users").OrderBy("Age", Asc).Where("Age", ">", 20).Page(ctx, 2, token)
+	if !errors.Is(err, ErrInvalidPageToken) {
+		t.Fatalf("different filter: expected ErrInvalidPageToken, got %v", err)
+	}
+
+	b := []byte(token)
+	b[len(b)/2] ^= 1
+	_, _, err = db.QueryGroup("users").OrderBy("Age", Asc).Page(ctx, 2, string(b))
+	if !errors.Is(err, ErrInvalidPageToken) {
+		t.Fatalf("tampered token: expected ErrInvalidPageToken, got %v", err)
+	}
+
+	other := NewDBConnectionFromBackend(logger.NewTestCompatLogWriter(t), "test", db.Backend())
+	other.SetPageTokenKey([]byte("other"))
+	_, _, err = other.QueryGroup("users").OrderBy("Age", Asc).Page(ctx, 2, token)
+	if !errors.Is(err, ErrInvalidPageToken) {
+		t.Fatalf("different key: expected ErrInvalidPageToken, got %v", err)
+	}
+
+	db.SetPageTokenKey([]byte("secret"))
+	other.SetPageTokenKey([]byte("secret"))
+	_, token, err = db.QueryGroup("users").OrderBy("Age", Asc).Page(ctx, 2, "")
+	if err != nil {
+		t.Fatalf("first page: %v", err)
+	}
+	docs, _, err := other.QueryGroup("users").OrderBy("Age", Asc).Limit(1).Page(ctx, 2, token)
+	if err != nil || len(docs) != 2 || docs[0].ID != "alice" {
+		t.Fatalf("shared key: got %d docs, %v", len(docs), err)
+	}
+
+	_, _, err = db.QueryGroup("users").OrderBy("Age", Asc).Select("Name").Page(ctx, 2, "")
+	if err == nil {
+		t.Fatalf("order field not selected: expected error")
+	}
+}
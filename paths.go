@@ -0,0 +1,62 @@
+package fsdb
+
+import (
+	"crypto/rand"
+	"strings"
+)
+
+const autoIDCharacters = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// newDocID returns a random document ID in the same form as Firestore's automatic IDs.
+func newDocID() string {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err) // crypto/rand.Read never returns an error on supported platforms
+	}
+
+	for i, v := range b {
+		b[i] = autoIDCharacters[int(v)%len(autoIDCharacters)]
+	}
+
+	return string(b)
+}
+
+// splitPath splits a slash separated path into its IDs, returning nil if any ID is empty.
+func splitPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+
+	ids := strings.Split(path, "/")
+	for _, id := range ids {
+		if id == "" {
+			return nil
+		}
+	}
+
+	return ids
+}
+
+// isDocPath reports whether path names a document, i.e. has an even number of non-empty IDs.
+func isDocPath(path string) bool {
+	ids := splitPath(path)
+	return len(ids) > 0 && len(ids)%2 == 0
+}
+
+// relativePath converts a full resource name
+// ("projects/{p}/databases/{d}/documents/users/alice") into a path relative
+// to the database root ("users/alice"). Paths that are already relative are
+// returned unchanged.
+func relativePath(name string) string {
+	if !strings.HasPrefix(name, "projects/") {
+		return name
+	}
+
+	_, rel, found := strings.Cut(name, "/documents/")
+	if !found {
+		return name
+	}
+
+	return rel
+}
@@ -27,14 +27,18 @@ const (
 //		Limit(10).
 //		Documents(ctx)
 type Query struct {
-	query firestore.Query
-	tx    *firestore.Transaction
+	spec    QuerySpec
+	db      *DBConnection
+	backend Backend
+	tx      BackendTransaction
 }
 
 // Query creates a new query builder for the named collection.
 func (db *DBConnection) Query(colname string) *Query {
 	return &Query{
-		query: db.Client.Collection(colname).Query,
+		spec:    QuerySpec{Collection: colname},
+		db:      db,
+		backend: db.backend,
 	}
 }
 
@@ -43,23 +47,29 @@ func (db *DBConnection) Query(colname string) *Query {
 // regardless of their parent document.
 func (db *DBConnection) QueryGroup(colname string) *Query {
 	return &Query{
-		query: db.Client.CollectionGroup(colname).Query,
+		spec:    QuerySpec{Collection: colname, Group: true},
+		db:      db,
+		backend: db.backend,
 	}
 }
 
 // Query creates a new query builder for the named collection within a transaction.
 func (t *Transaction) Query(colname string) *Query {
 	return &Query{
-		query: t.db.Client.Collection(colname).Query,
-		tx:    t.ft,
+		spec:    QuerySpec{Collection: colname},
+		db:      t.db,
+		backend: t.db.backend,
+		tx:      t.bt,
 	}
 }
 
 // QueryGroup creates a new query builder for a collection group within a transaction.
 func (t *Transaction) QueryGroup(colname string) *Query {
 	return &Query{
-		query: t.db.Client.CollectionGroup(colname).Query,
-		tx:    t.ft,
+		spec:    QuerySpec{Collection: colname, Group: true},
+		db:      t.db,
+		backend: t.db.backend,
+		tx:      t.bt,
 	}
 }
 
@@ -67,75 +77,109 @@ func (t *Transaction) QueryGroup(colname string) *Query {
 // The op argument must be one of "==", "!=", "<", "<=", ">", ">=",
 // "array-contains", "array-contains-any", "in", or "not-in".
 func (q *Query) Where(path, op string, value interface{}) *Query {
-	q.query = q.query.Where(path, op, value)
+	q.spec.Filters = append(q.spec.Filters, PropertyFilter{Path: path, Op: op, Value: value})
 	return q
 }
 
+// WhereFilter adds a filter, such as one built with Or or And, to the query.
+//
+// Example:
+//
+//	iter := db.Query("users").
+//		WhereFilter(fsdb.Or(
+//			fsdb.Where("role", "==", "admin"),
+//			fsdb.And(fsdb.Where("role", "==", "user"), fsdb.Where("age", ">=", 18)),
+//		)).
+//		Documents(ctx)
+func (q *Query) WhereFilter(filter Filter) *Query {
+	q.spec.Filters = append(q.spec.Filters, filter)
+	return q
+}
+
+// Where returns a filter comparing a field with a value, for use with Or, And and WhereFilter.
+func Where(path, op string, value interface{}) PropertyFilter {
+	return PropertyFilter{Path: path, Op: op, Value: value}
+}
+
+// Or returns a filter matching documents that match any of filters.
+func Or(filters ...Filter) CompositeFilter {
+	return CompositeFilter{Op: "or", Filters: filters}
+}
+
+// And returns a filter matching documents that match all of filters.
+func And(filters ...Filter) CompositeFilter {
+	return CompositeFilter{Op: "and", Filters: filters}
+}
+
 // OrderBy adds a sort ordering to the query.
 // Multiple OrderBy calls can be chained; they are applied in order.
 func (q *Query) OrderBy(path string, dir Direction) *Query {
-	q.query = q.query.OrderBy(path, dir)
+	q.spec.Orders = append(q.spec.Orders, Order{Path: path, Dir: dir})
 	return q
 }
 
 // Limit sets the maximum number of results to return.
 func (q *Query) Limit(n int) *Query {
-	q.query = q.query.Limit(n)
+	q.spec.Limit = n
+	q.spec.LimitToLast = false
 	return q
 }
 
 // LimitToLast sets the maximum number of results to return from the end
 // of the ordered result set. Requires at least one OrderBy clause.
 func (q *Query) LimitToLast(n int) *Query {
-	q.query = q.query.LimitToLast(n)
+	q.spec.Limit = n
+	q.spec.LimitToLast = true
 	return q
 }
 
 // Offset sets the number of results to skip before returning results.
 func (q *Query) Offset(n int) *Query {
-	q.query = q.query.Offset(n)
+	q.spec.Offset = n
 	return q
 }
 
 // StartAt sets the query cursor to start at the given field values (inclusive).
 // The values must correspond to the OrderBy fields, in the same order.
 func (q *Query) StartAt(values ...interface{}) *Query {
-	q.query = q.query.StartAt(values...)
+	q.spec.Start = &Cursor{Values: values, Inclusive: true}
 	return q
 }
 
 // StartAfter sets the query cursor to start after the given field values (exclusive).
 // The values must correspond to the OrderBy fields, in the same order.
 func (q *Query) StartAfter(values ...interface{}) *Query {
-	q.query = q.query.StartAfter(values...)
+	q.spec.Start = &Cursor{Values: values}
 	return q
 }
 
 // EndAt sets the query cursor to end at the given field values (inclusive).
 // The values must correspond to the OrderBy fields, in the same order.
 func (q *Query) EndAt(values ...interface{}) *Query {
-	q.query = q.query.EndAt(values...)
+	q.spec.End = &Cursor{Values: values, Inclusive: true}
 	return q
 }
 
 // EndBefore sets the query cursor to end before the given field values (exclusive).
 // The values must correspond to the OrderBy fields, in the same order.
 func (q *Query) EndBefore(values ...interface{}) *Query {
-	q.query = q.query.EndBefore(values...)
+	q.spec.End = &Cursor{Values: values}
 	return q
 }
 
 // Select specifies which document fields to return.
 // If no fields are specified, only document references are returned.
 func (q *Query) Select(fields ...string) *Query {
-	q.query = q.query.Select(fields...)
+	q.spec.Projected = true
+	q.spec.Fields = fields
 	return q
 }
 
 // Documents executes the query and returns a DocumentIterator over the results.
 func (q *Query) Documents(ctx context.Context) *DocumentIterator {
+	q.db.recordQuery(&q.spec)
 	if q.tx != nil {
-		return &DocumentIterator{q.tx.Documents(q.query)}
+		return newDocumentIterator(q.tx.Documents(&q.spec))
 	}
-	return &DocumentIterator{q.query.Documents(ctx)}
+	return newDocumentIterator(q.backend.Documents(ctx, &q.spec))
 }
@@ -0,0 +1,98 @@
+package fsdb
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Snapshot is a document as it was when it was read, along with its metadata.
+type Snapshot struct {
+	ID         string    // the document's ID, the last element of its path
+	Path       string    // the document's full resource name
+	Parent     string    // the full resource name of the document's collection
+	CreateTime time.Time // zero if the document does not exist
+	UpdateTime time.Time // zero if the document does not exist
+	ReadTime   time.Time
+
+	doc BackendDocument
+}
+
+func newSnapshot(doc BackendDocument) *Snapshot {
+	path := doc.Path()
+
+	snap := &Snapshot{
+		ID:         path,
+		Path:       path,
+		CreateTime: doc.CreateTime(),
+		UpdateTime: doc.UpdateTime(),
+		ReadTime:   doc.ReadTime(),
+		doc:        doc,
+	}
+
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		snap.ID = path[i+1:]
+		snap.Parent = path[:i]
+	}
+
+	return snap
+}
+
+// Exists reports whether the document exists.
+func (s *Snapshot) Exists() bool {
+	return s.doc.Exists()
+}
+
+// Data returns the document's fields as a map.
+func (s *Snapshot) Data() map[string]interface{} {
+	return s.doc.Data()
+}
+
+// DataTo decodes the document's fields into dval, which must be a pointer.
+func (s *Snapshot) DataTo(dval interface{}) error {
+	return s.doc.DataTo(dval)
+}
+
+// GetSnapshot reads a document, returning a NotFound error if it does not exist.
+func (db *DBConnection) GetSnapshot(ctx context.Context, docname string) (*Snapshot, error) {
+	doc, err := db.backend.Get(ctx, docname)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSnapshot(doc), nil
+}
+
+// NextSnapshot returns the next document from an iterator, or DBIteratorDone.
+func (db *DBConnection) NextSnapshot(ctx context.Context, iter *DocumentIterator) (*Snapshot, error) {
+	return iter.nextSnapshot()
+}
+
+// GetSnapshot reads a document as part of the transaction.
+func (t *Transaction) GetSnapshot(docname string) (*Snapshot, error) {
+	doc, err := t.bt.Get(docname)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSnapshot(doc), nil
+}
+
+// NextSnapshot returns the next document from an iterator, or DBIteratorDone.
+func (t *Transaction) NextSnapshot(iter *DocumentIterator) (*Snapshot, error) {
+	return iter.nextSnapshot()
+}
+
+func (it *DocumentIterator) nextSnapshot() (*Snapshot, error) {
+	doc, err := it.it.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	return newSnapshot(doc), nil
+}
+
+// Snapshot returns the document the change refers to.
+func (dc *DocumentChange) Snapshot() *Snapshot {
+	return newSnapshot(dc.doc)
+}
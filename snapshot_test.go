@@ -0,0 +1,99 @@
+package fsdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	err := db.Add(ctx, "users/alice", &testUser{Name: "alice", Age: 30})
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	err = db.Add(ctx, "users/alice/posts/p1", map[string]interface{}{"title": "hello"})
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	snap, err := db.GetSnapshot(ctx, "users/alice/posts/p1")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if snap.ID != "p1" || relativePath(snap.Path) != "users/alice/posts/p1" || relativePath(snap.Parent+"/x") != "users/alice/posts/x" {
+		t.Fatalf("get: unexpected names %q %q %q", snap.ID, snap.Path, snap.Parent)
+	}
+	if !snap.Exists() || snap.CreateTime.IsZero() || !snap.UpdateTime.Equal(snap.CreateTime) || snap.ReadTime.Before(snap.UpdateTime) {
+		t.Fatalf("get: unexpected metadata %#v", snap)
+	}
+	if snap.Data()["title"] != "hello" {
+		t.Fatalf("get: unexpected data %#v", snap.Data())
+	}
+
+	_, err = db.GetSnapshot(ctx, "users/bob")
+	if !ErrorIsNotFound(err) {
+		t.Fatalf("get missing: expected NotFound, got %v", err)
+	}
+
+	iter := db.DocumentIterator(ctx, "users")
+	defer iter.Stop()
+	snap, err = db.NextSnapshot(ctx, iter)
+	if err != nil {
+		t.Fatalf("next: %v", err)
+	}
+	u := &testUser{}
+	err = snap.DataTo(u)
+	if err != nil || u.Name != "alice" || snap.ID != "alice" {
+		t.Fatalf("next: unexpected %#v %v", u, err)
+	}
+	_, err = db.NextSnapshot(ctx, iter)
+	if !errors.Is(err, DBIteratorDone) {
+		t.Fatalf("next: expected DBIteratorDone, got %v", err)
+	}
+
+	err = db.UpdateIfUnchanged(ctx, "users/alice", snap, Set("Age", 31))
+	if err != nil {
+		t.Fatalf("update unchanged: %v", err)
+	}
+
+	err = db.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		snap, err := tx.GetSnapshot("users/alice")
+		if err != nil {
+			return err
+		}
+		if !snap.UpdateTime.After(snap.CreateTime) {
+			t.Errorf("transaction get: update time not after create time")
+		}
+
+		iter := tx.DocumentIterator("users/alice/posts")
+		defer iter.Stop()
+		snap, err = tx.NextSnapshot(iter)
+		if err != nil {
+			return err
+		}
+		if snap.ID != "p1" {
+			t.Errorf("transaction next: got %q", snap.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("transaction: %v", err)
+	}
+
+	n := 0
+	for snap, err := range db.QueryGroup("posts").Documents(ctx).Snapshots() {
+		if err != nil {
+			t.Fatalf("snapshots: %v", err)
+		}
+		if snap.ID != "p1" {
+			t.Fatalf("snapshots: got %q", snap.ID)
+		}
+		n++
+	}
+	if n != 1 {
+		t.Fatalf("snapshots: got %d, want 1", n)
+	}
+}
@@ -1,7 +1,6 @@
 package fsdb
 
 import (
-	"cloud.google.com/go/firestore"
 	"google.golang.org/api/iterator"
 	"context"
 	"fmt"
@@ -11,7 +10,8 @@ type TransactionFunc func(ctx context.Context, t *Transaction) error
 
 type Transaction struct {
 	db     *DBConnection
-	ft     *firestore.Transaction
+	ctx    context.Context
+	bt     BackendTransaction
 	tfuncs []TransactionFunc
 }
 
@@ -21,11 +21,12 @@ func (db *DBConnection) RunTransaction(ctx context.Context, tfuncs ...Transactio
 		tfuncs: tfuncs,
 	}
 
-	return db.Client.RunTransaction(ctx, transaction.handler)
+	return db.backend.RunTransaction(ctx, transaction.handler)
 }
 
-func (t *Transaction) handler(ctx context.Context, ft *firestore.Transaction) error {
-	t.ft = ft
+func (t *Transaction) handler(ctx context.Context, bt BackendTransaction) error {
+	t.ctx = ctx
+	t.bt = bt
 
 	for _, tfunc := range t.tfuncs {
 		err := tfunc(ctx, t)
@@ -38,12 +39,11 @@ func (t *Transaction) handler(ctx context.Context, ft *firestore.Transaction) er
 }
 
 func (t *Transaction) Add(docname string, dval interface{}) error {
-	dref := t.db.Client.Doc(docname)
-	if dref == nil {
+	if !isDocPath(docname) {
 		return fmt.Errorf("nil dref: bad docname '%s'?", docname)
 	}
 
-	err := t.ft.Create(dref, dval)
+	err := t.bt.Create(docname, dval)
 	if err != nil {
 		return err
 	}
@@ -54,9 +54,7 @@ func (t *Transaction) Add(docname string, dval interface{}) error {
 }
 
 func (t *Transaction) AddOrReplace(docname string, dval interface{}) error {
-	dref := t.db.Client.Doc(docname)
-
-	err := t.ft.Set(dref, dval)
+	err := t.bt.Set(docname, dval)
 	if err != nil {
 		return err
 	}
@@ -67,9 +65,7 @@ func (t *Transaction) AddOrReplace(docname string, dval interface{}) error {
 }
 
 func (t *Transaction) Delete(docname string) error {
-	dref := t.db.Client.Doc(docname)
-
-	err := t.ft.Delete(dref)
+	err := t.bt.Delete(docname)
 	if err != nil {
 		return err
 	}
@@ -78,14 +74,12 @@ func (t *Transaction) Delete(docname string) error {
 }
 
 func (t *Transaction) Get(docname string, dval interface{}) error {
-	dref := t.db.Client.Doc(docname)
-
-	dsnap, err := t.ft.Get(dref)
+	doc, err := t.bt.Get(docname)
 	if err != nil {
 		return err
 	}
 
-	return dsnap.DataTo(dval)
+	return doc.DataTo(dval)
 }
 
 func (t *Transaction) Escape(raw string) string {
@@ -93,42 +87,24 @@ func (t *Transaction) Escape(raw string) string {
 }
 
 func (t *Transaction) DocumentIterator(colname string) *DocumentIterator {
-	col := t.db.Client.Collection(colname)
-
-	iter := t.ft.Documents(col)
-
-	return &DocumentIterator{iter}
+	return t.Query(colname).Documents(t.ctx)
 }
 
 func (t *Transaction) QueryIterator(colname string, attr string, comparison string, val string) *DocumentIterator {
-	col := t.db.Client.Collection(colname)
-
-	query := col.Where(attr, comparison, val)
-
-	iter := t.ft.Documents(query)
-
-	return &DocumentIterator{iter}
+	return t.Query(colname).Where(attr, comparison, val).Documents(t.ctx)
 }
 
 func (t *Transaction) CompoundQueryIterator(colname string, wheres []*DbWhere) *DocumentIterator {
-	col := t.db.Client.Collection(colname)
-
-	var query firestore.Query
-	for i, w := range wheres {
-		if i == 0 {
-			query = col.Where(w.Attr, w.Comparison, w.Val)
-		} else {
-			query = query.Where(w.Attr, w.Comparison, w.Val)
-		}
+	query := t.Query(colname)
+	for _, w := range wheres {
+		query = query.Where(w.Attr, w.Comparison, w.Val)
 	}
 
-	iter := t.ft.Documents(query)
-
-	return &DocumentIterator{iter}
+	return query.Documents(t.ctx)
 }
 
 func (t *Transaction) NextDocPath(iter *DocumentIterator, dval interface{}) (string, error) {
-	dsnap, err := iter.Next()
+	doc, err := iter.it.Next()
 	if err == iterator.Done {
 		return "", DBIteratorDone
 	}
@@ -137,26 +113,35 @@ func (t *Transaction) NextDocPath(iter *DocumentIterator, dval interface{}) (str
 	}
 
 	if dval != nil {
-		err = dsnap.DataTo(dval)
+		err = doc.DataTo(dval)
 		if err != nil {
 			return "", err
 		}
 	}
 
-	return dsnap.Ref.Path, nil
+	return doc.Path(), nil
 }
 
+// DeleteCollection deletes every document in a collection as part of the
+// transaction. Since a transaction can make at most MaxBatchWrites writes,
+// it fails without deleting anything if the collection is too large; use
+// DBConnection.DeleteCollection for large collections. It reads the
+// collection, so like any read it must come before the transaction's
+// writes.
 func (t *Transaction) DeleteCollection(path string) error {
-	col := t.db.Client.Collection(path)
-	iter := t.ft.Documents(col.Select())
+	iter := t.bt.Documents(&QuerySpec{Collection: path, Projected: true, Limit: MaxBatchWrites + 1})
 	defer iter.Stop()
 
-	docIDs, err := iter.GetAll()
+	docs, err := getAll(iter)
 	if err != nil {
 		return err
 	}
-	for _, doc := range docIDs {
-		err := t.ft.Delete(doc.Ref)
+	if len(docs) > MaxBatchWrites {
+		return fmt.Errorf("delete collection %s: more than %d documents: %w", path, MaxBatchWrites, ErrTransactionTooLarge)
+	}
+
+	for _, doc := range docs {
+		err := t.bt.Delete(relativePath(doc.Path()))
 		if err != nil {
 			return err
 		}
@@ -168,12 +153,10 @@ func (t *Transaction) DeleteCollection(path string) error {
 type DBCreateFunc func(ctx context.Context, dval interface{}) error
 
 func (db *DBConnection) AtomicGetOrCreate(ctx context.Context, docname string, dval interface{}, createfunc DBCreateFunc) error {
-	dref := db.Client.Doc(docname)
-
-	txfunc := func(ctx context.Context, tx *firestore.Transaction) error {
-		dsnap, err := tx.Get(dref)
+	txfunc := func(ctx context.Context, tx BackendTransaction) error {
+		doc, err := tx.Get(docname)
 		if err == nil {
-			dsnap.DataTo(dval)
+			doc.DataTo(dval)
 			return nil
 		}
 
@@ -186,7 +169,7 @@ func (db *DBConnection) AtomicGetOrCreate(ctx context.Context, docname string, d
 			return err
 		}
 
-		err = tx.Create(dref, dval)
+		err = tx.Create(docname, dval)
 		if err != nil {
 			return err
 		}
@@ -194,7 +177,7 @@ func (db *DBConnection) AtomicGetOrCreate(ctx context.Context, docname string, d
 		return nil
 	}
 
-	err := db.Client.RunTransaction(ctx, txfunc)
+	err := db.backend.RunTransaction(ctx, txfunc)
 
 	if err != nil {
 		return err
@@ -206,15 +189,13 @@ func (db *DBConnection) AtomicGetOrCreate(ctx context.Context, docname string, d
 type DBUpdateFunc func(ctx context.Context, dval interface{}) error
 
 func (db *DBConnection) AtomicUpdate(ctx context.Context, docname string, dval interface{}, updateFunc DBUpdateFunc) error {
-	dref := db.Client.Doc(docname)
-
-	txfunc := func(ctx context.Context, tx *firestore.Transaction) error {
-		dsnap, err := tx.Get(dref)
+	txfunc := func(ctx context.Context, tx BackendTransaction) error {
+		doc, err := tx.Get(docname)
 		if err != nil {
 			return err
 		}
 
-		err = dsnap.DataTo(dval)
+		err = doc.DataTo(dval)
 		if err != nil {
 			return err
 		}
@@ -224,7 +205,7 @@ func (db *DBConnection) AtomicUpdate(ctx context.Context, docname string, dval i
 			return err
 		}
 
-		err = tx.Set(dref, dval)
+		err = tx.Set(docname, dval)
 		if err != nil {
 			return err
 		}
@@ -232,7 +213,7 @@ func (db *DBConnection) AtomicUpdate(ctx context.Context, docname string, dval i
 		return nil
 	}
 
-	err := db.Client.RunTransaction(ctx, txfunc)
+	err := db.backend.RunTransaction(ctx, txfunc)
 
 	if err != nil {
 		return err
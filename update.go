@@ -0,0 +1,105 @@
+package fsdb
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/firestore"
+)
+
+// Set returns a FieldUpdate that sets the field at the dot separated path to value.
+func Set(path string, value interface{}) FieldUpdate {
+	return FieldUpdate{Path: path, Value: value}
+}
+
+// Increment returns a FieldUpdate that adds n, an integer or floating point
+// number, to the field's current value. A missing or non-numeric field is
+// set to n.
+func Increment(path string, n interface{}) FieldUpdate {
+	return FieldUpdate{Path: path, Value: n, transform: transformIncrement}
+}
+
+// ArrayUnion returns a FieldUpdate that appends each of values not already
+// present to the array field. A missing or non-array field is replaced.
+func ArrayUnion(path string, values ...interface{}) FieldUpdate {
+	return FieldUpdate{Path: path, Value: values, transform: transformArrayUnion}
+}
+
+// ArrayRemove returns a FieldUpdate that removes every instance of each of
+// values from the array field. A missing or non-array field is set to an
+// empty array.
+func ArrayRemove(path string, values ...interface{}) FieldUpdate {
+	return FieldUpdate{Path: path, Value: values, transform: transformArrayRemove}
+}
+
+// ServerTimestamp returns a FieldUpdate that sets the field to the time the
+// write is committed.
+func ServerTimestamp(path string) FieldUpdate {
+	return FieldUpdate{Path: path, Value: firestore.ServerTimestamp}
+}
+
+// DeleteField returns a FieldUpdate that removes the field.
+func DeleteField(path string) FieldUpdate {
+	return FieldUpdate{Path: path, Value: firestore.Delete}
+}
+
+// Update changes fields of an existing document without reading it first.
+// It fails with a NotFound error if the document does not exist.
+//
+// Example:
+//
+//	err := db.Update(ctx, "counters/visits",
+//		fsdb.Increment("count", 1),
+//		fsdb.ServerTimestamp("updatedAt"))
+func (db *DBConnection) Update(ctx context.Context, docname string, updates ...FieldUpdate) error {
+	if !isDocPath(docname) {
+		return db.log.ErrFmt("nil dref: bad docname '%s'?", docname)
+	}
+
+	err := db.backend.Update(ctx, docname, updates)
+	if err != nil {
+		return err
+	}
+
+	db.log.Debugf("docname %s updates %d", docname, len(updates))
+
+	return nil
+}
+
+// SetMerge creates a document or merges dval into it. If fields are given,
+// only those dot separated field paths are written and each must be present
+// in dval; otherwise every field in dval is written and dval must be a map.
+func (db *DBConnection) SetMerge(ctx context.Context, docname string, dval interface{}, fields ...string) error {
+	if !isDocPath(docname) {
+		return db.log.ErrFmt("nil dref: bad docname '%s'?", docname)
+	}
+
+	err := db.backend.SetMerge(ctx, docname, dval, fields)
+	if err != nil {
+		return err
+	}
+
+	db.log.Debugf("docname %s dval %#v", docname, dval)
+
+	return nil
+}
+
+// Update changes fields of an existing document as part of the transaction.
+// See DBConnection.Update.
+func (t *Transaction) Update(docname string, updates ...FieldUpdate) error {
+	if !isDocPath(docname) {
+		return fmt.Errorf("nil dref: bad docname '%s'?", docname)
+	}
+
+	return t.bt.Update(docname, updates)
+}
+
+// SetMerge creates a document or merges dval into it as part of the
+// transaction. See DBConnection.SetMerge.
+func (t *Transaction) SetMerge(docname string, dval interface{}, fields ...string) error {
+	if !isDocPath(docname) {
+		return fmt.Errorf("nil dref: bad docname '%s'?", docname)
+	}
+
+	return t.bt.SetMerge(docname, dval, fields)
+}
@@ -0,0 +1,226 @@
+package fsdb
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestUpdate(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	err := db.Update(ctx, "counters/visits", Increment("count", 1))
+	if !ErrorIsNotFound(err) {
+		t.Fatalf("update missing: expected NotFound, got %v", err)
+	}
+
+	err = db.Add(ctx, "counters/visits", map[string]interface{}{
+		"count": 1,
+		"tags":  []interface{}{"a", "b", "a"},
+		"old":   true,
+		"a":     map[string]interface{}{"b": 1, "c": 2},
+		"max":   int64(math.MaxInt64 - 1),
+	})
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	err = db.Update(ctx, "counters/visits",
+		Set("a.b", "x"),
+		Increment("count", 2),
+		Increment("ratio", 0.5),
+		Increment("max", 10),
+		ArrayUnion("tags", "b", "c"),
+		ArrayRemove("other", "z"),
+		ServerTimestamp("updatedAt"),
+		DeleteField("old"))
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	m := map[string]interface{}{}
+	err = db.Get(ctx, "counters/visits", &m)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if m["count"] != int64(3) || m["ratio"] != 0.5 || m["max"] != int64(math.MaxInt64) {
+		t.Fatalf("increment: unexpected %#v", m)
+	}
+	if fmt.Sprint(m["tags"]) != "[a b a c]" || fmt.Sprint(m["other"]) != "[]" {
+		t.Fatalf("array transforms: unexpected %#v", m)
+	}
+	if fmt.Sprint(m["a"]) != "map[b:x c:2]" {
+		t.Fatalf("nested set: unexpected %#v", m["a"])
+	}
+	if _, ok := m["old"]; ok {
+		t.Fatalf("delete field: still present")
+	}
+	if ts, ok := m["updatedAt"].(time.Time); !ok || ts.IsZero() {
+		t.Fatalf("server timestamp: unexpected %#v", m["updatedAt"])
+	}
+
+	err = db.Update(ctx, "counters/visits", ArrayRemove("tags", "a"), Increment("count", 1.5))
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	m = map[string]interface{}{}
+	err = db.Get(ctx, "counters/visits", &m)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if fmt.Sprint(m["tags"]) != "[b c]" || m["count"] != 4.5 {
+		t.Fatalf("second update: unexpected %#v", m)
+	}
+
+	err = db.Update(ctx, "counters/visits", Increment("count", "one"))
+	if err == nil {
+		t.Fatalf("increment by string: expected error")
+	}
+	err = db.Update(ctx, "counters/visits", Set("a", 1), Set("a.b", 2))
+	if err == nil {
+		t.Fatalf("conflicting paths: expected error")
+	}
+	err = db.Update(ctx, "counters", Set("a", 1))
+	if err == nil {
+		t.Fatalf("collection path: expected error")
+	}
+}
+
+func TestSetMerge(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	err := db.SetMerge(ctx, "users/alice", map[string]interface{}{"Name": "alice", "meta": map[string]interface{}{"x": 1}})
+	if err != nil {
+		t.Fatalf("merge into missing document: %v", err)
+	}
+
+	err = db.SetMerge(ctx, "users/alice", map[string]interface{}{"Age": 30, "meta": map[string]interface{}{"y": 2}})
+	if err != nil {
+		t.Fatalf("merge all: %v", err)
+	}
+
+	m := map[string]interface{}{}
+	err = db.Get(ctx, "users/alice", &m)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if m["Name"] != "alice" || m["Age"] != int64(30) || fmt.Sprint(m["meta"]) != "map[x:1 y:2]" {
+		t.Fatalf("merge all: unexpected %#v", m)
+	}
+
+	err = db.SetMerge(ctx, "users/alice", &testUser{Name: "ignored", Age: 31}, "Age", "created")
+	if err != nil {
+		t.Fatalf("merge fields: %v", err)
+	}
+
+	u := &testUser{}
+	err = db.Get(ctx, "users/alice", u)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if u.Name != "alice" || u.Age != 31 || u.Created.IsZero() {
+		t.Fatalf("merge fields: unexpected %#v", u)
+	}
+
+	err = db.SetMerge(ctx, "users/alice", &testUser{Name: "bob"})
+	if err == nil {
+		t.Fatalf("merge all with struct: expected error")
+	}
+	err = db.SetMerge(ctx, "users/alice", &testUser{Name: "bob"}, "missing")
+	if err == nil {
+		t.Fatalf("merge of field not in data: expected error")
+	}
+}
+
+func TestTransactionUpdate(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	err := db.Add(ctx, "counters/c", map[string]interface{}{"count": 0})
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	err = db.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		err := tx.Update("counters/c", Increment("count", 5))
+		if err != nil {
+			return err
+		}
+		return tx.SetMerge("counters/d", map[string]interface{}{"count": 1})
+	})
+	if err != nil {
+		t.Fatalf("transaction: %v", err)
+	}
+
+	for path, want := range map[string]int64{"counters/c": 5, "counters/d": 1} {
+		m := map[string]interface{}{}
+		err = db.Get(ctx, path, &m)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if m["count"] != want {
+			t.Fatalf("%s: got %#v, want %d", path, m["count"], want)
+		}
+	}
+}
+
+func TestUnchangedPreconditions(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	err := db.Add(ctx, "users/alice", &testUser{Name: "alice", Age: 30})
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	snap, err := db.GetSnapshot(ctx, "users/alice")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+
+	err = db.UpdateIfUnchanged(ctx, "users/alice", snap, Increment("Age", 1))
+	if err != nil {
+		t.Fatalf("update unchanged: %v", err)
+	}
+
+	err = db.UpdateIfUnchanged(ctx, "users/alice", snap, Increment("Age", 1))
+	if !ErrorIsPreconditionFailed(err) {
+		t.Fatalf("update changed: expected FailedPrecondition, got %v", err)
+	}
+	err = db.DeleteIfUnchanged(ctx, "users/alice", snap)
+	if !ErrorIsPreconditionFailed(err) {
+		t.Fatalf("delete changed: expected FailedPrecondition, got %v", err)
+	}
+
+	snap2, err := db.GetSnapshot(ctx, "users/alice")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	u := &testUser{}
+	err = snap2.DataTo(u)
+	if err != nil || u.Age != 31 || !snap2.UpdateTime.After(snap.UpdateTime) {
+		t.Fatalf("get after update: unexpected %#v %#v %v", u, snap2, err)
+	}
+
+	err = db.DeleteIfUnchanged(ctx, "users/alice", snap2)
+	if err != nil {
+		t.Fatalf("delete unchanged: %v", err)
+	}
+
+	err = db.UpdateIfUnchanged(ctx, "users/alice", snap2, Increment("Age", 1))
+	if !ErrorIsPreconditionFailed(err) {
+		t.Fatalf("update deleted: expected FailedPrecondition, got %v", err)
+	}
+	err = db.DeleteIfUnchanged(ctx, "users/alice", nil)
+	if !ErrorIsPreconditionFailed(err) {
+		t.Fatalf("delete missing: expected FailedPrecondition, got %v", err)
+	}
+	err = db.Delete(ctx, "users/alice", Exists)
+	if !ErrorIsNotFound(err) {
+		t.Fatalf("delete missing with Exists: expected NotFound, got %v", err)
+	}
+}
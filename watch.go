@@ -0,0 +1,355 @@
+package fsdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultWatchBuffer is the number of batches Watch buffers for a slow
+// consumer.
+const DefaultWatchBuffer = 16
+
+// WatchPolicy says what a watch does when its consumer falls behind and the
+// channel's buffer is full.
+type WatchPolicy int
+
+const (
+	// WatchBlock stops reading snapshots until the consumer catches up.
+	WatchBlock WatchPolicy = iota
+
+	// WatchCoalesce keeps reading snapshots, and when the consumer catches
+	// up delivers a single batch with the changes since the last batch it
+	// received.
+	WatchCoalesce
+
+	// WatchFail ends the watch with ErrSlowConsumer.
+	WatchFail
+)
+
+// WatchOptions configures WatchWithOptions. The zero value is usable.
+type WatchOptions struct {
+	// Buffer is the capacity of the channel, or 0 for DefaultWatchBuffer.
+	Buffer int
+
+	// Policy says what to do when the buffer is full.
+	Policy WatchPolicy
+}
+
+// Change is a single change to the results of a watched query.
+type Change[T any] struct {
+	Kind DocumentChangeKind
+
+	// ID and Path are the document's ID and full resource name.
+	ID   string
+	Path string
+
+	// OldIndex is the document's position before the change, or -1 if it
+	// was added. NewIndex is its position after the change, or -1 if it was
+	// removed.
+	OldIndex int
+	NewIndex int
+
+	// ReadTime is the time of the snapshot that reported the change.
+	ReadTime time.Time
+
+	// Value is the document after the change, or nil if it was removed.
+	Value *T
+
+	// Previous is the document as of the consumer's previous batch, or nil
+	// if it was added.
+	Previous *T
+}
+
+// ChangeBatch holds the changes to a watched query's results.
+type ChangeBatch struct {
+	// Changes lists the changes since the previous batch. The first batch
+	// reports every result as added.
+	Changes []Change[Snapshot]
+
+	// Docs holds all of the query's results, in query order.
+	Docs []*Snapshot
+
+	// ReadTime is the time of the snapshot.
+	ReadTime time.Time
+
+	// Coalesced is the number of snapshots folded into this batch by
+	// WatchCoalesce, or 0.
+	Coalesced int
+
+	// Err is set on the last batch if the watch failed. Changes and Docs
+	// are then empty.
+	Err error
+}
+
+// DecodeChanges decodes the values of a batch's changes into T.
+//
+// Example:
+//
+//	for batch := range ch {
+//		changes, err := fsdb.DecodeChanges[User](batch)
+//		...
+//	}
+func DecodeChanges[T any](batch ChangeBatch) ([]Change[T], error) {
+	if batch.Err != nil {
+		return nil, batch.Err
+	}
+
+	changes := make([]Change[T], len(batch.Changes))
+	for i, c := range batch.Changes {
+		changes[i] = Change[T]{
+			Kind:     c.Kind,
+			ID:       c.ID,
+			Path:     c.Path,
+			OldIndex: c.OldIndex,
+			NewIndex: c.NewIndex,
+			ReadTime: c.ReadTime,
+		}
+
+		var err error
+		changes[i].Value, err = decodeSnapshot[T](c.Value)
+		if err != nil {
+			return nil, err
+		}
+		changes[i].Previous, err = decodeSnapshot[T](c.Previous)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return changes, nil
+}
+
+func decodeSnapshot[T any](snap *Snapshot) (*T, error) {
+	if snap == nil {
+		return nil, nil
+	}
+
+	dval := new(T)
+	err := snap.DataTo(dval)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", snap.Path, err)
+	}
+
+	return dval, nil
+}
+
+// Watch listens to a query, sending a batch on the returned channel each
+// time its results change, with the default WatchOptions. See
+// WatchWithOptions.
+func (db *DBConnection) Watch(ctx context.Context, q *Query) (<-chan ChangeBatch, error) {
+	return db.WatchWithOptions(ctx, q, nil)
+}
+
+// WatchWithOptions listens to a query, sending a batch on the returned
+// channel each time its results change. The channel is closed when ctx is
+// done, or after a batch with Err set if the watch fails. Changes made to q
+// after the call do not affect the watch.
+//
+// Example:
+//
+//	ch, err := db.WatchWithOptions(ctx, db.Query("users").Where("team", "==", "a"),
+//		&fsdb.WatchOptions{Policy: fsdb.WatchCoalesce})
+//	...
+//	for batch := range ch {
+//		if batch.Err != nil {
+//			return batch.Err
+//		}
+//		...
+//	}
+func (db *DBConnection) WatchWithOptions(ctx context.Context, q *Query, opts *WatchOptions) (<-chan ChangeBatch, error) {
+	if q.tx != nil {
+		return nil, errors.New("watch: query is part of a transaction")
+	}
+
+	w := &watcher{}
+	if opts != nil {
+		w.opts = *opts
+	}
+	if w.opts.Buffer < 0 {
+		return nil, fmt.Errorf("watch: negative buffer %d", w.opts.Buffer)
+	}
+	if w.opts.Buffer == 0 {
+		w.opts.Buffer = DefaultWatchBuffer
+	}
+
+	spec := q.spec
+	db.recordQuery(&spec)
+
+	// The listener shares run's context, so that it stops as soon as run
+	// returns rather than at its next snapshot.
+	ctx, cancel := context.WithCancel(ctx)
+	ch := make(chan ChangeBatch, w.opts.Buffer)
+	go w.run(ctx, cancel, db.listen(ctx, &spec), ch)
+
+	return ch, nil
+}
+
+type watcher struct {
+	opts WatchOptions
+
+	// sent is the last snapshot delivered, and prev its documents by path.
+	sent *BackendQuerySnapshot
+	prev map[string]*Snapshot
+}
+
+type watchResult struct {
+	snap *BackendQuerySnapshot
+	err  error
+}
+
+// run delivers the listener's snapshots to ch, and calls cancel when it
+// returns.
+func (w *watcher) run(ctx context.Context, cancel context.CancelFunc, it BackendQueryIterator, ch chan<- ChangeBatch) {
+	defer close(ch)
+	defer cancel()
+
+	results := make(chan watchResult)
+	go func() {
+		defer it.Stop()
+		for {
+			snap, err := it.Next()
+			select {
+			case results <- watchResult{snap, err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var pending *BackendQuerySnapshot
+	var next ChangeBatch
+	coalesced := 0
+	var failure error
+
+	for {
+		// Deliver the pending batch whenever there is room, so that
+		// snapshots are only coalesced or refused while the buffer is full.
+		if pending != nil {
+			select {
+			case ch <- next:
+				w.delivered(pending, next)
+				pending = nil
+				coalesced = 0
+			default:
+			}
+		}
+		if failure != nil && pending == nil {
+			break
+		}
+
+		in := results
+		var out chan<- ChangeBatch
+		if pending != nil {
+			out = ch
+			if w.opts.Policy == WatchBlock {
+				in = nil
+			}
+		}
+		if failure != nil {
+			in = nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case r := <-in:
+			if r.err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				failure = r.err
+				continue
+			}
+			if pending == nil {
+				pending = r.snap
+				next = w.batch(pending, 0)
+				continue
+			}
+
+			switch w.opts.Policy {
+			case WatchCoalesce:
+				coalesced++
+				pending = w.coalesce(r.snap)
+				next = w.batch(pending, coalesced)
+				if w.sent != nil && len(pending.Changes) == 0 {
+					pending = nil
+					coalesced = 0
+				}
+			case WatchFail:
+				failure = ErrSlowConsumer
+			}
+
+		case out <- next:
+			w.delivered(pending, next)
+			pending = nil
+			coalesced = 0
+		}
+	}
+
+	select {
+	case ch <- ChangeBatch{Err: failure}:
+	case <-ctx.Done():
+	}
+}
+
+// delivered records the last snapshot sent to the consumer.
+func (w *watcher) delivered(snap *BackendQuerySnapshot, batch ChangeBatch) {
+	w.sent = snap
+	w.prev = make(map[string]*Snapshot, len(batch.Docs))
+	for _, d := range batch.Docs {
+		w.prev[d.Path] = d
+	}
+}
+
+// coalesce returns snap with its changes replaced by those since the last
+// snapshot that was sent.
+func (w *watcher) coalesce(snap *BackendQuerySnapshot) *BackendQuerySnapshot {
+	if w.sent == nil {
+		resumed := *snap
+		resumed.Changes = make([]BackendDocumentChange, len(snap.Docs))
+		for i, d := range snap.Docs {
+			resumed.Changes[i] = BackendDocumentChange{Kind: DBCHANGE_DOC_ADDED, Doc: d, OldIndex: -1, NewIndex: i}
+		}
+		return &resumed
+	}
+	return resumedSnapshot(w.sent, snap)
+}
+
+// batch converts a snapshot into the batch that follows the last one sent.
+func (w *watcher) batch(snap *BackendQuerySnapshot, coalesced int) ChangeBatch {
+	batch := ChangeBatch{
+		Changes:   make([]Change[Snapshot], len(snap.Changes)),
+		Docs:      make([]*Snapshot, len(snap.Docs)),
+		ReadTime:  snap.ReadTime,
+		Coalesced: coalesced,
+	}
+
+	for i, d := range snap.Docs {
+		batch.Docs[i] = newSnapshot(d)
+	}
+
+	for i, c := range snap.Changes {
+		s := newSnapshot(c.Doc)
+		change := Change[Snapshot]{
+			Kind:     c.Kind,
+			ID:       s.ID,
+			Path:     s.Path,
+			OldIndex: c.OldIndex,
+			NewIndex: c.NewIndex,
+			ReadTime: snap.ReadTime,
+			Previous: w.prev[s.Path],
+		}
+		if c.Kind != DBCHANGE_DOC_REMOVED {
+			change.Value = s
+		}
+		batch.Changes[i] = change
+	}
+
+	return batch
+}
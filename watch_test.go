@@ -0,0 +1,256 @@
+package fsdb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func nextBatch(t *testing.T, ch <-chan ChangeBatch) ChangeBatch {
+	t.Helper()
+
+	select {
+	case batch, ok := <-ch:
+		if !ok {
+			t.Fatalf("watch channel closed")
+		}
+		return batch
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a batch")
+	}
+	return ChangeBatch{}
+}
+
+// describeBatch summarizes a batch's changes, e.g. "ADDED a -1 0".
+func describeBatch(batch ChangeBatch) string {
+	changes := make([]string, len(batch.Changes))
+	for i, c := range batch.Changes {
+		kind := strings.TrimPrefix(c.Kind.ToString(), "DBCHANGE_DOC_")
+		changes[i] = fmt.Sprintf("%s %s %d %d", kind, c.ID, c.OldIndex, c.NewIndex)
+	}
+	return strings.Join(changes, ", ")
+}
+
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := newTestDB(t)
+
+	for i, name := range []string{"alice", "bob", "carol"} {
+		err := db.Add(ctx, "users/"+name, &testUser{Name: name, Age: 20 + i, Tags: []string{"a"}})
+		if err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	q := db.Query("users").Where("tags", "array-contains", "a").OrderBy("Age", Asc)
+	ch, err := db.Watch(ctx, q)
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	q.Limit(1) // does not affect the watch
+
+	batch := nextBatch(t, ch)
+	if got := describeBatch(batch); got != "ADDED alice -1 0, ADDED bob -1 1, ADDED carol -1 2" {
+		t.Fatalf("first batch: %s", got)
+	}
+	if len(batch.Docs) != 3 || batch.ReadTime.IsZero() || batch.Changes[0].ReadTime != batch.ReadTime {
+		t.Fatalf("first batch: %d docs, read time %v", len(batch.Docs), batch.ReadTime)
+	}
+
+	err = db.Update(ctx, "users/alice", Set("Age", 30))
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	batch = nextBatch(t, ch)
+	changes, err := DecodeChanges[testUser](batch)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(changes) != 1 || changes[0].Kind != DBCHANGE_DOC_CHANGED || changes[0].OldIndex != 0 || changes[0].NewIndex != 2 ||
+		changes[0].Value.Age != 30 || changes[0].Previous.Age != 20 {
+		t.Fatalf("change: %#v", changes)
+	}
+
+	err = db.Update(ctx, "users/bob", Set("tags", []string{"b"}))
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	batch = nextBatch(t, ch)
+	changes, err = DecodeChanges[testUser](batch)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(changes) != 1 || changes[0].Kind != DBCHANGE_DOC_REMOVED || changes[0].ID != "bob" ||
+		changes[0].Value != nil || changes[0].Previous.Age != 21 {
+		t.Fatalf("removal: %#v", changes)
+	}
+
+	cancel()
+	for range ch {
+	}
+
+	ch, err = db.Watch(context.Background(), db.Query("users").Where("Age", "~", 1))
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	if batch := nextBatch(t, ch); batch.Err == nil {
+		t.Fatalf("bad query: got %s", describeBatch(batch))
+	}
+	if _, ok := <-ch; ok {
+		t.Fatalf("channel not closed after error")
+	}
+}
+
+// scriptedBackend serves listened-to queries from a fixed list of snapshots.
+type scriptedBackend struct {
+	Backend
+	snaps   []*BackendQuerySnapshot
+	drained chan struct{}
+	stopped chan struct{}
+}
+
+func (b *scriptedBackend) ListenQuery(ctx context.Context, q *QuerySpec) BackendQueryIterator {
+	return &scriptedQueryIterator{ctx: ctx, b: b, snaps: b.snaps}
+}
+
+type scriptedQueryIterator struct {
+	ctx   context.Context
+	b     *scriptedBackend
+	snaps []*BackendQuerySnapshot
+	once  sync.Once
+	stop  sync.Once
+}
+
+// Next returns the next snapshot. Once they have all been returned, it
+// closes b.drained and waits for the context to be done.
+func (it *scriptedQueryIterator) Next() (*BackendQuerySnapshot, error) {
+	if len(it.snaps) > 0 {
+		snap := it.snaps[0]
+		it.snaps = it.snaps[1:]
+		return snap, nil
+	}
+
+	it.once.Do(func() { close(it.b.drained) })
+	<-it.ctx.Done()
+	return nil, it.ctx.Err()
+}
+
+// Stop closes b.stopped, if it is set.
+func (it *scriptedQueryIterator) Stop() {
+	if it.b.stopped != nil {
+		it.stop.Do(func() { close(it.b.stopped) })
+	}
+}
+
+// recordSnapshots returns the snapshots of the users collection after each
+// of a series of writes.
+func recordSnapshots(t *testing.T) (*DBConnection, []*BackendQuerySnapshot) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	for _, name := range []string{"a", "b"} {
+		if err := db.Add(ctx, "users/"+name, &testUser{Name: name}); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	it := db.backend.ListenQuery(ctx, &QuerySpec{Collection: "users"})
+	defer it.Stop()
+
+	writes := []func() error{
+		func() error { return db.Update(ctx, "users/b", Set("Age", 1)) },
+		func() error { return db.Add(ctx, "users/c", &testUser{Name: "c"}) },
+		func() error { return db.Delete(ctx, "users/a") },
+	}
+
+	snaps := make([]*BackendQuerySnapshot, 0)
+	for i := 0; ; i++ {
+		snap, err := it.Next()
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		snaps = append(snaps, snap)
+		if i == len(writes) {
+			return db, snaps
+		}
+		if err := writes[i](); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+}
+
+func TestWatchSlowConsumer(t *testing.T) {
+	tests := []struct {
+		policy  WatchPolicy
+		snaps   int
+		drain   bool
+		batches []string
+		err     error
+	}{
+		{WatchBlock, 4, false, []string{
+			"ADDED a -1 0, ADDED b -1 1",
+			"CHANGED b 1 1",
+			"ADDED c -1 2",
+			"REMOVED a 0 -1",
+		}, nil},
+		{WatchCoalesce, 4, true, []string{
+			"ADDED a -1 0, ADDED b -1 1",
+			"REMOVED a 0 -1, ADDED c -1 1, CHANGED b 0 0",
+		}, nil},
+		{WatchFail, 3, true, []string{
+			"ADDED a -1 0, ADDED b -1 1",
+			"CHANGED b 1 1",
+		}, ErrSlowConsumer},
+	}
+
+	for _, tc := range tests {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		mem, snaps := recordSnapshots(t)
+		b := &scriptedBackend{Backend: mem.backend, snaps: snaps[:tc.snaps], drained: make(chan struct{}), stopped: make(chan struct{})}
+		db := NewDBConnectionFromBackend(mem.log, memoryProject, b)
+
+		ch, err := db.WatchWithOptions(ctx, db.Query("users"), &WatchOptions{Buffer: 1, Policy: tc.policy})
+		if err != nil {
+			t.Fatalf("policy %d: watch: %v", tc.policy, err)
+		}
+		if tc.drain {
+			<-b.drained
+		}
+
+		for i, want := range tc.batches {
+			batch := nextBatch(t, ch)
+			if got := describeBatch(batch); got != want || batch.Err != nil {
+				t.Fatalf("policy %d: batch %d is %q (%v), want %q", tc.policy, i, got, batch.Err, want)
+			}
+			if tc.policy == WatchCoalesce && i == 1 && batch.Coalesced != 2 {
+				t.Fatalf("coalesced %d snapshots, want 2", batch.Coalesced)
+			}
+			if i == 1 && batch.Changes[len(batch.Changes)-1].Previous == nil {
+				t.Fatalf("policy %d: no previous version", tc.policy)
+			}
+		}
+
+		if tc.err != nil {
+			if batch := nextBatch(t, ch); batch.Err != tc.err {
+				t.Fatalf("policy %d: got error %v, want %v", tc.policy, batch.Err, tc.err)
+			}
+			if _, ok := <-ch; ok {
+				t.Fatalf("policy %d: channel not closed after error", tc.policy)
+			}
+
+			// The listener stops with the watch, not when ctx is done.
+			select {
+			case <-b.stopped:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("policy %d: listener not stopped after error", tc.policy)
+			}
+		}
+
+		cancel()
+	}
+}